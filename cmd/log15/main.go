@@ -0,0 +1,128 @@
+// Command log15 holds tools for the logs written by log15 handlers.
+//
+// Usage:
+//
+//	log15 audit verify [-key-file file] [-pubkey-file file] [-first-seq n] file...
+//
+// audit verify checks the chain of files written by logext.AuditHandler
+// with LogfmtFormat or JsonFormat, and reports the records which are
+// missing, out of order or modified, and the bad checkpoints. The HMAC
+// key is read from -key-file, or from the LOG15_AUDIT_KEY environment
+// variable. If the checkpoints are signed with Ed25519, -pubkey-file names
+// a file with the hex encoded public key. Records missing before the first
+// one are reported unless -first-seq gives the sequence number the file is
+// expected to start with, like after a rotation. The exit status is 1 if
+// a problem was found.
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/inconshreveable/log15/ext"
+)
+
+const usage = "usage: log15 audit verify [-key-file file] [-pubkey-file file] [-first-seq n] file..."
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run runs the command with args and returns its exit status.
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) < 2 || args[0] != "audit" || args[1] != "verify" {
+		fmt.Fprintln(stderr, usage)
+		return 2
+	}
+
+	fs := flag.NewFlagSet("log15 audit verify", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	keyFile := fs.String("key-file", "", "`file` with the HMAC key (default $LOG15_AUDIT_KEY)")
+	pubFile := fs.String("pubkey-file", "", "`file` with the hex Ed25519 public key of the checkpoints")
+	firstSeq := fs.Uint64("first-seq", 1, "sequence `number` the files start with")
+	if err := fs.Parse(args[2:]); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintln(stderr, usage)
+		return 2
+	}
+
+	key, pub, err := loadKeys(*keyFile, *pubFile)
+	if err != nil {
+		fmt.Fprintln(stderr, "log15:", err)
+		return 2
+	}
+
+	status := 0
+	opts := ext.AuditVerifyOptions{PublicKey: pub, FirstSeq: *firstSeq}
+	for _, path := range fs.Args() {
+		ok, err := verifyFile(stdout, path, key, opts)
+		if err != nil {
+			fmt.Fprintf(stderr, "log15: %s: %v\n", path, err)
+			status = 1
+		} else if !ok {
+			status = 1
+		}
+	}
+	return status
+}
+
+func loadKeys(keyFile, pubFile string) ([]byte, ed25519.PublicKey, error) {
+	var key []byte
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		key = bytes.TrimRight(data, "\r\n")
+	} else {
+		key = []byte(os.Getenv("LOG15_AUDIT_KEY"))
+	}
+	if len(key) == 0 {
+		return nil, nil, errors.New("no audit key, set -key-file or LOG15_AUDIT_KEY")
+	}
+
+	if pubFile == "" {
+		return key, nil, nil
+	}
+	data, err := os.ReadFile(pubFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	pub, err := hex.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, nil, fmt.Errorf("%s: not a hex Ed25519 public key", pubFile)
+	}
+	return key, ed25519.PublicKey(pub), nil
+}
+
+// verifyFile prints the problems of the file at path and a summary. It
+// reports whether the file is intact.
+func verifyFile(w io.Writer, path string, key []byte, opts ext.AuditVerifyOptions) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	report, err := ext.VerifyAudit(f, key, opts)
+	if err != nil {
+		return false, err
+	}
+
+	for _, p := range report.Problems {
+		fmt.Fprintf(w, "%s: %v\n", path, p)
+	}
+	fmt.Fprintf(w, "%s: %d records (seq %d to %d), %d checkpoints, %d problems\n",
+		path, report.Records, report.FirstSeq, report.LastSeq, report.Checkpoints, len(report.Problems))
+	if report.Unsealed > 0 {
+		fmt.Fprintf(w, "%s: %d records after the last checkpoint could have been truncated\n", path, report.Unsealed)
+	}
+	return len(report.Problems) == 0, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/inconshreveable/log15/ext"
+)
+
+func TestAuditVerify(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	keyFile := filepath.Join(dir, "key")
+	os.WriteFile(keyFile, []byte("secret\n"), 0600)
+
+	h, err := ext.AuditFileHandler(path, log.LogfmtFormat(), []byte("secret"), ext.AuditOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := log.New()
+	l.SetHandler(h)
+	l.Info("login", "user", "bob")
+	l.Info("logout", "user", "bob")
+	h.Close()
+
+	var stdout, stderr bytes.Buffer
+	if status := run([]string{"audit", "verify", "-key-file", keyFile, path}, &stdout, &stderr); status != 0 {
+		t.Fatalf("expected status 0, got %d: %s%s", status, stdout.String(), stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "3 records (seq 1 to 3), 1 checkpoints, 0 problems") {
+		t.Fatalf("unexpected output %q", stdout.String())
+	}
+
+	// the first record removed
+	data, _ := os.ReadFile(path)
+	headless := filepath.Join(dir, "headless.log")
+	os.WriteFile(headless, data[bytes.IndexByte(data, '\n')+1:], 0644)
+	stdout.Reset()
+	if status := run([]string{"audit", "verify", "-key-file", keyFile, headless}, &stdout, &stderr); status != 1 {
+		t.Fatalf("expected status 1, got %d: %s", status, stdout.String())
+	}
+	if !strings.Contains(stdout.String(), "line 1 (seq 2): records missing: seq 1 to 1") {
+		t.Fatalf("unexpected output %q", stdout.String())
+	}
+	stdout.Reset()
+	if status := run([]string{"audit", "verify", "-key-file", keyFile, "-first-seq", "2", headless}, &stdout, &stderr); status != 0 {
+		t.Fatalf("expected status 0, got %d: %s", status, stdout.String())
+	}
+
+	os.WriteFile(path, bytes.Replace(data, []byte("user=bob"), []byte("user=eve"), 1), 0644)
+	stdout.Reset()
+	t.Setenv("LOG15_AUDIT_KEY", "secret")
+	if status := run([]string{"audit", "verify", path}, &stdout, &stderr); status != 1 {
+		t.Fatalf("expected status 1, got %d: %s", status, stdout.String())
+	}
+	if !strings.Contains(stdout.String(), "line 1 (seq 1): record modified") {
+		t.Fatalf("unexpected output %q", stdout.String())
+	}
+
+	if status := run([]string{"audit"}, &stdout, &stderr); status != 2 {
+		t.Fatalf("expected usage status 2, got %d", status)
+	}
+}
@@ -0,0 +1,191 @@
+// Command log15d collects the records which processes send with log15's
+// NetHandler and writes them to a log15 handler tree.
+//
+// Usage:
+//
+//	log15d [-config handlers.json] [-addr-key remote] -listen URL...
+//
+// Each -listen URL names a network, an address and optionally the format
+// of the records, logfmt by default:
+//
+//	log15d -listen tcp://:7000 -listen 'udp://:7001?format=binary' \
+//	    -listen 'unix:///run/log15d.sock?format=json'
+//
+// The supported networks are tcp, udp, unix and unixgram. The handler tree
+// is described by a JSON file as understood by log15.HandlerFromJSON, like
+//
+//	{"type": "file", "path": "/var/log/all.log", "format": "json"}
+//
+// Without -config, records are written to stdout with LogfmtFormat.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/inconshreveable/log15/receiver"
+)
+
+type listenFlags []string
+
+func (f *listenFlags) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *listenFlags) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+func main() {
+	var listen listenFlags
+	flag.Var(&listen, "listen", "`URL` to receive records on, like tcp://:7000?format=json (repeatable)")
+	config := flag.String("config", "", "JSON `file` describing the handler tree")
+	addrKey := flag.String("addr-key", "", "context `key` for the address of the sender")
+	flag.Parse()
+
+	logger := log.New("module", "log15d")
+	logger.SetHandler(log.StreamHandler(os.Stderr, log.LogfmtFormat()))
+
+	if len(listen) == 0 {
+		fmt.Fprintln(os.Stderr, "log15d: at least one -listen URL is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	h := log.StdoutHandler
+	// the handlers of the tree which are closed on shutdown, children
+	// first since they are built first
+	var closers []io.Closer
+	if *config != "" {
+		data, err := os.ReadFile(*config)
+		if err != nil {
+			logger.Crit("can't read config", "err", err)
+			os.Exit(1)
+		}
+		var c log.Config
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&c); err != nil {
+			logger.Crit("bad config", "path", *config, "err", err)
+			os.Exit(1)
+		}
+		h, err = c.BuildWith(func(path string, h log.Handler) log.Handler {
+			if closer, ok := h.(io.Closer); ok {
+				closers = append(closers, closer)
+			}
+			return h
+		})
+		if err != nil {
+			logger.Crit("bad config", "path", *config, "err", err)
+			os.Exit(1)
+		}
+	}
+
+	receivers := make([]*receiver.Receiver, 0, len(listen))
+	errc := make(chan error, len(listen))
+	for _, u := range listen {
+		network, addr, format, err := parseListenURL(u)
+		if err != nil {
+			logger.Crit("bad listen URL", "url", u, "err", err)
+			os.Exit(2)
+		}
+		rc := &receiver.Receiver{
+			Handler:  h,
+			Format:   format,
+			AddrKey:  *addrKey,
+			ErrorLog: logger.New("listen", u),
+		}
+		receivers = append(receivers, rc)
+
+		if network == "unix" || network == "unixgram" {
+			removeStaleSocket(network, addr)
+		}
+		logger.Info("listening", "network", network, "addr", addr, "format", format)
+		go func() {
+			errc <- rc.ListenAndServe(network, addr)
+		}()
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+	status := 0
+	select {
+	case s := <-sig:
+		logger.Info("shutting down", "signal", s)
+	case err := <-errc:
+		logger.Crit("receiver failed", "err", err)
+		status = 1
+	}
+	for _, rc := range receivers {
+		rc.Close()
+	}
+	// parents first, so that they can still write to their children
+	for i := len(closers) - 1; i >= 0; i-- {
+		if err := closers[i].Close(); err != nil {
+			logger.Error("can't close handler", "err", err)
+		}
+	}
+	os.Exit(status)
+}
+
+// parseListenURL splits a -listen URL into the network, the address and
+// the format of the records.
+func parseListenURL(s string) (network, addr, format string, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", "", err
+	}
+	network = u.Scheme
+	switch network {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+		addr = u.Host
+	case "unix", "unixgram":
+		addr = u.Path
+	default:
+		return "", "", "", fmt.Errorf("unsupported network %q", network)
+	}
+	if addr == "" {
+		return "", "", "", fmt.Errorf("missing address")
+	}
+
+	format = u.Query().Get("format")
+	switch format {
+	case "":
+		format = receiver.FormatLogfmt
+	case receiver.FormatLogfmt, receiver.FormatJSON, receiver.FormatBinary:
+	default:
+		return "", "", "", fmt.Errorf("unknown format %q", format)
+	}
+	return network, addr, format, nil
+}
+
+// removeStaleSocket removes the socket file left at path by a previous
+// run, so that it can be listened on again. A socket which a process still
+// listens on is left alone.
+func removeStaleSocket(network, path string) {
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	conn, err := net.Dial(network, path)
+	if err == nil {
+		conn.Close()
+		return
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		os.Remove(path)
+	}
+}
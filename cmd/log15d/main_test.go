@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseListenURL(t *testing.T) {
+	for _, tc := range []struct {
+		url, network, addr, format string
+	}{
+		{"tcp://:7000", "tcp", ":7000", "logfmt"},
+		{"udp://127.0.0.1:7001?format=binary", "udp", "127.0.0.1:7001", "binary"},
+		{"unix:///run/log15d.sock?format=json", "unix", "/run/log15d.sock", "json"},
+	} {
+		network, addr, format, err := parseListenURL(tc.url)
+		if err != nil || network != tc.network || addr != tc.addr || format != tc.format {
+			t.Errorf("%s: got %s %s %s %v", tc.url, network, addr, format, err)
+		}
+	}
+
+	for _, bad := range []string{"http://:80", "tcp://", "tcp://:7000?format=xml"} {
+		if _, _, _, err := parseListenURL(bad); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+	live := filepath.Join(dir, "live.sock")
+	l, err := net.Listen("unix", live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	removeStaleSocket("unix", live)
+	if _, err := os.Stat(live); err != nil {
+		t.Fatalf("removed the socket of a listening process: %v", err)
+	}
+
+	stale := filepath.Join(dir, "stale.sock")
+	sl, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// keep the file, like a process which died without closing it
+	sl.(*net.UnixListener).SetUnlinkOnClose(false)
+	sl.Close()
+	removeStaleSocket("unix", stale)
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("stale socket wasn't removed: %v", err)
+	}
+}
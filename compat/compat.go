@@ -15,6 +15,10 @@
 package compat
 
 import (
+	"runtime"
+	"strings"
+
+	"github.com/go-stack/stack"
 	legacy "github.com/inconshreveable/log15"
 	"github.com/inconshreveable/log15/v3"
 )
@@ -35,6 +39,7 @@ func fromLegacyRecord(r *legacy.Record) log15.Record {
 			Msg:  r.KeyNames.Msg,
 			Time: r.KeyNames.Time,
 		},
+		PC: legacyCallPC(r.Call),
 	}
 }
 
@@ -50,10 +55,52 @@ func toLegacyRecord(r log15.Record) *legacy.Record {
 		Lvl:      legacy.Lvl(r.Lvl),
 		Msg:      r.Msg,
 		Ctx:      r.Ctx,
+		Call:     legacyCall(r.PC),
 		KeyNames: keyNames,
 	}
 }
 
+// legacyCallPC returns the program counter of c in the form of Record.PC.
+func legacyCallPC(c stack.Call) uintptr {
+	frame := c.Frame()
+	if frame.PC == 0 {
+		return 0
+	}
+	// the frame's PC is the call instruction itself, while Record.PC holds
+	// the return address like the program counters from runtime.Callers
+	return frame.PC + 1
+}
+
+// legacyCall returns the call site at pc as a stack.Call. A stack.Call can
+// only be taken from the current goroutine's stack, so this looks for the
+// call site there, walking up through the frames of log15 only. It returns
+// the zero Call if the record is handled on a different goroutine than the
+// one which logged it, or if it was logged through a helper function.
+func legacyCall(pc uintptr) stack.Call {
+	if pc == 0 {
+		return stack.Call{}
+	}
+	site, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	for skip := 1; ; skip++ {
+		c := stack.Caller(skip)
+		frame := c.Frame()
+		if frame.PC == site.PC && frame.Function == site.Function {
+			return c
+		}
+		if frame.PC == 0 || !isLog15Func(frame.Function) {
+			return stack.Call{}
+		}
+	}
+}
+
+// isLog15Func reports whether fn, the name of a function, belongs to one of
+// the log15 packages.
+func isLog15Func(fn string) bool {
+	const module = "github.com/inconshreveable/log15"
+	rest, ok := strings.CutPrefix(fn, module)
+	return ok && (strings.HasPrefix(rest, ".") || strings.HasPrefix(rest, "/"))
+}
+
 func (c *compat) Log(r *legacy.Record) error {
 	return c.Handler.Log(fromLegacyRecord(r))
 }
@@ -63,6 +110,10 @@ func (c *compat) GetHandler() legacy.Handler {
 }
 
 func (c *compat) SetHandler(h legacy.Handler) {
+	// Record.Call is only looked up for the legacy handlers which read it
+	if legacy.CapturesCallers() {
+		log15.CaptureCallers()
+	}
 	c.Logger.SetHandler(log15.FuncHandler(func(r log15.Record) error {
 		return h.Log(toLegacyRecord(r))
 	}))
@@ -72,18 +123,46 @@ func (c *compat) New(args ...interface{}) legacy.Logger {
 	return &compat{Logger: c.Logger.New(args...)}
 }
 
+// WithDupKeyPolicy implements legacy.DupKeyPolicyLogger. If the wrapped
+// logger isn't a log15.DupKeyPolicyLogger, p is ignored and c is returned
+// unchanged, so duplicate keys are kept as they are.
+func (c *compat) WithDupKeyPolicy(p legacy.DupKeyPolicy) legacy.Logger {
+	l, ok := c.Logger.(log15.DupKeyPolicyLogger)
+	if !ok {
+		return c
+	}
+	return &compat{Logger: l.WithDupKeyPolicy(log15.DupKeyPolicy(p))}
+}
+
+// WithCallerSkip implements legacy.CallerSkipLogger. If the wrapped logger
+// isn't a log15.CallerSkipLogger, skip is ignored and c is returned
+// unchanged, so records report the call site in the wrapper.
+func (c *compat) WithCallerSkip(skip int) legacy.Logger {
+	l, ok := c.Logger.(log15.CallerSkipLogger)
+	if !ok {
+		return c
+	}
+	return &compat{Logger: l.WithCallerSkip(skip)}
+}
+
 // CompatHandler wraps a handler for use with pre-v3 log15.Handler consumers.
 func CompatHandler(h log15.Handler) legacy.Handler {
 	return &compat{Handler: h}
 }
 
 // CompatLogger wraps a Logger for use with pre-v3 log15.Logger consumers.
+// The returned logger always implements legacy.DupKeyPolicyLogger and
+// legacy.CallerSkipLogger, but their methods only take effect if l
+// implements log15.DupKeyPolicyLogger and log15.CallerSkipLogger, like the
+// loggers returned by log15.New and log15.Root. Check l for them if it
+// matters.
 func CompatLogger(l log15.Logger) legacy.Logger {
 	return &compat{Logger: l}
 }
 
 // Interface assertions to make sure we got everything right
 var _ interface {
-	legacy.Logger
+	legacy.DupKeyPolicyLogger
+	legacy.CallerSkipLogger
 	legacy.Handler
 } = (*compat)(nil)
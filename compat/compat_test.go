@@ -2,6 +2,8 @@ package compat
 
 import (
 	"bytes"
+	"fmt"
+	"runtime"
 	"testing"
 	"time"
 
@@ -311,3 +313,53 @@ func containsAll(s string, subs ...string) bool {
 	}
 	return true
 }
+
+func TestCompatHandlerCaller(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	v3Handler := log15.CallerFileHandler(log15.StreamHandler(&buf, log15.LogfmtFormat()))
+
+	legacyLogger := legacy.New()
+	legacyLogger.SetHandler(CompatHandler(v3Handler))
+	legacyLogger.Info("test")
+	_, _, line, _ := runtime.Caller(0)
+
+	exp := fmt.Sprint("caller=compat_test.go:", line-1)
+	if !containsAll(buf.String(), exp) {
+		t.Errorf("Caller not preserved: got %s, want %s", buf.String(), exp)
+	}
+}
+
+func TestCompatLoggerCaller(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	legacyHandler := legacy.CallerFileHandler(legacy.StreamHandler(&buf, legacy.LogfmtFormat()))
+
+	legacyLogger := CompatLogger(log15.New())
+	legacyLogger.SetHandler(legacyHandler)
+	legacyLogger.Info("test")
+	_, _, line, _ := runtime.Caller(0)
+
+	exp := fmt.Sprint("caller=compat_test.go:", line-1)
+	if !containsAll(buf.String(), exp) {
+		t.Errorf("Caller not preserved: got %s, want %s", buf.String(), exp)
+	}
+}
+
+func TestLegacyCallOtherGoroutine(t *testing.T) {
+	t.Parallel()
+
+	// the call site of a record logged on another goroutine isn't on this
+	// goroutine's stack
+	pcs := make(chan uintptr)
+	go func() {
+		var pc [1]uintptr
+		runtime.Callers(1, pc[:])
+		pcs <- pc[0]
+	}()
+	if c := legacyCall(<-pcs); c.Frame().PC != 0 {
+		t.Errorf("expected the zero Call, got %v", c)
+	}
+}
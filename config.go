@@ -0,0 +1,441 @@
+package log15
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// Config describes a tree of handlers. It is usually decoded from JSON,
+// for example:
+//
+//	{
+//	    "type": "multi",
+//	    "handlers": [
+//	        {"type": "file", "path": "/var/log/app.json", "format": "json", "level": "info"},
+//	        {"type": "stderr", "level": "error"}
+//	    ]
+//	}
+//
+// Type selects the handler. The built-in types are:
+//
+//	stdout, stderr  StdoutHandler/StderrHandler, or a StreamHandler if format is set
+//	discard         DiscardHandler
+//	file            FileHandler; requires path
+//	net             NetHandler; requires addr, network defaults to "tcp"
+//	syslog          SyslogHandler, or SyslogNetHandler if addr is set
+//	lvlfilter       LvlFilterHandler around handler; requires level
+//	matchfilter     MatchFilterHandler around handler; requires key
+//	buffered        BufferedHandler around handler
+//	failover        FailoverHandler over handlers
+//	multi           MultiHandler over handlers
+//
+// More types may be added with RegisterHandlerType. Any handler which has
+// a level is wrapped in a LvlFilterHandler.
+type Config struct {
+	Type string `json:"type"`
+
+	// Level is the maximum level of the records passed to the handler,
+	// as understood by LvlFromString.
+	Level string `json:"level,omitempty"`
+
+	// Format is one of "logfmt", "json", "json-pretty" or "terminal".
+	// It defaults to "logfmt".
+	Format string `json:"format,omitempty"`
+
+	Path     string      `json:"path,omitempty"`
+	Network  string      `json:"network,omitempty"`
+	Addr     string      `json:"addr,omitempty"`
+	Tag      string      `json:"tag,omitempty"`
+	Facility string      `json:"facility,omitempty"`
+	Key      string      `json:"key,omitempty"`
+	Value    interface{} `json:"value,omitempty"`
+	BufSize  int         `json:"bufSize,omitempty"`
+
+	// Handler and Handlers are the configurations of the handlers
+	// which this handler wraps.
+	Handler  *Config   `json:"handler,omitempty"`
+	Handlers []*Config `json:"handlers,omitempty"`
+
+	// Options holds the settings of handler types which were added
+	// with RegisterHandlerType.
+	Options json.RawMessage `json:"options,omitempty"`
+}
+
+// A ConfigError describes an invalid Config. Path locates the offending
+// value, e.g. "$.handlers[1].level".
+type ConfigError struct {
+	Path string
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("log15: invalid config at %s: %v", e.Path, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// A HandlerFactory builds a Handler of a registered type from its Config.
+// The handlers which c wraps, its Handler followed by its Handlers, are
+// built first and passed as children. The level of c is applied by the
+// caller. A HandlerFactory may return a *ConfigError with a path relative
+// to c, like "options.url", to point at the offending setting.
+type HandlerFactory func(c *Config, children []Handler) (Handler, error)
+
+var handlerTypes = struct {
+	sync.RWMutex
+	m map[string]HandlerFactory
+}{m: make(map[string]HandlerFactory)}
+
+// RegisterHandlerType makes a handler type available to Config. It
+// panics if f is nil or if a type with the same name already exists.
+func RegisterHandlerType(typ string, f HandlerFactory) {
+	handlerTypes.Lock()
+	defer handlerTypes.Unlock()
+	if f == nil {
+		panic("log15: RegisterHandlerType factory is nil")
+	}
+	if _, dup := handlerTypes.m[typ]; dup {
+		panic("log15: RegisterHandlerType called twice for type " + typ)
+	}
+	handlerTypes.m[typ] = f
+}
+
+// HandlerFromJSON decodes a Config from data and builds it.
+func HandlerFromJSON(data []byte) (Handler, error) {
+	c, err := decodeConfig(data, "$")
+	if err != nil {
+		return nil, err
+	}
+	return c.Build()
+}
+
+// decodeConfig decodes the Config at path one node at a time, so that a
+// decoding error points at the node, or the field, where it happened.
+func decodeConfig(data []byte, path string) (*Config, error) {
+	var node struct {
+		*Config
+		// the children are decoded with their own paths
+		Handler  json.RawMessage   `json:"handler,omitempty"`
+		Handlers []json.RawMessage `json:"handlers,omitempty"`
+	}
+	node.Config = new(Config)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&node); err != nil {
+		var terr *json.UnmarshalTypeError
+		if errors.As(err, &terr) && terr.Field != "" {
+			path += "." + terr.Field
+		}
+		return nil, &ConfigError{Path: path, Err: err}
+	}
+
+	c := node.Config
+	if len(node.Handler) > 0 && string(node.Handler) != "null" {
+		child, err := decodeConfig(node.Handler, path+".handler")
+		if err != nil {
+			return nil, err
+		}
+		c.Handler = child
+	}
+	for i, raw := range node.Handlers {
+		if string(raw) == "null" {
+			c.Handlers = append(c.Handlers, nil)
+			continue
+		}
+		child, err := decodeConfig(raw, fmt.Sprintf("%s.handlers[%d]", path, i))
+		if err != nil {
+			return nil, err
+		}
+		c.Handlers = append(c.Handlers, child)
+	}
+	return c, nil
+}
+
+// Build builds the handler tree described by c. If a handler of the tree
+// can't be built, the handlers which were built before it are closed.
+func (c *Config) Build() (Handler, error) {
+	return c.BuildWith(nil)
+}
+
+// BuildWith is like Build, but passes each handler of the tree through
+// wrap as soon as it is built, along with its path in c, e.g.
+// "$.handlers[0]". It lets you decorate every handler of a tree, for
+// example to instrument it.
+func (c *Config) BuildWith(wrap func(path string, h Handler) Handler) (Handler, error) {
+	var built []Handler
+	h, err := c.build("$", wrap, &built)
+	if err != nil {
+		for _, b := range built {
+			if closer, ok := b.(io.Closer); ok {
+				closer.Close()
+			}
+		}
+		return nil, err
+	}
+	return h, nil
+}
+
+// build builds the tree of c and adds the handlers it builds to built.
+func (c *Config) build(path string, wrap func(path string, h Handler) Handler, built *[]Handler) (Handler, error) {
+	if c == nil {
+		return nil, &ConfigError{Path: path, Err: errors.New("missing handler")}
+	}
+
+	handlerTypes.RLock()
+	f, ok := handlerTypes.m[c.Type]
+	handlerTypes.RUnlock()
+	if !ok {
+		return nil, &ConfigError{Path: path + ".type", Err: fmt.Errorf("unknown handler type %q", c.Type)}
+	}
+
+	var lvl Lvl
+	if c.Level != "" {
+		var err error
+		if lvl, err = LvlFromString(c.Level); err != nil {
+			return nil, &ConfigError{Path: path + ".level", Err: err}
+		}
+	}
+
+	var children []Handler
+	if c.Handler != nil {
+		h, err := c.Handler.build(path+".handler", wrap, built)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, h)
+	}
+	for i, child := range c.Handlers {
+		h, err := child.build(fmt.Sprintf("%s.handlers[%d]", path, i), wrap, built)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, h)
+	}
+
+	h, err := f(c, children)
+	if err != nil {
+		if cerr, ok := err.(*ConfigError); ok {
+			return nil, &ConfigError{Path: path + "." + cerr.Path, Err: cerr.Err}
+		}
+		return nil, &ConfigError{Path: path, Err: err}
+	}
+	*built = append(*built, h)
+
+	if wrap != nil {
+		h = wrap(path, h)
+	}
+	if c.Level != "" {
+		h = LvlFilterHandler(lvl, h)
+	}
+	return h, nil
+}
+
+// BuildFormat returns the Format named by c.Format.
+func (c *Config) BuildFormat() (Format, error) {
+	switch c.Format {
+	case "", "logfmt":
+		return LogfmtFormat(), nil
+	case "json":
+		return JsonFormat(), nil
+	case "json-pretty":
+		return JsonFormatEx(true, true), nil
+	case "terminal":
+		return TerminalFormat(), nil
+	default:
+		return nil, &ConfigError{Path: "format", Err: fmt.Errorf("unknown format %q", c.Format)}
+	}
+}
+
+// require returns an error for the first of the named settings of c which
+// is empty.
+func (c *Config) require(settings ...string) error {
+	for _, s := range settings {
+		var v string
+		switch s {
+		case "path":
+			v = c.Path
+		case "addr":
+			v = c.Addr
+		case "level":
+			v = c.Level
+		case "key":
+			v = c.Key
+		}
+		if v == "" {
+			return &ConfigError{Path: s, Err: fmt.Errorf("%s handler requires %s", c.Type, s)}
+		}
+	}
+	return nil
+}
+
+// checkChildren returns an error unless there are between min and max children.
+// A max of -1 means there is no upper bound.
+func checkChildren(c *Config, children []Handler, min, max int) error {
+	n := len(children)
+	switch {
+	case max == 0 && n > 0:
+		return fmt.Errorf("%s handler doesn't wrap other handlers", c.Type)
+	case min == 1 && max == 1 && n != 1:
+		return fmt.Errorf("%s handler requires exactly one handler", c.Type)
+	case n < min:
+		return fmt.Errorf("%s handler requires at least %d handlers", c.Type, min)
+	}
+	return nil
+}
+
+// HandlerTypes returns the sorted names of the handler types available
+// to Config.
+func HandlerTypes() []string {
+	handlerTypes.RLock()
+	defer handlerTypes.RUnlock()
+	types := make([]string, 0, len(handlerTypes.m))
+	for typ := range handlerTypes.m {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func init() {
+	stream := func(std *os.File, dflt func() Handler) HandlerFactory {
+		return func(c *Config, children []Handler) (Handler, error) {
+			if err := checkChildren(c, children, 0, 0); err != nil {
+				return nil, err
+			}
+			if c.Format == "" {
+				return dflt(), nil
+			}
+			fmtr, err := c.BuildFormat()
+			if err != nil {
+				return nil, err
+			}
+			return StreamHandler(std, fmtr), nil
+		}
+	}
+	RegisterHandlerType("stdout", stream(os.Stdout, func() Handler { return StdoutHandler }))
+	RegisterHandlerType("stderr", stream(os.Stderr, func() Handler { return StderrHandler }))
+
+	RegisterHandlerType("discard", func(c *Config, children []Handler) (Handler, error) {
+		if err := checkChildren(c, children, 0, 0); err != nil {
+			return nil, err
+		}
+		return DiscardHandler(), nil
+	})
+
+	RegisterHandlerType("file", func(c *Config, children []Handler) (Handler, error) {
+		if err := checkChildren(c, children, 0, 0); err != nil {
+			return nil, err
+		}
+		if err := c.require("path"); err != nil {
+			return nil, err
+		}
+		fmtr, err := c.BuildFormat()
+		if err != nil {
+			return nil, err
+		}
+		return FileHandler(c.Path, fmtr)
+	})
+
+	RegisterHandlerType("net", func(c *Config, children []Handler) (Handler, error) {
+		if err := checkChildren(c, children, 0, 0); err != nil {
+			return nil, err
+		}
+		if err := c.require("addr"); err != nil {
+			return nil, err
+		}
+		fmtr, err := c.BuildFormat()
+		if err != nil {
+			return nil, err
+		}
+		network := c.Network
+		if network == "" {
+			network = "tcp"
+		}
+		return NetHandler(network, c.Addr, fmtr)
+	})
+
+	RegisterHandlerType("lvlfilter", func(c *Config, children []Handler) (Handler, error) {
+		if err := checkChildren(c, children, 1, 1); err != nil {
+			return nil, err
+		}
+		if err := c.require("level"); err != nil {
+			return nil, err
+		}
+		// the level filter itself is applied by Config.build
+		return children[0], nil
+	})
+
+	RegisterHandlerType("matchfilter", func(c *Config, children []Handler) (Handler, error) {
+		if err := checkChildren(c, children, 1, 1); err != nil {
+			return nil, err
+		}
+		if err := c.require("key"); err != nil {
+			return nil, err
+		}
+		if v, ok := c.Value.(float64); ok {
+			return numberFilterHandler(c.Key, v, children[0]), nil
+		}
+		return MatchFilterHandler(c.Key, c.Value, children[0]), nil
+	})
+
+	RegisterHandlerType("buffered", func(c *Config, children []Handler) (Handler, error) {
+		if err := checkChildren(c, children, 1, 1); err != nil {
+			return nil, err
+		}
+		if c.BufSize < 0 {
+			return nil, &ConfigError{Path: "bufSize", Err: errors.New("must not be negative")}
+		}
+		return BufferedHandler(c.BufSize, children[0]), nil
+	})
+
+	RegisterHandlerType("failover", func(c *Config, children []Handler) (Handler, error) {
+		if err := checkChildren(c, children, 1, -1); err != nil {
+			return nil, err
+		}
+		return FailoverHandler(children...), nil
+	})
+
+	RegisterHandlerType("multi", func(c *Config, children []Handler) (Handler, error) {
+		if err := checkChildren(c, children, 1, -1); err != nil {
+			return nil, err
+		}
+		return MultiHandler(children...), nil
+	})
+}
+
+// numberFilterHandler is MatchFilterHandler for a number decoded from
+// JSON, which is a float64: it matches the context values of any numeric
+// type which are equal to v.
+func numberFilterHandler(key string, v float64, h Handler) Handler {
+	return FilterHandler(func(r *Record) bool {
+		for i := 0; i+1 < len(r.Ctx); i += 2 {
+			if r.Ctx[i] == key {
+				f, ok := toFloat(r.Ctx[i+1])
+				return ok && f == v
+			}
+		}
+		return false
+	}, h)
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
@@ -0,0 +1,60 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package log15
+
+import (
+	"fmt"
+	"log/syslog"
+	"strings"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+func init() {
+	RegisterHandlerType("syslog", func(c *Config, children []Handler) (Handler, error) {
+		if err := checkChildren(c, children, 0, 0); err != nil {
+			return nil, err
+		}
+		fmtr, err := c.BuildFormat()
+		if err != nil {
+			return nil, err
+		}
+
+		facility := syslog.LOG_USER
+		if c.Facility != "" {
+			var ok bool
+			if facility, ok = syslogFacilities[strings.ToLower(c.Facility)]; !ok {
+				return nil, &ConfigError{Path: "facility", Err: fmt.Errorf("unknown syslog facility %q", c.Facility)}
+			}
+		}
+
+		// the severity is chosen for each record by its level
+		priority := facility | syslog.LOG_INFO
+		if c.Addr != "" {
+			return SyslogNetHandler(c.Network, c.Addr, priority, c.Tag, fmtr)
+		}
+		return SyslogHandler(priority, c.Tag, fmtr)
+	})
+}
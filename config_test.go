@@ -0,0 +1,183 @@
+package log15
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// the handler types of the tests are registered once, since
+// RegisterHandlerType panics for a type which is registered twice
+var (
+	prefixHandler, prefixRecord           = testHandler()
+	matchNumberHandler, matchNumberRecord = testHandler()
+)
+
+func init() {
+	RegisterHandlerType("test-prefix", func(c *Config, children []Handler) (Handler, error) {
+		var prefix string
+		if err := json.Unmarshal(c.Options, &prefix); err != nil {
+			return nil, &ConfigError{Path: "options", Err: err}
+		}
+		return FuncHandler(func(r *Record) error {
+			r.Msg = prefix + r.Msg
+			return prefixHandler.Log(r)
+		}), nil
+	})
+	RegisterHandlerType("test-match-number", func(c *Config, children []Handler) (Handler, error) {
+		return matchNumberHandler, nil
+	})
+}
+
+func TestConfigFile(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	infoPath := filepath.Join(dir, "info.log")
+	errPath := filepath.Join(dir, "error.log")
+
+	h, err := HandlerFromJSON([]byte(`{
+		"type": "multi",
+		"handlers": [
+			{"type": "file", "path": "` + infoPath + `", "level": "info"},
+			{"type": "lvlfilter", "level": "error", "handler":
+				{"type": "file", "path": "` + errPath + `", "format": "json"}}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := New()
+	l.SetHandler(h)
+	l.Debug("debug")
+	l.Info("info")
+	l.Error("error")
+
+	info, err := os.ReadFile(infoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(info), "\n") != 2 || strings.Contains(string(info), "debug") {
+		t.Fatalf("unexpected info.log contents: %s", info)
+	}
+
+	errs, err := os.ReadFile(errPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(errs), "{") || !strings.Contains(string(errs), `"msg":"error"`) {
+		t.Fatalf("unexpected error.log contents: %s", errs)
+	}
+}
+
+func TestConfigErrorPath(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		config, path string
+	}{
+		{`{"type": "nope"}`, "$.type"},
+		{`{"type": "multi", "handlers": [{"type": "discard"}, {"type": "file"}]}`, "$.handlers[1].path"},
+		{`{"type": "multi", "handlers": [{"type": "stdout", "level": "loud"}]}`, "$.handlers[0].level"},
+		{`{"type": "buffered", "handler": {"type": "stdout", "format": "xml"}}`, "$.handler.format"},
+		{`{"type": "failover"}`, "$"},
+		{`{"type": "stdout", "lvl": "info"}`, "$"},
+		{`{"type": "multi", "handlers": [{"type": "discard"}, {"type": "stdout", "lvl": "info"}]}`, "$.handlers[1]"},
+		{`{"type": "buffered", "handler": {"type": "discard", "bufSize": "big"}}`, "$.handler.bufSize"},
+		{`{"type": "multi", "handlers": [{"type": "discard"}, {"type": 1}]}`, "$.handlers[1].type"},
+	}
+
+	for _, tt := range cases {
+		_, err := HandlerFromJSON([]byte(tt.config))
+		var cerr *ConfigError
+		if !errors.As(err, &cerr) {
+			t.Errorf("%s: expected ConfigError, got %v", tt.config, err)
+			continue
+		}
+		if cerr.Path != tt.path {
+			t.Errorf("%s: got error path %s, expected %s: %v", tt.config, cerr.Path, tt.path, err)
+		}
+	}
+}
+
+func TestConfigRegisterHandlerType(t *testing.T) {
+	t.Parallel()
+
+	r := prefixRecord
+	ch, err := HandlerFromJSON([]byte(`{"type": "test-prefix", "options": "app: "}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := New()
+	l.SetHandler(ch)
+	l.Info("test")
+	if r.Msg != "app: test" {
+		t.Fatalf("got msg %q, expected %q", r.Msg, "app: test")
+	}
+
+	_, err = HandlerFromJSON([]byte(`{"type": "multi", "handlers": [{"type": "test-prefix", "options": 1}]}`))
+	var cerr *ConfigError
+	if !errors.As(err, &cerr) || cerr.Path != "$.handlers[0].options" {
+		t.Fatalf("expected error at $.handlers[0].options, got %v", err)
+	}
+}
+
+func TestConfigClosesBuiltHandlersOnError(t *testing.T) {
+	t.Parallel()
+
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		t.Skip("no /proc/self/fd")
+	}
+	path := filepath.Join(t.TempDir(), "a.log")
+	_, err := HandlerFromJSON([]byte(`{
+		"type": "multi",
+		"handlers": [
+			{"type": "file", "path": "` + path + `"},
+			{"type": "net", "network": "tcp", "addr": "127.0.0.1:1"}
+		]
+	}`))
+	if err == nil {
+		t.Fatal("expected an error connecting to 127.0.0.1:1")
+	}
+
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fd := range fds {
+		if target, _ := os.Readlink(filepath.Join("/proc/self/fd", fd.Name())); target == path {
+			t.Fatalf("%s is still open after the config failed", path)
+		}
+	}
+}
+
+func TestConfigMatchFilterNumber(t *testing.T) {
+	t.Parallel()
+
+	r := matchNumberRecord
+	ch, err := HandlerFromJSON([]byte(`{"type": "matchfilter", "key": "n", "value": 5,
+		"handler": {"type": "test-match-number"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := New()
+	l.SetHandler(ch)
+
+	l.Info("int", "n", 5)
+	if r.Msg != "int" {
+		t.Fatalf("int value 5 didn't match, got msg %q", r.Msg)
+	}
+	l.Info("uint", "n", uint8(5))
+	if r.Msg != "uint" {
+		t.Fatalf("uint8 value 5 didn't match, got msg %q", r.Msg)
+	}
+	l.Info("other", "n", 6)
+	l.Info("string", "n", "5")
+	if r.Msg != "uint" {
+		t.Fatalf("expected only numbers equal to 5 to match, got msg %q", r.Msg)
+	}
+}
@@ -0,0 +1,218 @@
+package ext
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// LevelAdmin is an http.Handler for changing the levels of named handlers
+// at runtime, for example to switch a component to debug logging in
+// production without a redeploy:
+//
+//	admin := logext.NewLevelAdmin(log.Root(), func(r *http.Request) bool {
+//	    return r.Header.Get("Authorization") == "Bearer "+adminToken
+//	})
+//	admin.RegisterLogger("db", dbLogger, log.LvlInfo)
+//	http.Handle("/debug/log15", admin)
+//
+// Every request must be accepted by the authorizer of the LevelAdmin. A
+// GET request lists the registered handlers and their levels as JSON. A
+// POST request with the form values name, level and optionally ttl
+// changes the level of a handler:
+//
+//	curl -d name=db -d level=debug -d ttl=10m http://localhost:8080/debug/log15
+//
+// After the ttl, a duration as understood by time.ParseDuration, the level
+// reverts to what it was before; it must not be negative. Every change and
+// revert is logged.
+type LevelAdmin struct {
+	logger    log.Logger
+	authorize func(r *http.Request) bool
+
+	mu      sync.Mutex
+	entries map[string]*levelEntry
+}
+
+type levelEntry struct {
+	handler log.Handler
+	swap    *HotSwap
+	lvl     log.Lvl
+
+	// revert is set while a change with a ttl is pending
+	revert   *time.Timer
+	revertTo log.Lvl
+	expires  time.Time
+}
+
+// NewLevelAdmin returns a LevelAdmin which logs level changes to logger
+// and only serves the requests for which authorize returns true. If
+// authorize is nil, no requests are served.
+func NewLevelAdmin(logger log.Logger, authorize func(r *http.Request) bool) *LevelAdmin {
+	return &LevelAdmin{
+		logger:    logger,
+		authorize: authorize,
+		entries:   make(map[string]*levelEntry),
+	}
+}
+
+// Register adds h under name with the initial level lvl. It returns the
+// handler to log to, which passes the records up to the current level of
+// name to h. Registering a name again replaces the previous handler.
+func (a *LevelAdmin) Register(name string, h log.Handler, lvl log.Lvl) log.Handler {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if e, ok := a.entries[name]; ok && e.revert != nil {
+		e.revert.Stop()
+	}
+	e := &levelEntry{handler: h, lvl: lvl, swap: HotSwapHandler(log.LvlFilterHandler(lvl, h))}
+	a.entries[name] = e
+	return e.swap
+}
+
+// RegisterLogger registers the handler of l under name with the initial
+// level lvl, and sets l to log through it.
+func (a *LevelAdmin) RegisterLogger(name string, l log.Logger, lvl log.Lvl) {
+	l.SetHandler(a.Register(name, l.GetHandler(), lvl))
+}
+
+// SetLevel changes the level of the handler registered under name. If ttl
+// is positive, the level reverts after ttl. It returns an error if no
+// handler is registered under name.
+func (a *LevelAdmin) SetLevel(name string, lvl log.Lvl, ttl time.Duration) error {
+	return a.setLevel(name, lvl, ttl, "")
+}
+
+func (a *LevelAdmin) setLevel(name string, lvl log.Lvl, ttl time.Duration, by string) error {
+	a.mu.Lock()
+	e, ok := a.entries[name]
+	if !ok {
+		a.mu.Unlock()
+		return fmt.Errorf("no handler named %q", name)
+	}
+
+	from := e.lvl
+	if e.revert != nil {
+		// a pending revert keeps going back to the level from before
+		// the first temporary change
+		e.revert.Stop()
+		e.revert = nil
+	} else {
+		e.revertTo = from
+	}
+	e.set(lvl)
+
+	ctx := []interface{}{"name", name, "from", from, "to", lvl}
+	if by != "" {
+		ctx = append(ctx, "by", by)
+	}
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+		e.revert = time.AfterFunc(ttl, func() {
+			a.expire(name, e)
+		})
+		ctx = append(ctx, "ttl", ttl)
+	}
+	a.mu.Unlock()
+
+	// log without the lock, since the handler of a.logger may call back
+	// into a, for example if it is registered with it
+	a.logger.Info("log level changed", ctx...)
+	return nil
+}
+
+// expire reverts the temporary level of e, unless it has been replaced
+// or changed again in the meantime.
+func (a *LevelAdmin) expire(name string, e *levelEntry) {
+	a.mu.Lock()
+	if a.entries[name] != e || e.revert == nil || time.Now().Before(e.expires) {
+		a.mu.Unlock()
+		return
+	}
+	from, to := e.lvl, e.revertTo
+	e.revert = nil
+	e.set(to)
+	a.mu.Unlock()
+
+	a.logger.Info("log level reverted", "name", name, "from", from, "to", to)
+}
+
+func (e *levelEntry) set(lvl log.Lvl) {
+	e.lvl = lvl
+	e.swap.Swap(log.LvlFilterHandler(lvl, e.handler))
+}
+
+// LevelStatus describes the level of a handler registered with a LevelAdmin.
+type LevelStatus struct {
+	Name  string `json:"name"`
+	Level string `json:"level"`
+
+	// RevertTo and Expires are set while a temporary level is in effect.
+	RevertTo string     `json:"revert_to,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+}
+
+// Levels returns the status of the registered handlers sorted by name.
+func (a *LevelAdmin) Levels() []LevelStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	levels := make([]LevelStatus, 0, len(a.entries))
+	for name, e := range a.entries {
+		s := LevelStatus{Name: name, Level: e.lvl.String()}
+		if e.revert != nil {
+			expires := e.expires
+			s.RevertTo, s.Expires = e.revertTo.String(), &expires
+		}
+		levels = append(levels, s)
+	}
+	sort.Slice(levels, func(i, j int) bool {
+		return levels[i].Name < levels[j].Name
+	})
+	return levels
+}
+
+// ServeHTTP implements http.Handler.
+func (a *LevelAdmin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.authorize == nil || !a.authorize(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		lvl, err := log.LvlFromString(r.FormValue("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var ttl time.Duration
+		if s := r.FormValue("ttl"); s != "" {
+			if ttl, err = time.ParseDuration(s); err != nil {
+				http.Error(w, "bad ttl: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if ttl < 0 {
+				http.Error(w, "bad ttl: must not be negative", http.StatusBadRequest)
+				return
+			}
+		}
+		if err := a.setLevel(r.FormValue("name"), lvl, ttl, r.RemoteAddr); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.Levels())
+}
@@ -0,0 +1,367 @@
+package ext
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/smtp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// AlertRule fires an alert when more than Threshold records match it
+// within Window.
+type AlertRule struct {
+	// Name identifies the rule in alerts.
+	Name string
+
+	// Lvl is the least severe level of the records which match the rule.
+	// Its zero value is LvlCrit.
+	Lvl log.Lvl
+
+	// Filter, if set, must also return true for matching records.
+	Filter func(r *log.Record) bool
+
+	// Threshold is the number of matching records within Window which
+	// may pass without an alert. Window defaults to 1 minute.
+	Threshold int
+	Window    time.Duration
+
+	// Throttle is the least time between two alerts of the rule.
+	// Matches in the meantime are counted as suppressed in the next
+	// alert. Defaults to Window.
+	Throttle time.Duration
+}
+
+// Alert is a fired AlertRule.
+type Alert struct {
+	Rule string `json:"rule"`
+
+	// Count is the number of records which matched the rule within its
+	// window, the last of them at Time. Suppressed is the number of
+	// records which matched while the rule was throttled since its
+	// previous alert.
+	Count      int       `json:"count"`
+	Window     string    `json:"window"`
+	Time       time.Time `json:"time"`
+	Suppressed int       `json:"suppressed,omitempty"`
+
+	// Records are the last of the matching records.
+	Records []*log.Record `json:"-"`
+}
+
+// Digest is a group of alerts which are delivered together.
+type Digest struct {
+	Time   time.Time
+	Alerts []*Alert
+}
+
+// Subject returns a one line summary of d.
+func (d *Digest) Subject() string {
+	rules := make([]string, len(d.Alerts))
+	for i, a := range d.Alerts {
+		rules[i] = a.Rule
+	}
+	noun := "alerts"
+	if len(d.Alerts) == 1 {
+		noun = "alert"
+	}
+	return fmt.Sprintf("[log15] %d %s: %s", len(d.Alerts), noun, strings.Join(rules, ", "))
+}
+
+// Text returns a plain text description of d with its records formatted
+// with LogfmtFormat.
+func (d *Digest) Text() string {
+	var b strings.Builder
+	fmtr := log.SafeFormat(log.LogfmtFormat())
+	for i, a := range d.Alerts {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		fmt.Fprintf(&b, "%s: %d records in %s at %s", a.Rule, a.Count, a.Window, a.Time.Format(time.RFC3339))
+		if a.Suppressed > 0 {
+			fmt.Fprintf(&b, " (%d more while throttled)", a.Suppressed)
+		}
+		b.WriteString("\n")
+		for _, r := range a.Records {
+			b.WriteString("    ")
+			b.Write(fmtr.Format(r))
+		}
+	}
+	return b.String()
+}
+
+// MarshalJSON encodes d as an object with the time and the alerts, whose
+// records are formatted with JsonFormat.
+func (d *Digest) MarshalJSON() ([]byte, error) {
+	type alert struct {
+		*Alert
+		Records []json.RawMessage `json:"records"`
+	}
+	alerts := make([]alert, len(d.Alerts))
+	fmtr := log.SafeFormat(log.JsonFormatEx(false, false))
+	for i, a := range d.Alerts {
+		alerts[i].Alert = a
+		alerts[i].Records = make([]json.RawMessage, len(a.Records))
+		for j, r := range a.Records {
+			alerts[i].Records[j] = fmtr.Format(r)
+		}
+	}
+	return json.Marshal(struct {
+		Time   time.Time `json:"time"`
+		Alerts []alert   `json:"alerts"`
+	}{d.Time, alerts})
+}
+
+// A Notifier delivers digests of alerts.
+type Notifier interface {
+	Notify(d *Digest) error
+}
+
+// NotifierFunc is a function which implements Notifier.
+type NotifierFunc func(d *Digest) error
+
+// Notify implements Notifier.
+func (f NotifierFunc) Notify(d *Digest) error {
+	return f(d)
+}
+
+// AlertOptions configures an AlertHandler.
+type AlertOptions struct {
+	Rules     []AlertRule
+	Notifiers []Notifier
+
+	// DigestDelay is how long the handler waits after an alert for more
+	// alerts to deliver with it. Defaults to 30s.
+	DigestDelay time.Duration
+
+	// MaxRecords is the number of records kept with each alert.
+	// Defaults to 10.
+	MaxRecords int
+
+	// OnError, if set, is called with the errors of the notifiers.
+	OnError func(err error)
+}
+
+// AlertHandler returns a handler which fires alerts according to
+// opts.Rules and delivers them through opts.Notifiers, for example to
+// mail someone when more than 5 errors of the database are logged within
+// a minute:
+//
+//	alerts := logext.AlertHandler(logext.AlertOptions{
+//	    Rules: []logext.AlertRule{{
+//	        Name:      "db errors",
+//	        Lvl:       log.LvlError,
+//	        Filter:    func(r *log.Record) bool { return strings.HasPrefix(r.Msg, "db:") },
+//	        Threshold: 5,
+//	        Window:    time.Minute,
+//	        Throttle:  15 * time.Minute,
+//	    }},
+//	    Notifiers: []logext.Notifier{
+//	        logext.SMTPNotifier("mail:25", nil, "log15@example.com", []string{"oncall@example.com"}),
+//	    },
+//	})
+//	log.Root().SetHandler(log.MultiHandler(log.StdoutHandler, alerts))
+//	defer alerts.Close()
+//
+// Alerts which fire within opts.DigestDelay of each other are delivered
+// in a single digest. Notifiers are called from a timer goroutine, never
+// from Log, or by Flush and Close.
+func AlertHandler(opts AlertOptions) *Alerter {
+	if opts.DigestDelay <= 0 {
+		opts.DigestDelay = 30 * time.Second
+	}
+	if opts.MaxRecords <= 0 {
+		opts.MaxRecords = 10
+	}
+	a := &Alerter{opts: opts, rules: make([]*alertState, len(opts.Rules))}
+	for i, rule := range opts.Rules {
+		if rule.Window <= 0 {
+			rule.Window = time.Minute
+		}
+		if rule.Throttle <= 0 {
+			rule.Throttle = rule.Window
+		}
+		a.rules[i] = &alertState{AlertRule: rule}
+	}
+	a.handler = log.LazyHandler(log.FuncHandler(a.match))
+	return a
+}
+
+// Alerter is the Log15.Handler. Read `AlertHandler` for more information.
+type Alerter struct {
+	handler log.Handler
+	opts    AlertOptions
+
+	mu      sync.Mutex
+	rules   []*alertState
+	pending []*Alert
+	timer   *time.Timer
+
+	// notify serializes the deliveries
+	notify sync.Mutex
+}
+
+type alertState struct {
+	AlertRule
+
+	// times and records of the matches within the window
+	times      []time.Time
+	records    []*log.Record
+	lastFired  time.Time
+	suppressed int
+}
+
+// Log implements log15.Handler interface.
+func (a *Alerter) Log(r *log.Record) error {
+	return a.handler.Log(r)
+}
+
+func (a *Alerter) match(r *log.Record) error {
+	// the rules don't change, so their filters run without the lock
+	var matched []*alertState
+	for _, s := range a.rules {
+		if r.Lvl <= s.Lvl && (s.Filter == nil || s.Filter(r)) {
+			matched = append(matched, s)
+		}
+	}
+	if matched == nil {
+		return nil
+	}
+	now := time.Now()
+	rc := r.Clone()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, s := range matched {
+		if alert := s.match(now, rc, a.opts.MaxRecords); alert != nil {
+			a.fire(alert)
+		}
+	}
+	return nil
+}
+
+// match counts r and returns an alert if the rule fires.
+func (s *alertState) match(now time.Time, r *log.Record, maxRecords int) *Alert {
+	// forget the matches which left the window
+	start := now.Add(-s.Window)
+	i := sort.Search(len(s.times), func(i int) bool { return s.times[i].After(start) })
+	s.times = append(s.times[:0], s.times[i:]...)
+	s.times = append(s.times, now)
+	s.records = append(s.records, r)
+	if n := min(len(s.times), maxRecords); len(s.records) > n {
+		s.records = append(s.records[:0], s.records[len(s.records)-n:]...)
+	}
+
+	if len(s.times) <= s.Threshold {
+		return nil
+	}
+	if !s.lastFired.IsZero() && now.Sub(s.lastFired) < s.Throttle {
+		s.suppressed++
+		return nil
+	}
+
+	alert := &Alert{
+		Rule:       s.Name,
+		Count:      len(s.times),
+		Window:     s.Window.String(),
+		Time:       now,
+		Suppressed: s.suppressed,
+		Records:    append([]*log.Record(nil), s.records...),
+	}
+	s.lastFired = now
+	s.suppressed = 0
+	return alert
+}
+
+// fire queues alert for the next digest.
+func (a *Alerter) fire(alert *Alert) {
+	a.pending = append(a.pending, alert)
+	if a.timer == nil {
+		a.timer = time.AfterFunc(a.opts.DigestDelay, a.Flush)
+	}
+}
+
+// Flush delivers the pending alerts right away and returns when the
+// notifiers are done.
+func (a *Alerter) Flush() {
+	a.notify.Lock()
+	defer a.notify.Unlock()
+
+	a.mu.Lock()
+	alerts := a.pending
+	a.pending = nil
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+	a.mu.Unlock()
+	if len(alerts) == 0 {
+		return
+	}
+
+	d := &Digest{Time: time.Now(), Alerts: alerts}
+	for _, n := range a.opts.Notifiers {
+		if err := n.Notify(d); err != nil && a.opts.OnError != nil {
+			a.opts.OnError(err)
+		}
+	}
+}
+
+// Close delivers the pending alerts.
+func (a *Alerter) Close() error {
+	a.Flush()
+	return nil
+}
+
+// WebhookNotifier returns a Notifier which posts each digest as JSON to
+// url, like
+//
+//	{"time": "...", "alerts": [{"rule": "db errors", "count": 6, "window": "1m0s",
+//	    "time": "...", "records": [{"lvl": "eror", "msg": "...", ...}, ...]}]}
+//
+// Requests are sent and retried according to opts, whose batching options
+// are ignored. Most webhooks don't accept gzipped requests, so set
+// opts.DisableGzip for them.
+func WebhookNotifier(url string, opts HTTPOptions) Notifier {
+	opts.setDefaults()
+	client := &httpClient{opts}
+	return NotifierFunc(func(d *Digest) error {
+		body, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		_, err = client.post(url, "application/json", body)
+		return err
+	})
+}
+
+// SMTPNotifier returns a Notifier which mails each digest as plain text
+// from the address from to the addresses to through the SMTP server at
+// addr, authenticating with auth if it isn't nil. See smtp.SendMail.
+// Line breaks in the subject, which has the names of the rules, are
+// replaced by spaces.
+func SMTPNotifier(addr string, auth smtp.Auth, from string, to []string) Notifier {
+	return NotifierFunc(func(d *Digest) error {
+		subject := strings.Map(func(c rune) rune {
+			if c == '\r' || c == '\n' {
+				return ' '
+			}
+			return c
+		}, d.Subject())
+
+		var msg bytes.Buffer
+		fmt.Fprintf(&msg, "From: %s\r\n", from)
+		fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+		fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+		fmt.Fprintf(&msg, "Date: %s\r\n", d.Time.Format(time.RFC1123Z))
+		msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+		msg.WriteString(strings.ReplaceAll(d.Text(), "\n", "\r\n"))
+		return smtp.SendMail(addr, auth, from, to, msg.Bytes())
+	})
+}
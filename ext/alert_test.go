@@ -0,0 +1,387 @@
+package ext
+
+import (
+	"bufio"
+	"encoding/json"
+	"mime"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// smtpServer is an SMTP server which keeps the messages it gets.
+type smtpServer struct {
+	l net.Listener
+
+	mu       sync.Mutex
+	messages []smtpMessage
+	received chan struct{}
+}
+
+type smtpMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+func newSMTPServer(t *testing.T) *smtpServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &smtpServer{l: l, received: make(chan struct{}, 16)}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serveConn(conn)
+		}
+	}()
+	return srv
+}
+
+func (srv *smtpServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ready")
+	var msg smtpMessage
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			tp.PrintfLine("250 localhost")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			msg = smtpMessage{from: strings.Trim(line[len("MAIL FROM:"):], "<>")}
+			tp.PrintfLine("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			msg.to = append(msg.to, strings.Trim(line[len("RCPT TO:"):], "<>"))
+			tp.PrintfLine("250 OK")
+		case cmd == "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data = string(data)
+			srv.mu.Lock()
+			srv.messages = append(srv.messages, msg)
+			srv.mu.Unlock()
+			tp.PrintfLine("250 OK")
+			srv.received <- struct{}{}
+		case cmd == "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("250 OK")
+		}
+	}
+}
+
+func (srv *smtpServer) Messages() []smtpMessage {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return append([]smtpMessage(nil), srv.messages...)
+}
+
+// digestRecorder is a Notifier which keeps the digests.
+type digestRecorder struct {
+	mu      sync.Mutex
+	digests []*Digest
+}
+
+func (rec *digestRecorder) Notify(d *Digest) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.digests = append(rec.digests, d)
+	return nil
+}
+
+func (rec *digestRecorder) Digests() []*Digest {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]*Digest(nil), rec.digests...)
+}
+
+func TestAlertHandlerThreshold(t *testing.T) {
+	t.Parallel()
+
+	rec := &digestRecorder{}
+	h := AlertHandler(AlertOptions{
+		Rules: []AlertRule{{
+			Name:      "db errors",
+			Lvl:       log.LvlError,
+			Filter:    func(r *log.Record) bool { return strings.HasPrefix(r.Msg, "db:") },
+			Threshold: 2,
+			Window:    time.Minute,
+		}},
+		Notifiers:   []Notifier{rec},
+		DigestDelay: time.Hour,
+		MaxRecords:  2,
+	})
+	l := log.New()
+	l.SetHandler(h)
+
+	l.Error("db: timeout", "n", 1)
+	l.Error("cache: miss")
+	l.Warn("db: slow")
+	l.Error("db: timeout", "n", 2)
+	h.Flush()
+	if got := rec.Digests(); len(got) != 0 {
+		t.Fatalf("alert fired below the threshold: %v", got[0].Alerts)
+	}
+
+	l.Crit("db: down", "n", 3)
+	h.Flush()
+	digests := rec.Digests()
+	if len(digests) != 1 || len(digests[0].Alerts) != 1 {
+		t.Fatalf("expected one digest with one alert, got %v", digests)
+	}
+	a := digests[0].Alerts[0]
+	if a.Rule != "db errors" || a.Count != 3 || a.Window != "1m0s" {
+		t.Fatalf("unexpected alert %+v", a)
+	}
+	if len(a.Records) != 2 || a.Records[0].Msg != "db: timeout" || a.Records[1].Msg != "db: down" {
+		t.Fatalf("unexpected records %v", a.Records)
+	}
+}
+
+func TestAlertHandlerThrottle(t *testing.T) {
+	t.Parallel()
+
+	rec := &digestRecorder{}
+	h := AlertHandler(AlertOptions{
+		Rules: []AlertRule{
+			{Name: "crit", Throttle: 50 * time.Millisecond},
+			{Name: "errors", Lvl: log.LvlError, Throttle: time.Hour},
+		},
+		Notifiers:   []Notifier{rec},
+		DigestDelay: time.Hour,
+	})
+	l := log.New()
+	l.SetHandler(h)
+
+	// both rules fire once and are delivered in a single digest
+	l.Crit("down")
+	l.Crit("down")
+	l.Error("failed")
+	h.Flush()
+	digests := rec.Digests()
+	if len(digests) != 1 || len(digests[0].Alerts) != 2 {
+		t.Fatalf("expected one digest with two alerts, got %v", digests)
+	}
+	if s := digests[0].Subject(); s != "[log15] 2 alerts: crit, errors" {
+		t.Fatalf("unexpected subject %q", s)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	l.Crit("still down")
+	h.Flush()
+	digests = rec.Digests()
+	if len(digests) != 2 || len(digests[1].Alerts) != 1 {
+		t.Fatalf("expected a second digest with one alert, got %v", digests)
+	}
+	if a := digests[1].Alerts[0]; a.Rule != "crit" || a.Suppressed != 1 {
+		t.Fatalf("unexpected alert %+v", a)
+	}
+}
+
+func TestAlertHandlerDigestDelay(t *testing.T) {
+	t.Parallel()
+
+	rec := &digestRecorder{}
+	h := AlertHandler(AlertOptions{
+		Rules:       []AlertRule{{Name: "crit"}},
+		Notifiers:   []Notifier{rec},
+		DigestDelay: 20 * time.Millisecond,
+	})
+	defer h.Close()
+	l := log.New()
+	l.SetHandler(h)
+	l.Crit("down")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(rec.Digests()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("digest wasn't delivered after its delay")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	t.Parallel()
+
+	srv := newHTTPRecorder(500)
+	defer srv.Close()
+
+	h := AlertHandler(AlertOptions{
+		Rules: []AlertRule{{Name: "crit"}},
+		Notifiers: []Notifier{WebhookNotifier(srv.URL, HTTPOptions{
+			DisableGzip: true,
+			MinBackoff:  time.Millisecond,
+		})},
+		OnError: func(err error) { t.Error(err) },
+	})
+	l := log.New()
+	l.SetHandler(h)
+	l.Crit("down", "host", "db1")
+	h.Close()
+
+	if n := len(srv.Requests()); n != 2 {
+		t.Fatalf("expected the webhook to be retried once, got %d requests", n)
+	}
+	bodies := srv.Bodies()
+	if ct := srv.Requests()[1].Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	var d struct {
+		Alerts []struct {
+			Rule    string
+			Count   int
+			Records []map[string]interface{}
+		}
+	}
+	if err := json.Unmarshal([]byte(bodies[0]), &d); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Alerts) != 1 || d.Alerts[0].Rule != "crit" || d.Alerts[0].Count != 1 {
+		t.Fatalf("unexpected digest %s", bodies[0])
+	}
+	if r := d.Alerts[0].Records; len(r) != 1 || r[0]["msg"] != "down" || r[0]["host"] != "db1" {
+		t.Fatalf("unexpected records %s", bodies[0])
+	}
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	t.Parallel()
+
+	srv := newSMTPServer(t)
+	var errs []error
+	h := AlertHandler(AlertOptions{
+		Rules: []AlertRule{{Name: "crit"}},
+		Notifiers: []Notifier{
+			SMTPNotifier(srv.l.Addr().String(), nil, "log15@example.com", []string{"a@example.com", "b@example.com"}),
+		},
+		OnError: func(err error) { errs = append(errs, err) },
+	})
+	l := log.New()
+	l.SetHandler(h)
+	l.Crit("down", "host", "db1")
+	h.Close()
+	if len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+
+	select {
+	case <-srv.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	msgs := srv.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("expected one message, got %d", len(msgs))
+	}
+	m := msgs[0]
+	if m.from != "log15@example.com" || strings.Join(m.to, ",") != "a@example.com,b@example.com" {
+		t.Fatalf("unexpected envelope %q %q", m.from, m.to)
+	}
+	tp := textproto.NewReader(bufio.NewReader(strings.NewReader(m.data)))
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := header.Get("Subject"); s != "[log15] 1 alert: crit" {
+		t.Fatalf("unexpected subject %q", s)
+	}
+	if !strings.Contains(m.data, "crit: 1 records in 1m0s") || !strings.Contains(m.data, `msg=down host=db1`) {
+		t.Fatalf("unexpected body %q", m.data)
+	}
+}
+
+func TestSMTPNotifierSubject(t *testing.T) {
+	t.Parallel()
+
+	srv := newSMTPServer(t)
+	h := AlertHandler(AlertOptions{
+		Rules: []AlertRule{{Name: "crit\r\nBcc: x@example.com é"}},
+		Notifiers: []Notifier{
+			SMTPNotifier(srv.l.Addr().String(), nil, "log15@example.com", []string{"a@example.com"}),
+		},
+		OnError: func(err error) { t.Error(err) },
+	})
+	l := log.New()
+	l.SetHandler(h)
+	l.Crit("down")
+	h.Close()
+
+	select {
+	case <-srv.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	tp := textproto.NewReader(bufio.NewReader(strings.NewReader(srv.Messages()[0].data)))
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bcc := header.Get("Bcc"); bcc != "" {
+		t.Fatalf("rule name injected a header: Bcc: %s", bcc)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[log15] 1 alert: crit  Bcc: x@example.com é"; subject != want {
+		t.Fatalf("got subject %q, expected %q", subject, want)
+	}
+}
+
+func TestAlertHandlerFilterWithoutLock(t *testing.T) {
+	t.Parallel()
+
+	entered, release := make(chan struct{}), make(chan struct{})
+	h := AlertHandler(AlertOptions{
+		Rules: []AlertRule{{
+			Name: "slow",
+			Filter: func(r *log.Record) bool {
+				if r.Msg == "slow" {
+					close(entered)
+					<-release
+				}
+				return true
+			},
+		}},
+		Notifiers:   []Notifier{&digestRecorder{}},
+		DigestDelay: time.Hour,
+	})
+	defer h.Close()
+	l := log.New()
+	l.SetHandler(h)
+
+	go l.Crit("slow")
+	<-entered
+	// a slow filter doesn't hold up the records of other goroutines
+	done := make(chan struct{})
+	go func() {
+		l.Crit("fast")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Log blocked on the filter of another record")
+	}
+	close(release)
+}
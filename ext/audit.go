@@ -0,0 +1,512 @@
+package ext
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/inconshreveable/log15/receiver"
+)
+
+// The context keys added by an AuditHandler, and the message and context
+// keys of its checkpoints.
+const (
+	AuditSeqKey   = "seq"
+	AuditChainKey = "chain"
+
+	AuditCheckpointMsg = "audit checkpoint"
+	AuditHeadKey       = "head"
+	AuditSigKey        = "sig"
+)
+
+// Errors of the problems found by VerifyAudit.
+var (
+	ErrAuditMalformed = errors.New("not an audit record")
+	ErrAuditGap       = errors.New("records missing")
+	ErrAuditOrder     = errors.New("record out of order")
+	ErrAuditModified  = errors.New("record modified")
+	ErrAuditSignature = errors.New("bad checkpoint")
+)
+
+// AuditOptions configures an AuditHandler. The zero value writes a
+// checkpoint every 1000 records or 1 minute, signed with the HMAC key.
+type AuditOptions struct {
+	// CheckpointRecords and CheckpointInterval are the number of records
+	// and the time after which a checkpoint is written with the next
+	// record, 1000 and 1 minute by default.
+	CheckpointRecords  int
+	CheckpointInterval time.Duration
+
+	// SigningKey, if set, signs the checkpoints with Ed25519 instead of
+	// the HMAC key, so that they can be verified with the public key.
+	SigningKey ed25519.PrivateKey
+}
+
+// AuditHandler writes records formatted with LogfmtFormat or JsonFormat
+// to wr as a tamper-evident log. Each record gets a sequence number under
+// AuditSeqKey, and a chain value under AuditChainKey, which is the
+// HMAC-SHA256 with key of the previous chain value and the formatted
+// record. For example:
+//
+//	t=2024-05-01T10:00:00+0000 lvl=info msg="user deleted" user=bob seq=41 chain=5be1...
+//
+// Records can't be changed, removed or reordered without breaking the
+// chain, which VerifyAudit and the log15 audit verify command check.
+//
+// After opts.CheckpointRecords records or opts.CheckpointInterval, and on
+// Close, the handler writes a checkpoint: a record with the message
+// AuditCheckpointMsg, the chain value of the record before it under
+// AuditHeadKey and a signature of both under AuditSigKey. The records
+// after the last checkpoint could be truncated undetected.
+//
+// The chain starts anew with sequence number 1. Use AuditFileHandler to
+// continue the chain of an existing file. The seq and chain keys must not
+// be used by the records, and JsonFormat must not be pretty printed.
+func AuditHandler(wr io.Writer, fmtr log.Format, key []byte, opts AuditOptions) *Audit {
+	if opts.CheckpointRecords <= 0 {
+		opts.CheckpointRecords = 1000
+	}
+	if opts.CheckpointInterval <= 0 {
+		opts.CheckpointInterval = time.Minute
+	}
+	a := &Audit{
+		wr:             wr,
+		fmtr:           log.SafeFormat(fmtr),
+		key:            key,
+		opts:           opts,
+		prev:           make([]byte, sha256.Size),
+		lastCheckpoint: time.Now(),
+	}
+	a.handler = log.LazyHandler(log.FuncHandler(a.log))
+	return a
+}
+
+// AuditFileHandler is an AuditHandler which appends to the file at path.
+// If the file already has records, it continues their chain.
+func AuditFileHandler(path string, fmtr log.Format, key []byte, opts AuditOptions) (*Audit, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	seq, chain, err := lastAuditRecord(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("log15: can't continue the audit chain of %s: %w", path, err)
+	}
+	a := AuditHandler(f, fmtr, key, opts)
+	a.closer = f
+	if seq > 0 {
+		a.seq, a.prev = seq, chain
+	}
+	return a, nil
+}
+
+// lastAuditRecord returns the sequence number and the chain value of the
+// last record in f, or 0 if f is empty.
+func lastAuditRecord(f *os.File) (uint64, []byte, error) {
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return 0, nil, err
+	}
+	// the last line is within the last 64KB unless it's huge
+	off := max(0, info.Size()-64<<10)
+	buf := make([]byte, info.Size()-off)
+	if _, err := f.ReadAt(buf, off); err != nil {
+		return 0, nil, err
+	}
+	if !bytes.HasSuffix(buf, []byte("\n")) {
+		return 0, nil, errors.New("partial last line")
+	}
+	line := buf[bytes.LastIndexByte(buf[:len(buf)-1], '\n')+1:]
+	_, seq, chain, err := parseAuditLine(line)
+	return seq, chain, err
+}
+
+// Audit is the Log15.Handler. Read `AuditHandler` for more information.
+type Audit struct {
+	handler log.Handler
+	wr      io.Writer
+	fmtr    log.Format
+	key     []byte
+	opts    AuditOptions
+	closer  io.Closer
+
+	mu             sync.Mutex
+	seq            uint64
+	prev           []byte
+	records        int // since the last checkpoint
+	lastCheckpoint time.Time
+}
+
+// Log implements log15.Handler interface.
+func (a *Audit) Log(r *log.Record) error {
+	return a.handler.Log(r)
+}
+
+func (a *Audit) log(r *log.Record) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.write(r); err != nil {
+		return err
+	}
+	a.records++
+	if a.records >= a.opts.CheckpointRecords || time.Since(a.lastCheckpoint) >= a.opts.CheckpointInterval {
+		return a.checkpoint()
+	}
+	return nil
+}
+
+// write adds the sequence number and the chain value to r and writes it.
+// The chain advances only if the write succeeds.
+func (a *Audit) write(r *log.Record) error {
+	c := r.Clone()
+	c.Ctx = append(c.Ctx, AuditSeqKey, a.seq+1)
+	line := a.fmtr.Format(c)
+	chain := auditChain(a.key, a.prev, line)
+	sealed, err := sealAuditLine(line, chain)
+	if err != nil {
+		return err
+	}
+	if _, err := a.wr.Write(sealed); err != nil {
+		return err
+	}
+	a.seq++
+	a.prev = chain
+	return nil
+}
+
+// checkpoint writes a signed checkpoint of the chain so far.
+func (a *Audit) checkpoint() error {
+	head := hex.EncodeToString(a.prev)
+	sig := auditSign(a.key, a.opts.SigningKey, a.seq+1, head)
+	err := a.write(&log.Record{
+		Time:     time.Now(),
+		Lvl:      log.LvlInfo,
+		Msg:      AuditCheckpointMsg,
+		Ctx:      []interface{}{AuditHeadKey, head, AuditSigKey, hex.EncodeToString(sig)},
+		KeyNames: receiver.DefaultKeyNames,
+	})
+	if err != nil {
+		return err
+	}
+	a.records = 0
+	a.lastCheckpoint = time.Now()
+	return nil
+}
+
+// Close writes a checkpoint if records were logged since the last one, and
+// closes the file of an AuditFileHandler.
+func (a *Audit) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var err error
+	if a.records > 0 {
+		err = a.checkpoint()
+	}
+	if a.closer != nil {
+		if cerr := a.closer.Close(); err == nil {
+			err = cerr
+		}
+		a.closer = nil
+	}
+	return err
+}
+
+func auditChain(key, prev, line []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(prev)
+	mac.Write(line)
+	return mac.Sum(nil)
+}
+
+func auditCheckpointMessage(seq uint64, head string) []byte {
+	return fmt.Appendf(nil, "log15 audit checkpoint %d %s", seq, head)
+}
+
+func auditSign(key []byte, signer ed25519.PrivateKey, seq uint64, head string) []byte {
+	msg := auditCheckpointMessage(seq, head)
+	if signer != nil {
+		return ed25519.Sign(signer, msg)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+// sealAuditLine appends the chain value to a line of LogfmtFormat, or adds
+// it to the object of a line of JsonFormat.
+func sealAuditLine(line, chain []byte) ([]byte, error) {
+	if len(line) < 2 || line[len(line)-1] != '\n' || bytes.IndexByte(line[:len(line)-1], '\n') >= 0 {
+		return nil, errors.New("log15: audit records must be formatted on a single line")
+	}
+	sealed := make([]byte, 0, len(line)+len(AuditChainKey)+2*len(chain)+8)
+	if line[0] == '{' {
+		sealed = append(sealed, line[:len(line)-2]...)
+		sealed = append(sealed, `,"`+AuditChainKey+`":"`...)
+		sealed = hex.AppendEncode(sealed, chain)
+		return append(sealed, "\"}\n"...), nil
+	}
+	sealed = append(sealed, line[:len(line)-1]...)
+	sealed = append(sealed, " "+AuditChainKey+"="...)
+	sealed = hex.AppendEncode(sealed, chain)
+	return append(sealed, '\n'), nil
+}
+
+// unsealAuditLine returns the line as formatted before sealAuditLine and
+// the chain value.
+func unsealAuditLine(sealed []byte) ([]byte, []byte, error) {
+	hexLen := 2 * sha256.Size
+	line := bytes.TrimSuffix(sealed, []byte("\n"))
+	var prefix, suffix string
+	if len(line) > 0 && line[0] == '{' {
+		prefix, suffix = `,"`+AuditChainKey+`":"`, `"}`
+	} else {
+		prefix = " " + AuditChainKey + "="
+	}
+	n := len(prefix) + hexLen + len(suffix)
+	if len(line) < n || string(line[len(line)-n:len(line)-n+len(prefix)]) != prefix ||
+		string(line[len(line)-len(suffix):]) != suffix {
+		return nil, nil, ErrAuditMalformed
+	}
+	chain, err := hex.DecodeString(string(line[len(line)-len(suffix)-hexLen : len(line)-len(suffix)]))
+	if err != nil {
+		return nil, nil, ErrAuditMalformed
+	}
+	orig := append([]byte(nil), line[:len(line)-n]...)
+	if suffix != "" {
+		orig = append(orig, '}')
+	}
+	return append(orig, '\n'), chain, nil
+}
+
+// parseAuditLine decodes a sealed line and returns its record without
+// the chain value, its sequence number and its chain value.
+func parseAuditLine(sealed []byte) (*log.Record, uint64, []byte, error) {
+	_, chain, err := unsealAuditLine(sealed)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	format := receiver.FormatLogfmt
+	if sealed[0] == '{' {
+		format = receiver.FormatJSON
+	}
+	dec, err := receiver.NewDecoder(format, bytes.NewReader(sealed), receiver.DefaultKeyNames)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	r, err := dec.Decode()
+	if err != nil {
+		return nil, 0, nil, ErrAuditMalformed
+	}
+	var seq uint64
+	ctx := r.Ctx[:0]
+	for i := 0; i+1 < len(r.Ctx); i += 2 {
+		switch r.Ctx[i] {
+		case AuditSeqKey:
+			seq, err = strconv.ParseUint(fmt.Sprint(r.Ctx[i+1]), 10, 64)
+		case AuditChainKey:
+		default:
+			ctx = append(ctx, r.Ctx[i], r.Ctx[i+1])
+		}
+	}
+	if seq == 0 || err != nil {
+		return nil, 0, nil, ErrAuditMalformed
+	}
+	r.Ctx = ctx
+	return r, seq, chain, nil
+}
+
+// AuditProblem is a problem found by VerifyAudit at a line.
+type AuditProblem struct {
+	Line int
+	Seq  uint64
+	Err  error
+	Msg  string
+}
+
+func (p *AuditProblem) Error() string {
+	s := fmt.Sprintf("line %d", p.Line)
+	if p.Seq > 0 {
+		s += fmt.Sprintf(" (seq %d)", p.Seq)
+	}
+	s += ": " + p.Err.Error()
+	if p.Msg != "" {
+		s += ": " + p.Msg
+	}
+	return s
+}
+
+func (p *AuditProblem) Unwrap() error {
+	return p.Err
+}
+
+// AuditReport is the result of VerifyAudit.
+type AuditReport struct {
+	// Records is the number of records, including the checkpoints.
+	Records     int
+	Checkpoints int
+
+	// FirstSeq and LastSeq are the sequence numbers of the first and the
+	// last record.
+	FirstSeq uint64
+	LastSeq  uint64
+
+	// Unsealed is the number of records after the last checkpoint,
+	// which could have been truncated undetected.
+	Unsealed int
+
+	Problems []*AuditProblem
+}
+
+// AuditVerifyOptions configures VerifyAudit.
+type AuditVerifyOptions struct {
+	// PublicKey, if set, verifies the checkpoints signed with Ed25519
+	// instead of the HMAC key.
+	PublicKey ed25519.PublicKey
+
+	// FirstSeq is the sequence number of the first record, 1 by default.
+	// Set it to verify a part of a chain, like a file which starts after a
+	// rotation: the chain is then verified from the first record on.
+	FirstSeq uint64
+}
+
+// VerifyAudit checks the chain of the audit records read from r, which
+// were written by an AuditHandler with key. It reports missing,
+// reordered and modified records, including the records missing before
+// the first one, and checkpoints whose signature or head is wrong.
+func VerifyAudit(r io.Reader, key []byte, opts AuditVerifyOptions) (*AuditReport, error) {
+	if opts.FirstSeq == 0 {
+		opts.FirstSeq = 1
+	}
+	report := &AuditReport{}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 16<<20)
+
+	var (
+		prev     []byte
+		next     = opts.FirstSeq // expected sequence number
+		lineNo   int
+		gaps     = make(map[uint64]*AuditProblem)
+		reported = make(map[*AuditProblem]int) // missing records per gap
+	)
+	problem := func(seq uint64, err error, msg string, args ...interface{}) *AuditProblem {
+		p := &AuditProblem{Line: lineNo, Seq: seq, Err: err, Msg: fmt.Sprintf(msg, args...)}
+		report.Problems = append(report.Problems, p)
+		return p
+	}
+
+	for sc.Scan() {
+		lineNo++
+		sealed := append(sc.Bytes(), '\n')
+		if len(bytes.TrimSpace(sealed)) == 0 {
+			continue
+		}
+		rec, seq, chain, err := parseAuditLine(sealed)
+		if err != nil {
+			problem(0, ErrAuditMalformed, "")
+			continue
+		}
+		line, _, _ := unsealAuditLine(sealed)
+		report.Records++
+		report.Unsealed++
+
+		switch {
+		case seq < next:
+			if p := gaps[seq]; p != nil {
+				delete(gaps, seq)
+				if reported[p]--; reported[p] == 0 {
+					removeAuditProblem(report, p)
+				}
+			}
+			problem(seq, ErrAuditOrder, "expected seq %d", next)
+			// the chain continues from the records in order
+			continue
+		case seq > next:
+			p := problem(seq, ErrAuditGap, "seq %d to %d", next, seq-1)
+			for s := next; s < seq && s-next < 10000; s++ {
+				gaps[s] = p
+				reported[p]++
+			}
+		case prev == nil:
+			// the first record is verified if it starts the chain, and
+			// anchors it otherwise
+			if seq == 1 && !hmac.Equal(chain, auditChain(key, make([]byte, sha256.Size), line)) {
+				problem(seq, ErrAuditModified, "")
+			}
+		case !hmac.Equal(chain, auditChain(key, prev, line)):
+			problem(seq, ErrAuditModified, "")
+		}
+		if report.FirstSeq == 0 {
+			report.FirstSeq = seq
+		}
+		before := prev
+		prev, next = chain, seq+1
+		report.LastSeq = seq
+
+		if rec.Msg == AuditCheckpointMsg {
+			report.Checkpoints++
+			report.Unsealed = 0
+			if err := verifyAuditCheckpoint(rec, seq, before, key, opts.PublicKey); err != nil {
+				problem(seq, ErrAuditSignature, "%v", err)
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+func removeAuditProblem(report *AuditReport, p *AuditProblem) {
+	for i, q := range report.Problems {
+		if q == p {
+			report.Problems = append(report.Problems[:i], report.Problems[i+1:]...)
+			return
+		}
+	}
+}
+
+// verifyAuditCheckpoint checks the signature of a checkpoint, and that its
+// head is prev unless prev is unknown.
+func verifyAuditCheckpoint(r *log.Record, seq uint64, prev, key []byte, pub ed25519.PublicKey) error {
+	var head, sig string
+	for i := 0; i+1 < len(r.Ctx); i += 2 {
+		switch r.Ctx[i] {
+		case AuditHeadKey:
+			head = fmt.Sprint(r.Ctx[i+1])
+		case AuditSigKey:
+			sig = fmt.Sprint(r.Ctx[i+1])
+		}
+	}
+	sigBytes, err := hex.DecodeString(sig)
+	if err != nil || head == "" {
+		return errors.New("missing head or signature")
+	}
+	if prev != nil && head != hex.EncodeToString(prev) {
+		return errors.New("head doesn't match the chain")
+	}
+	msg := auditCheckpointMessage(seq, head)
+	if pub != nil {
+		if !ed25519.Verify(pub, msg, sigBytes) {
+			return errors.New("signature mismatch")
+		}
+		return nil
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(msg)
+	if !hmac.Equal(sigBytes, mac.Sum(nil)) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package ext
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+)
+
+var auditTestKey = []byte("secret")
+
+// auditLines logs n records through an AuditHandler and returns the lines
+// it writes.
+func auditLines(t *testing.T, fmtr log.Format, n int, opts AuditOptions) []string {
+	t.Helper()
+	var buf bytes.Buffer
+	h := AuditHandler(&buf, fmtr, auditTestKey, opts)
+	l := log.New()
+	l.SetHandler(h)
+	for i := 0; i < n; i++ {
+		l.Info("user deleted", "user", fmt.Sprint("user", i))
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return strings.SplitAfter(strings.TrimSuffix(buf.String(), "\n"), "\n")
+}
+
+func verifyLines(t *testing.T, lines []string, opts AuditVerifyOptions) *AuditReport {
+	t.Helper()
+	report, err := VerifyAudit(strings.NewReader(strings.Join(lines, "")+"\n"), auditTestKey, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func expectProblems(t *testing.T, report *AuditReport, errs ...error) {
+	t.Helper()
+	if len(report.Problems) != len(errs) {
+		t.Fatalf("expected %d problems, got %v", len(errs), report.Problems)
+	}
+	for i, err := range errs {
+		if !errors.Is(report.Problems[i], err) {
+			t.Fatalf("expected %v, got %v", err, report.Problems[i])
+		}
+	}
+}
+
+func TestAuditHandler(t *testing.T) {
+	t.Parallel()
+
+	for name, fmtr := range map[string]log.Format{"logfmt": log.LogfmtFormat(), "json": log.JsonFormat()} {
+		lines := auditLines(t, fmtr, 5, AuditOptions{CheckpointRecords: 3})
+		// 5 records with a checkpoint after the 3rd and on Close
+		if len(lines) != 7 {
+			t.Fatalf("%s: expected 7 lines, got %q", name, lines)
+		}
+		if !strings.Contains(lines[3], AuditCheckpointMsg) || !strings.Contains(lines[6], AuditCheckpointMsg) {
+			t.Fatalf("%s: expected checkpoints, got %q", name, lines)
+		}
+		report := verifyLines(t, lines, AuditVerifyOptions{})
+		expectProblems(t, report)
+		if report.Records != 7 || report.Checkpoints != 2 || report.FirstSeq != 1 || report.LastSeq != 7 || report.Unsealed != 0 {
+			t.Fatalf("%s: unexpected report %+v", name, report)
+		}
+
+		modified := append([]string(nil), lines...)
+		modified[1] = strings.Replace(modified[1], "user1", "user9", 1)
+		expectProblems(t, verifyLines(t, modified, AuditVerifyOptions{}), ErrAuditModified)
+
+		removed := append(append([]string(nil), lines[:1]...), lines[2:]...)
+		expectProblems(t, verifyLines(t, removed, AuditVerifyOptions{}), ErrAuditGap)
+
+		swapped := append([]string(nil), lines...)
+		swapped[1], swapped[2] = swapped[2], swapped[1]
+		expectProblems(t, verifyLines(t, swapped, AuditVerifyOptions{}), ErrAuditOrder)
+
+		truncated := lines[:5]
+		if report := verifyLines(t, truncated, AuditVerifyOptions{}); len(report.Problems) != 0 || report.Unsealed != 1 {
+			t.Fatalf("%s: unexpected report of a truncated log %+v", name, report)
+		}
+
+		// records removed from the head
+		headless := verifyLines(t, lines[3:], AuditVerifyOptions{})
+		expectProblems(t, headless, ErrAuditGap)
+		if p := headless.Problems[0]; p.Line != 1 || p.Msg != "seq 1 to 3" {
+			t.Fatalf("%s: unexpected problem %v", name, p)
+		}
+
+		// a file cut at a rotation verifies from the expected first record
+		expectProblems(t, verifyLines(t, lines[2:], AuditVerifyOptions{FirstSeq: 3}))
+		expectProblems(t, verifyLines(t, lines[3:], AuditVerifyOptions{FirstSeq: 3}), ErrAuditGap)
+
+		if report, _ := VerifyAudit(strings.NewReader(strings.Join(lines, "")), []byte("wrong"), AuditVerifyOptions{}); len(report.Problems) == 0 {
+			t.Fatalf("%s: verified with the wrong key", name)
+		}
+	}
+}
+
+func TestAuditHandlerSigningKey(t *testing.T) {
+	t.Parallel()
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := auditLines(t, log.LogfmtFormat(), 2, AuditOptions{SigningKey: priv})
+	expectProblems(t, verifyLines(t, lines, AuditVerifyOptions{PublicKey: pub}))
+
+	other, _, _ := ed25519.GenerateKey(nil)
+	expectProblems(t, verifyLines(t, lines, AuditVerifyOptions{PublicKey: other}), ErrAuditSignature)
+}
+
+func TestAuditFileHandler(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	for i := 0; i < 2; i++ {
+		h, err := AuditFileHandler(path, log.JsonFormat(), auditTestKey, AuditOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := log.New()
+		l.SetHandler(h)
+		l.Info("login", "run", i)
+		l.Info("logout", "run", i)
+		if err := h.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	report, err := VerifyAudit(f, auditTestKey, AuditVerifyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectProblems(t, report)
+	if report.Records != 6 || report.LastSeq != 6 || report.Checkpoints != 2 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+}
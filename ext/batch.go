@@ -0,0 +1,344 @@
+package ext
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// BatchSink is implemented by destinations which take records in batches,
+// like the bulk APIs of log collectors. See BatchHandler.
+type BatchSink interface {
+	// LogBatch writes records. To report that only some of the records
+	// failed, it returns a *BatchError; any other error means that the
+	// whole batch failed.
+	LogBatch(records []*log.Record) error
+}
+
+// BatchError is returned by a BatchSink which wrote only part of a batch.
+// The records in Failed are passed to the sink again with a later batch.
+type BatchError struct {
+	Failed []*log.Record
+	Err    error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d records failed: %v", len(e.Failed), e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// ErrBatchClosed is returned for records logged to a closed BatchHandler.
+var ErrBatchClosed = errors.New("log15: batch handler is closed")
+
+// BatchOptions configures a BatchHandler. The zero value flushes batches
+// of 100 records or 1MB, at least every second.
+type BatchOptions struct {
+	// A batch is flushed when it has MaxRecords records, when it has
+	// MaxBytes bytes or MaxDelay after its first record, whichever comes
+	// first. They default to 100, 1MB and 1s.
+	MaxRecords int
+	MaxBytes   int
+	MaxDelay   time.Duration
+
+	// Size returns the number of bytes that a record counts towards
+	// MaxBytes. Defaults to the length of the record in LogfmtFormat.
+	Size func(r *log.Record) int
+
+	// MaxAttempts is the number of times a record is passed to the sink
+	// before it is dropped. Defaults to 3.
+	MaxAttempts int
+
+	// MinBackoff is the delay before a failed batch is retried. It
+	// doubles with every further failure up to MaxBackoff. Defaults to
+	// 100ms and 10s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// OnError, if set, is called with the errors returned by the sink.
+	// It runs in the goroutine of the handler, so it must not call Flush
+	// or Close, which wait for that goroutine.
+	OnError func(err error)
+}
+
+// BatchHandler collects records and writes them to sink in batches from a
+// separate goroutine. For example:
+//
+//	h := logext.BatchHandler(sink, logext.BatchOptions{MaxDelay: 5 * time.Second})
+//	log.Root().SetHandler(h)
+//	defer h.Close()
+//
+// Records which the sink fails to write, either because it returns an
+// error or a *BatchError listing them, are retried with the next batch up
+// to opts.MaxAttempts times, after a backoff from opts.MinBackoff to
+// opts.MaxBackoff. Log blocks while the sink is busy, or backing off, and
+// a batch worth of records waits to be collected. Close flushes the
+// remaining records before it returns.
+//
+// The sink is called from a separate goroutine which Flush and Close wait
+// for, so neither the sink nor opts.OnError may call them.
+func BatchHandler(sink BatchSink, opts BatchOptions) *Batch {
+	return newBatch(sink, opts, true)
+}
+
+// newBatch returns a BatchHandler which, unless block is set, drops the
+// records logged while a batch worth of records waits to be collected
+// rather than block the caller.
+func newBatch(sink BatchSink, opts BatchOptions, block bool) *Batch {
+	if opts.MaxRecords <= 0 {
+		opts.MaxRecords = 100
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = 1 << 20
+	}
+	if opts.MaxDelay <= 0 {
+		opts.MaxDelay = time.Second
+	}
+	if opts.Size == nil {
+		fmtr := log.SafeFormat(log.LogfmtFormat())
+		opts.Size = func(r *log.Record) int {
+			return len(fmtr.Format(r))
+		}
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 3
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 100 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 10 * time.Second
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = opts.MinBackoff
+	}
+
+	b := &Batch{
+		sink:     sink,
+		opts:     opts,
+		block:    block,
+		in:       make(chan *log.Record, opts.MaxRecords),
+		flushReq: make(chan chan struct{}),
+		done:     make(chan struct{}),
+		attempts: make(map[*log.Record]int),
+	}
+	b.handler = log.LazyHandler(log.FuncHandler(b.enqueue))
+	go b.loop()
+	return b
+}
+
+// Batch is the Log15.Handler. Read `BatchHandler` for more information.
+type Batch struct {
+	handler log.Handler
+	sink    BatchSink
+	opts    BatchOptions
+	block   bool
+	dropped atomic.Uint64
+
+	mu       sync.RWMutex
+	closed   bool
+	in       chan *log.Record
+	flushReq chan chan struct{}
+	done     chan struct{}
+
+	// owned by loop
+	batch    []*log.Record
+	bytes    int
+	attempts map[*log.Record]int
+	failures int
+	timer    <-chan time.Time
+}
+
+// Log implements log15.Handler interface.
+func (b *Batch) Log(r *log.Record) error {
+	return b.handler.Log(r)
+}
+
+func (b *Batch) enqueue(r *log.Record) error {
+	return b.push(r.Clone())
+}
+
+// push adds r to the batch as it is. r must not be changed afterwards.
+// If b doesn't block, r is dropped with ErrInFlightLimit when the batch
+// can't take it right away.
+func (b *Batch) push(r *log.Record) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return ErrBatchClosed
+	}
+	if b.block {
+		b.in <- r
+		return nil
+	}
+	select {
+	case b.in <- r:
+		return nil
+	default:
+		b.dropped.Add(1)
+		return ErrInFlightLimit
+	}
+}
+
+func (b *Batch) loop() {
+	defer close(b.done)
+	for {
+		// after a failure, records wait in b.in until the batch is
+		// retried
+		in := b.in
+		if b.failures > 0 && len(b.batch) > 0 {
+			in = nil
+		}
+		select {
+		case r, ok := <-in:
+			if !ok {
+				for len(b.batch) > 0 {
+					if b.failures > 0 {
+						<-b.timer
+					}
+					b.flush()
+				}
+				return
+			}
+			b.add(r)
+		case <-b.timer:
+			b.flush()
+		case ack := <-b.flushReq:
+			b.drain()
+			b.flush()
+			close(ack)
+		}
+
+		if len(b.batch) == 0 {
+			b.timer = nil
+		} else if b.timer == nil {
+			b.timer = time.After(b.opts.MaxDelay)
+		}
+	}
+}
+
+// drain adds the records which are already waiting in b.in.
+func (b *Batch) drain() {
+	for {
+		select {
+		case r, ok := <-b.in:
+			if !ok {
+				return
+			}
+			b.add(r)
+		default:
+			return
+		}
+	}
+}
+
+func (b *Batch) add(r *log.Record) {
+	size := b.opts.Size(r)
+	if len(b.batch) > 0 && b.bytes+size > b.opts.MaxBytes {
+		b.flush()
+	}
+	b.batch = append(b.batch, r)
+	b.bytes += size
+	if len(b.batch) >= b.opts.MaxRecords || b.bytes >= b.opts.MaxBytes {
+		b.flush()
+	}
+}
+
+// flush passes the current batch to the sink and keeps the records which
+// failed for the next batch, which is retried after a backoff.
+func (b *Batch) flush() {
+	if len(b.batch) == 0 {
+		return
+	}
+	records := b.batch
+	b.batch, b.bytes = nil, 0
+	b.timer = nil
+
+	err := b.sink.LogBatch(records)
+	if err == nil {
+		b.failures = 0
+		for _, r := range records {
+			delete(b.attempts, r)
+		}
+		return
+	}
+	if b.opts.OnError != nil {
+		b.opts.OnError(err)
+	}
+
+	failed := records
+	var be *BatchError
+	if errors.As(err, &be) {
+		failed = be.Failed
+		retry := make(map[*log.Record]bool, len(failed))
+		for _, r := range failed {
+			retry[r] = true
+		}
+		for _, r := range records {
+			if !retry[r] {
+				delete(b.attempts, r)
+			}
+		}
+	}
+	for _, r := range failed {
+		n := b.attempts[r] + 1
+		if n >= b.opts.MaxAttempts {
+			delete(b.attempts, r)
+			b.dropped.Add(1)
+			continue
+		}
+		b.attempts[r] = n
+		b.batch = append(b.batch, r)
+		b.bytes += b.opts.Size(r)
+	}
+	if len(b.batch) == 0 {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	b.timer = time.After(backoff(b.opts.MinBackoff, b.opts.MaxBackoff, b.failures))
+}
+
+// Flush writes the records logged so far to the sink and returns when it
+// is done, without waiting for the backoff of failed records. Records
+// which fail are kept for the next batch. It must not be called from the
+// sink or from BatchOptions.OnError.
+func (b *Batch) Flush() {
+	b.mu.RLock()
+	if b.closed {
+		b.mu.RUnlock()
+		return
+	}
+	ack := make(chan struct{})
+	b.flushReq <- ack
+	b.mu.RUnlock()
+	<-ack
+}
+
+// Dropped returns the number of records which were dropped after the sink
+// failed to write them opts.MaxAttempts times, or because the batch was
+// full in the handlers which don't block, like HTTPHandler.
+func (b *Batch) Dropped() uint64 {
+	return b.dropped.Load()
+}
+
+// Close flushes the remaining records, retrying failed ones after their
+// backoff, and stops the handler. It must not be called from the sink or
+// from BatchOptions.OnError. Records logged after Close are rejected with
+// ErrBatchClosed.
+func (b *Batch) Close() error {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.in)
+	}
+	b.mu.Unlock()
+	<-b.done
+	return nil
+}
@@ -0,0 +1,199 @@
+package ext
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// BreakerState is the state of a CircuitBreaker.
+type BreakerState int
+
+// List of circuit breaker states
+const (
+	// BreakerClosed passes records to the wrapped handler.
+	BreakerClosed BreakerState = iota
+
+	// BreakerOpen passes records to the fallback handler.
+	BreakerOpen
+
+	// BreakerHalfOpen passes a single trial record to the wrapped
+	// handler and all others to the fallback handler.
+	BreakerHalfOpen
+)
+
+// Returns the name of a BreakerState
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// ErrBreakerOpen is returned by a CircuitBreaker without a fallback
+// handler for the records it doesn't pass to the wrapped handler.
+var ErrBreakerOpen = errors.New("log15: circuit breaker is open")
+
+// CircuitBreakerHandler wraps a handler which may fail for a while, like a
+// NetHandler whose server is down, so that a dead handler doesn't stall
+// every log call. After threshold consecutive failures the breaker opens
+// and passes records to fallback instead. Once cooldown has passed, the
+// next record is tried on h again: if it succeeds the breaker closes,
+// otherwise it stays open for another cooldown. The results of records
+// which were passed to h before the last change of state are ignored, so
+// that a slow success from before the breaker opened doesn't close it.
+// For example:
+//
+//	breaker := logext.CircuitBreakerHandler(5, 30*time.Second,
+//	    log.Must.NetHandler("tcp", ":9090", log.JsonFormat()),
+//	    log.Must.FileHandler("/var/log/app.log", log.LogfmtFormat()))
+//
+// A record for which h fails is passed to fallback too, with the error
+// added to its context under the key "breaker_err". fallback may be nil
+// to drop the records which h can't take.
+func CircuitBreakerHandler(threshold int, cooldown time.Duration, h, fallback log.Handler) *CircuitBreaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &CircuitBreaker{
+		handler:   h,
+		fallback:  fallback,
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// CircuitBreaker is the Log15.Handler. Read `CircuitBreakerHandler` for more information.
+type CircuitBreaker struct {
+	handler   log.Handler
+	fallback  log.Handler
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    BreakerState
+	gen      uint64 // incremented on every transition
+	failures int
+	openedAt time.Time
+	onChange func(from, to BreakerState)
+}
+
+// Log implements log15.Handler interface.
+func (b *CircuitBreaker) Log(r *log.Record) error {
+	gen, ok := b.allow()
+	if !ok {
+		return b.logFallback(r, nil)
+	}
+
+	err := b.handler.Log(r)
+	b.report(gen, err)
+	if err != nil {
+		return b.logFallback(r, err)
+	}
+	return nil
+}
+
+// allow reports whether r should be passed to the wrapped handler, and
+// the generation of the state to report its result for. In the open
+// state, it lets through one trial record once the cooldown is over.
+func (b *CircuitBreaker) allow() (uint64, bool) {
+	var notify func()
+	// runs after the unlock below
+	defer func() {
+		if notify != nil {
+			notify()
+		}
+	}()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerClosed:
+		return b.gen, true
+	case BreakerOpen:
+		if time.Since(b.openedAt) >= b.cooldown {
+			notify = b.transition(BreakerHalfOpen)
+			return b.gen, true
+		}
+	}
+	return b.gen, false
+}
+
+// report updates the state with the result of passing a record to the
+// wrapped handler in the generation gen of the state.
+func (b *CircuitBreaker) report(gen uint64, err error) {
+	var notify func()
+	defer func() {
+		if notify != nil {
+			notify()
+		}
+	}()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if gen != b.gen {
+		// the record was passed before the last transition
+		return
+	}
+	if err == nil {
+		b.failures = 0
+		if b.state != BreakerClosed {
+			notify = b.transition(BreakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || b.state == BreakerClosed && b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		notify = b.transition(BreakerOpen)
+	}
+}
+
+// transition changes the state and returns the call of the OnStateChange
+// function, if any, to make once the breaker is unlocked.
+func (b *CircuitBreaker) transition(to BreakerState) func() {
+	from := b.state
+	b.state = to
+	b.gen++
+	if fn := b.onChange; fn != nil {
+		return func() { fn(from, to) }
+	}
+	return nil
+}
+
+func (b *CircuitBreaker) logFallback(r *log.Record, err error) error {
+	if b.fallback == nil {
+		if err == nil {
+			err = ErrBreakerOpen
+		}
+		return err
+	}
+	if err != nil {
+		r.Ctx = append(r.Ctx, "breaker_err", err)
+	}
+	return b.fallback.Log(r)
+}
+
+// State returns the current state of the breaker.
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// OnStateChange sets a function which is called on every state transition
+// of the breaker. It is called after the breaker is unlocked, so it may
+// log to the breaker, but the calls for transitions made at the same time
+// by different goroutines may arrive out of order.
+func (b *CircuitBreaker) OnStateChange(fn func(from, to BreakerState)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onChange = fn
+}
@@ -0,0 +1,161 @@
+package ext
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// ElasticsearchOptions configures an ElasticsearchHandler. Its
+// MaxInFlightBytes and JSONArray are ignored, but records are dropped
+// rather than block the caller while a batch worth of records waits for a
+// request to complete.
+type ElasticsearchOptions struct {
+	HTTPOptions
+
+	// The index of a record is IndexPrefix followed by the UTC time of
+	// the record formatted with IndexDateLayout. They default to "logs-"
+	// and "2006.01.02", which give index names like "logs-2026.10.17".
+	IndexPrefix     string
+	IndexDateLayout string
+}
+
+// ElasticsearchHandler writes records in batches to Elasticsearch or
+// OpenSearch with the _bulk API of the cluster at url, like
+// "http://localhost:9200". Each record is a document formatted with
+// JsonFormat under the keys "@timestamp", "level" and "message",
+// created in a date based index. For example:
+//
+//	h := logext.ElasticsearchHandler("http://localhost:9200", logext.ElasticsearchOptions{
+//	    IndexPrefix: "api-",
+//	})
+//	defer h.Close()
+//
+// Documents which the cluster rejects with status 429 or 5xx in the bulk
+// response are retried with the next batch, up to opts.Batch.MaxAttempts
+// times. Other rejected documents, like those which don't match the
+// mapping of the index, are dropped.
+func ElasticsearchHandler(url string, opts ElasticsearchOptions) *Elasticsearch {
+	opts.setDefaults()
+	if opts.IndexPrefix == "" {
+		opts.IndexPrefix = "logs-"
+	}
+	if opts.IndexDateLayout == "" {
+		opts.IndexDateLayout = "2006.01.02"
+	}
+	es := &Elasticsearch{
+		url:    strings.TrimSuffix(url, "/") + "/_bulk",
+		opts:   opts,
+		fmtr:   log.SafeFormat(log.JsonFormat()),
+		client: &httpClient{opts.HTTPOptions},
+	}
+	es.batch = newBatch(es, opts.Batch, false)
+	return es
+}
+
+// Elasticsearch is the Log15.Handler. Read `ElasticsearchHandler` for more information.
+type Elasticsearch struct {
+	url      string
+	opts     ElasticsearchOptions
+	fmtr     log.Format
+	client   *httpClient
+	batch    *Batch
+	rejected atomic.Uint64
+}
+
+// Log implements log15.Handler interface.
+func (es *Elasticsearch) Log(r *log.Record) error {
+	return es.batch.Log(r)
+}
+
+// index returns the name of the index for r.
+func (es *Elasticsearch) index(r *log.Record) string {
+	return es.opts.IndexPrefix + r.Time.UTC().Format(es.opts.IndexDateLayout)
+}
+
+// bulkItem is the result of an action in a bulk response.
+type bulkItem struct {
+	Status int `json:"status"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+// LogBatch implements BatchSink.
+func (es *Elasticsearch) LogBatch(records []*log.Record) error {
+	var body bytes.Buffer
+	for _, r := range records {
+		action, _ := json.Marshal(map[string]interface{}{
+			"create": map[string]string{"_index": es.index(r)},
+		})
+		body.Write(action)
+		body.WriteByte('\n')
+
+		doc := *r
+		doc.KeyNames = log.RecordKeyNames{Time: "@timestamp", Lvl: "level", Msg: "message"}
+		body.Write(es.fmtr.Format(&doc))
+	}
+
+	resp, err := es.client.post(es.url, "application/x-ndjson", body.Bytes())
+	if err != nil {
+		return err
+	}
+
+	var result struct {
+		Errors bool                  `json:"errors"`
+		Items  []map[string]bulkItem `json:"items"`
+	}
+	if err := json.Unmarshal(resp, &result); err != nil {
+		// the request succeeded, so report the error without retrying
+		return &BatchError{Err: fmt.Errorf("log15: bad bulk response: %v", err)}
+	}
+	if !result.Errors {
+		return nil
+	}
+	if len(result.Items) != len(records) {
+		return fmt.Errorf("log15: bulk response has %d items for %d records", len(result.Items), len(records))
+	}
+
+	var failed []*log.Record
+	var reasons []string
+	for i, item := range result.Items {
+		for _, res := range item {
+			if res.Status < 300 {
+				continue
+			}
+			if res.Status == 429 || res.Status >= 500 {
+				failed = append(failed, records[i])
+			} else {
+				es.rejected.Add(1)
+			}
+			if res.Error != nil && len(reasons) < 3 {
+				reasons = append(reasons, fmt.Sprintf("%d %s: %s", res.Status, res.Error.Type, res.Error.Reason))
+			}
+		}
+	}
+	return &BatchError{
+		Failed: failed,
+		Err:    fmt.Errorf("log15: bulk errors: %s", strings.Join(reasons, "; ")),
+	}
+}
+
+// Flush writes the records logged so far and returns when it is done.
+func (es *Elasticsearch) Flush() {
+	es.batch.Flush()
+}
+
+// Dropped returns the number of records which were rejected by the
+// cluster or failed too many times.
+func (es *Elasticsearch) Dropped() uint64 {
+	return es.rejected.Load() + es.batch.Dropped()
+}
+
+// Close writes the remaining records and stops the handler.
+func (es *Elasticsearch) Close() error {
+	return es.batch.Close()
+}
@@ -0,0 +1,153 @@
+package ext
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// bulkServer is a stand-in for the _bulk API which checks the action and
+// document pairs and answers for each document with the status returned
+// by status.
+type bulkServer struct {
+	*httptest.Server
+	t      *testing.T
+	status func(doc map[string]interface{}, attempt int) int
+
+	mu       sync.Mutex
+	indexed  []string
+	indices  []string
+	attempts map[string]int
+}
+
+func newBulkServer(t *testing.T, status func(doc map[string]interface{}, attempt int) int) *bulkServer {
+	srv := &bulkServer{t: t, status: status, attempts: make(map[string]int)}
+	srv.Server = httptest.NewServer(http.HandlerFunc(srv.serve))
+	return srv
+}
+
+func (srv *bulkServer) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/_bulk" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+		srv.t.Errorf("unexpected request %s %s", r.URL.Path, r.Header.Get("Content-Type"))
+	}
+	zr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	var items []string
+	hasErrors := false
+	sc := bufio.NewScanner(zr)
+	for sc.Scan() {
+		var action map[string]map[string]string
+		if err := json.Unmarshal(sc.Bytes(), &action); err != nil || action["create"]["_index"] == "" {
+			srv.t.Errorf("bad action line %q", sc.Text())
+		}
+		if !sc.Scan() {
+			srv.t.Errorf("action without document")
+			break
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal(sc.Bytes(), &doc); err != nil {
+			srv.t.Errorf("bad document line %q", sc.Text())
+		}
+		msg, _ := doc["message"].(string)
+		srv.attempts[msg]++
+		status := srv.status(doc, srv.attempts[msg])
+		if status < 300 {
+			srv.indexed = append(srv.indexed, msg)
+			srv.indices = append(srv.indices, action["create"]["_index"])
+			items = append(items, fmt.Sprintf(`{"create":{"status":%d}}`, status))
+		} else {
+			hasErrors = true
+			items = append(items, fmt.Sprintf(`{"create":{"status":%d,"error":{"type":"test_exception","reason":"%s"}}}`, status, msg))
+		}
+	}
+	fmt.Fprintf(w, `{"took":1,"errors":%v,"items":[%s]}`, hasErrors, strings.Join(items, ","))
+}
+
+func TestElasticsearchHandler(t *testing.T) {
+	t.Parallel()
+
+	srv := newBulkServer(t, func(doc map[string]interface{}, attempt int) int {
+		if doc["@timestamp"] == nil || doc["level"] != "info" {
+			t.Errorf("wrong document: %v", doc)
+		}
+		return 201
+	})
+	defer srv.Close()
+
+	h := ElasticsearchHandler(srv.URL, ElasticsearchOptions{})
+	l := log.New("app", "test")
+	l.SetHandler(log.FuncHandler(func(r *log.Record) error {
+		r.Time = time.Date(2026, 10, 17, 23, 0, 0, 0, time.FixedZone("", -3600))
+		return h.Log(r)
+	}))
+	l.Info("one")
+	l.Info("two")
+	h.Close()
+
+	if strings.Join(srv.indexed, ",") != "one,two" {
+		t.Fatalf("wrong documents: %v", srv.indexed)
+	}
+	if srv.indices[0] != "logs-2026.10.18" {
+		t.Fatalf("wrong index: %s", srv.indices[0])
+	}
+}
+
+func TestElasticsearchHandlerItemErrors(t *testing.T) {
+	t.Parallel()
+
+	srv := newBulkServer(t, func(doc map[string]interface{}, attempt int) int {
+		switch doc["message"] {
+		case "busy":
+			if attempt < 3 {
+				return 429
+			}
+		case "bad":
+			return 400
+		}
+		return 201
+	})
+	defer srv.Close()
+
+	var errs []string
+	h := ElasticsearchHandler(srv.URL, ElasticsearchOptions{
+		HTTPOptions: HTTPOptions{
+			Batch: BatchOptions{OnError: func(err error) { errs = append(errs, err.Error()) }},
+		},
+		IndexPrefix: "test-",
+	})
+	l := log.New()
+	l.SetHandler(h)
+	l.Info("ok")
+	l.Info("busy")
+	l.Info("bad")
+	h.Close()
+
+	// only the failed documents are sent again
+	if srv.attempts["ok"] != 1 || srv.attempts["bad"] != 1 || srv.attempts["busy"] != 3 {
+		t.Fatalf("wrong attempts: %v", srv.attempts)
+	}
+	if strings.Join(srv.indexed, ",") != "ok,busy" {
+		t.Fatalf("wrong documents: %v", srv.indexed)
+	}
+	if h.Dropped() != 1 {
+		t.Fatalf("expected the bad document to be dropped, got %d", h.Dropped())
+	}
+	if len(errs) != 2 || !strings.Contains(errs[0], "400 test_exception: bad") {
+		t.Fatalf("wrong errors: %v", errs)
+	}
+}
@@ -0,0 +1,153 @@
+package ext
+
+import (
+	"expvar"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// DropCounter is implemented by handlers which may drop records instead
+// of writing them, like handlers which buffer or sample records. An
+// Instrumented handler publishes the count of such a wrapped handler.
+type DropCounter interface {
+	// Dropped returns the number of records dropped so far.
+	Dropped() uint64
+}
+
+// InstrumentHandler wraps h to collect metrics about the records it
+// handles and publishes them with expvar under name. It panics if name is
+// already in use, like expvar.Publish. The metrics are a JSON object like:
+//
+//	{
+//	    "records": {"crit": 0, "eror": 2, "warn": 0, "info": 120, "dbug": 0},
+//	    "errors": 1,
+//	    "dropped": 0,
+//	    "latency_us": {"le_10": 97, "le_100": 120, ..., "le_inf": 122, "count": 122, "sum": 2210}
+//	}
+//
+// where records counts the records by level, errors counts the records
+// for which h returned an error, dropped is the count of h if it
+// implements DropCounter and latency_us is a cumulative histogram of the
+// time h took to handle each record, in microseconds.
+func InstrumentHandler(name string, h log.Handler) *Instrumented {
+	i := newInstrumented(h)
+	expvar.Publish(name, i.vars)
+	return i
+}
+
+// InstrumentConfig builds the handler tree described by c with each of
+// its handlers instrumented like by InstrumentHandler. The metrics of all
+// handlers are published with expvar under name in a single map keyed by
+// the handlers' paths in c, like "$" and "$.handlers[0]". Like
+// InstrumentHandler, it panics if name is already in use, which it checks
+// before building c.
+func InstrumentConfig(name string, c *log.Config) (log.Handler, error) {
+	// panic like expvar.Publish, but before any handler is built
+	if expvar.Get(name) != nil {
+		panic("Reuse of exported var name: " + name)
+	}
+	tree := new(expvar.Map).Init()
+	h, err := c.BuildWith(func(path string, h log.Handler) log.Handler {
+		i := newInstrumented(h)
+		tree.Set(path, i.vars)
+		return i
+	})
+	if err != nil {
+		return nil, err
+	}
+	expvar.Publish(name, tree)
+	return h, nil
+}
+
+// Instrumented is the Log15.Handler. Read `InstrumentHandler` for more information.
+type Instrumented struct {
+	handler log.Handler
+	vars    *expvar.Map
+	levels  [log.LvlDebug + 1]expvar.Int
+	errors  expvar.Int
+	latency histogram
+}
+
+func newInstrumented(h log.Handler) *Instrumented {
+	i := &Instrumented{handler: h}
+
+	records := new(expvar.Map).Init()
+	for lvl := range i.levels {
+		records.Set(log.Lvl(lvl).String(), &i.levels[lvl])
+	}
+
+	i.vars = new(expvar.Map).Init()
+	i.vars.Set("records", records)
+	i.vars.Set("errors", &i.errors)
+	i.vars.Set("dropped", expvar.Func(func() interface{} {
+		if d, ok := h.(DropCounter); ok {
+			return d.Dropped()
+		}
+		return 0
+	}))
+	i.vars.Set("latency_us", &i.latency)
+	return i
+}
+
+// Log implements log15.Handler interface.
+func (i *Instrumented) Log(r *log.Record) error {
+	if r.Lvl >= 0 && int(r.Lvl) < len(i.levels) {
+		i.levels[r.Lvl].Add(1)
+	}
+
+	start := time.Now()
+	err := i.handler.Log(r)
+	i.latency.observe(time.Since(start))
+
+	if err != nil {
+		i.errors.Add(1)
+	}
+	return err
+}
+
+// Vars returns the metrics of the handler.
+func (i *Instrumented) Vars() *expvar.Map {
+	return i.vars
+}
+
+// latencyBuckets are the upper bounds of the buckets of a histogram in
+// microseconds.
+var latencyBuckets = [...]int64{10, 50, 100, 500, 1000, 5000, 10000, 50000, 100000}
+
+// histogram is an expvar.Var which counts durations in latencyBuckets.
+type histogram struct {
+	// counts has an extra bucket for durations above all bounds
+	counts [len(latencyBuckets) + 1]atomic.Int64
+	sum    atomic.Int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	us := d.Microseconds()
+	b := len(latencyBuckets)
+	for i, bound := range latencyBuckets {
+		if us <= bound {
+			b = i
+			break
+		}
+	}
+	h.counts[b].Add(1)
+	h.sum.Add(us)
+}
+
+// String implements expvar.Var.
+func (h *histogram) String() string {
+	var b strings.Builder
+	var total int64
+	b.WriteByte('{')
+	for i, bound := range latencyBuckets {
+		total += h.counts[i].Load()
+		fmt.Fprintf(&b, `"le_%d": %d, `, bound, total)
+	}
+	total += h.counts[len(latencyBuckets)].Load()
+	fmt.Fprintf(&b, `"le_inf": %d, "count": %d, "sum": %d}`, total, total, h.sum.Load())
+	return b.String()
+}
@@ -1,9 +1,21 @@
 package ext
 
 import (
+	"encoding/json"
 	"errors"
+	"expvar"
+	"fmt"
 	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	log "github.com/inconshreveable/log15"
 )
@@ -108,3 +120,662 @@ func TestErrorHandler(t *testing.T) {
 		t.Fatalf("Expected debug level message to be escalated to LvlError")
 	}
 }
+
+type droppingHandler struct {
+	dropped uint64
+}
+
+func (h *droppingHandler) Log(r *log.Record) error {
+	h.dropped++
+	return nil
+}
+
+func (h *droppingHandler) Dropped() uint64 {
+	return h.dropped
+}
+
+// droppingType is the handler of the "ext-test-dropping" type, which is
+// registered once since RegisterHandlerType panics for a type registered
+// twice.
+var droppingType = &droppingHandler{}
+
+func init() {
+	log.RegisterHandlerType("ext-test-dropping", func(c *log.Config, children []log.Handler) (log.Handler, error) {
+		return droppingType, nil
+	})
+}
+
+var expvarNames atomic.Int64
+
+// expvarName returns a name for the metrics of a test which isn't in use
+// yet, even if the test runs again.
+func expvarName(t *testing.T, suffix string) string {
+	return fmt.Sprintf("log15_%s_%s_%d", t.Name(), suffix, expvarNames.Add(1))
+}
+
+func TestInstrumentHandler(t *testing.T) {
+	t.Parallel()
+
+	fail := true
+	name := expvarName(t, "instrument")
+	h := InstrumentHandler(name, log.FuncHandler(func(r *log.Record) error {
+		if fail {
+			return errors.New("fail")
+		}
+		return nil
+	}))
+
+	l := log.New()
+	l.SetHandler(h)
+	l.Error("error")
+	fail = false
+	l.Info("info")
+	l.Info("info")
+
+	var v struct {
+		Records map[string]int
+		Errors  int
+		Dropped int
+		Latency map[string]int `json:"latency_us"`
+	}
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &v); err != nil {
+		t.Fatal(err)
+	}
+
+	if v.Records["eror"] != 1 || v.Records["info"] != 2 || v.Records["dbug"] != 0 {
+		t.Fatalf("wrong record counts: %v", v.Records)
+	}
+	if v.Errors != 1 {
+		t.Fatalf("wrong error count: %d", v.Errors)
+	}
+	if v.Latency["count"] != 3 || v.Latency["le_inf"] != 3 {
+		t.Fatalf("wrong latency histogram: %v", v.Latency)
+	}
+}
+
+func TestInstrumentConfig(t *testing.T) {
+	t.Parallel()
+
+	start := droppingType.Dropped()
+	name := expvarName(t, "tree")
+	h, err := InstrumentConfig(name, &log.Config{
+		Type: "multi",
+		Handlers: []*log.Config{
+			{Type: "ext-test-dropping"},
+			{Type: "discard", Level: "eror"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := log.New()
+	l.SetHandler(h)
+	l.Info("info")
+	l.Error("error")
+
+	var v map[string]struct {
+		Records map[string]int
+		Dropped int
+	}
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &v); err != nil {
+		t.Fatal(err)
+	}
+
+	if v["$"].Records["info"] != 1 || v["$"].Records["eror"] != 1 {
+		t.Fatalf("wrong record counts for root: %v", v["$"].Records)
+	}
+	if v["$.handlers[0]"].Dropped != int(start)+2 {
+		t.Fatalf("wrong drop count: %d", v["$.handlers[0]"].Dropped)
+	}
+	if v["$.handlers[1]"].Records["info"] != 0 || v["$.handlers[1]"].Records["eror"] != 1 {
+		t.Fatalf("wrong record counts for filtered handler: %v", v["$.handlers[1]"].Records)
+	}
+}
+
+func TestInstrumentConfigNameInUse(t *testing.T) {
+	t.Parallel()
+
+	name := expvarName(t, "tree")
+	expvar.NewInt(name)
+	path := filepath.Join(t.TempDir(), "a.log")
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic for a name in use")
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("the handlers were built before the name was checked: %v", err)
+		}
+	}()
+	InstrumentConfig(name, &log.Config{Type: "file", Path: path})
+}
+
+func TestInstrumentDropped(t *testing.T) {
+	t.Parallel()
+
+	spec := SpeculativeHandler(2, log.DiscardHandler())
+	buffered := log.BufferedHandler(1, log.FuncHandler(func(r *log.Record) error {
+		return errors.New("fail")
+	}))
+	specName, bufferedName := expvarName(t, "speculative"), expvarName(t, "buffered")
+	l := log.New()
+	l.SetHandler(log.MultiHandler(
+		InstrumentHandler(specName, spec),
+		InstrumentHandler(bufferedName, buffered),
+	))
+
+	dropped := func(name string) int {
+		var v struct{ Dropped int }
+		if err := json.Unmarshal([]byte(expvar.Get(name).String()), &v); err != nil {
+			t.Fatal(err)
+		}
+		return v.Dropped
+	}
+	if n := dropped(specName); n != 0 {
+		t.Fatalf("expected no dropped records yet, got %d", n)
+	}
+
+	for i := 0; i < 5; i++ {
+		l.Info("test", "i", i)
+	}
+
+	// the ring buffer of 2 records overwrote the first 3
+	if n := dropped(specName); n != 3 {
+		t.Fatalf("wrong speculative drop count: %d", n)
+	}
+	for deadline := time.Now().Add(5 * time.Second); dropped(bufferedName) != 5; {
+		if time.Now().After(deadline) {
+			t.Fatalf("wrong buffered drop count: %d", dropped(bufferedName))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLevelAdminLogsWithoutLock(t *testing.T) {
+	t.Parallel()
+
+	// the change log calls back into the admin, which deadlocks if it
+	// logs with its lock held
+	var admin *LevelAdmin
+	logged := make(chan []LevelStatus, 2)
+	changeLog := log.New()
+	changeLog.SetHandler(log.FuncHandler(func(r *log.Record) error {
+		logged <- admin.Levels()
+		return nil
+	}))
+	admin = NewLevelAdmin(changeLog, nil)
+	admin.RegisterLogger("db", log.New(), log.LvlInfo)
+
+	go admin.SetLevel("db", log.LvlDebug, time.Millisecond)
+	// the change, then the revert
+	for _, expected := range []string{"dbug", "info"} {
+		select {
+		case levels := <-logged:
+			if levels[0].Level != expected {
+				t.Fatalf("expected level %s, got %s", expected, levels[0].Level)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("deadlock logging a level change")
+		}
+	}
+}
+
+func TestLevelAdmin(t *testing.T) {
+	t.Parallel()
+
+	changes, changeRec := testHandler()
+	changeLog := log.New()
+	changeLog.SetHandler(changes)
+
+	admin := NewLevelAdmin(changeLog, func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "secret"
+	})
+
+	h, r := testHandler()
+	l := log.New()
+	l.SetHandler(h)
+	admin.RegisterLogger("db", l, log.LvlInfo)
+
+	post := func(auth string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := post("wrong", url.Values{"name": {"db"}, "level": {"debug"}}); w.Code != http.StatusForbidden {
+		t.Fatalf("expected unauthorized change to be forbidden, got %d", w.Code)
+	}
+	if w := post("secret", url.Values{"name": {"cache"}, "level": {"debug"}}); w.Code != http.StatusNotFound {
+		t.Fatalf("expected change of unknown name to fail, got %d", w.Code)
+	}
+	if w := post("secret", url.Values{"name": {"db"}, "level": {"debug"}, "ttl": {"-1m"}}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected negative ttl to be rejected, got %d", w.Code)
+	}
+
+	l.Debug("hidden")
+	if r.Msg != "" {
+		t.Fatalf("expected debug record to be filtered")
+	}
+
+	if w := post("secret", url.Values{"name": {"db"}, "level": {"debug"}, "ttl": {"50ms"}}); w.Code != http.StatusOK {
+		t.Fatalf("expected change to succeed, got %d: %s", w.Code, w.Body)
+	}
+	if changeRec.Msg != "log level changed" {
+		t.Fatalf("expected change to be logged")
+	}
+
+	l.Debug("shown")
+	if r.Msg != "shown" {
+		t.Fatalf("expected debug record after level change")
+	}
+
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected unauthorized listing to be forbidden, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "secret")
+	admin.ServeHTTP(w, req)
+	var levels []LevelStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &levels); err != nil {
+		t.Fatal(err)
+	}
+	if len(levels) != 1 || levels[0].Level != "dbug" || levels[0].RevertTo != "info" || levels[0].Expires == nil {
+		t.Fatalf("unexpected levels: %+v", levels)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for admin.Levels()[0].Level != "info" {
+		if time.Now().After(deadline) {
+			t.Fatalf("level was not reverted after ttl")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	l.Debug("hidden again")
+	if r.Msg != "shown" {
+		t.Fatalf("expected debug record to be filtered after revert")
+	}
+}
+
+func TestCircuitBreakerHandler(t *testing.T) {
+	t.Parallel()
+
+	fail := true
+	var primary, fallback int
+	h := log.FuncHandler(func(r *log.Record) error {
+		if fail {
+			return errors.New("down")
+		}
+		primary++
+		return nil
+	})
+	fb := log.FuncHandler(func(r *log.Record) error {
+		fallback++
+		return nil
+	})
+
+	b := CircuitBreakerHandler(2, 20*time.Millisecond, h, fb)
+	var transitions []string
+	b.OnStateChange(func(from, to BreakerState) {
+		transitions = append(transitions, from.String()+">"+to.String())
+	})
+
+	l := log.New()
+	l.SetHandler(b)
+
+	l.Info("a")
+	if b.State() != BreakerClosed {
+		t.Fatalf("breaker opened after one failure")
+	}
+	l.Info("b")
+	if b.State() != BreakerOpen {
+		t.Fatalf("expected open breaker, got %s", b.State())
+	}
+	l.Info("c")
+	if fallback != 3 {
+		t.Fatalf("expected 3 records on fallback, got %d", fallback)
+	}
+
+	// failed trial reopens
+	time.Sleep(25 * time.Millisecond)
+	l.Info("d")
+	if b.State() != BreakerOpen {
+		t.Fatalf("expected open breaker after failed trial, got %s", b.State())
+	}
+
+	// successful trial closes
+	fail = false
+	time.Sleep(25 * time.Millisecond)
+	l.Info("e")
+	l.Info("f")
+	if b.State() != BreakerClosed || primary != 2 {
+		t.Fatalf("expected closed breaker and 2 records on primary, got %s and %d", b.State(), primary)
+	}
+
+	want := "closed>open open>half-open half-open>open open>half-open half-open>closed"
+	if got := strings.Join(transitions, " "); got != want {
+		t.Fatalf("wrong transitions:\ngot:  %s\nwant: %s", got, want)
+	}
+}
+
+func TestCircuitBreakerNoFallback(t *testing.T) {
+	t.Parallel()
+
+	b := CircuitBreakerHandler(1, time.Hour, log.FuncHandler(func(r *log.Record) error {
+		return errors.New("down")
+	}), nil)
+	if err := b.Log(&log.Record{}); err == nil || err.Error() != "down" {
+		t.Fatalf("expected handler error, got %v", err)
+	}
+	if err := b.Log(&log.Record{}); err != ErrBreakerOpen {
+		t.Fatalf("expected ErrBreakerOpen, got %v", err)
+	}
+}
+
+func TestCircuitBreakerStaleSuccess(t *testing.T) {
+	t.Parallel()
+
+	entered, release := make(chan struct{}), make(chan struct{})
+	b := CircuitBreakerHandler(1, time.Hour, log.FuncHandler(func(r *log.Record) error {
+		if r.Msg == "slow" {
+			close(entered)
+			<-release
+			return nil
+		}
+		return errors.New("down")
+	}), nil)
+
+	done := make(chan struct{})
+	go func() {
+		b.Log(&log.Record{Msg: "slow"})
+		close(done)
+	}()
+	<-entered
+	b.Log(&log.Record{Msg: "fail"})
+	close(release)
+	<-done
+
+	// the success of the slow record was started before the breaker opened
+	if b.State() != BreakerOpen {
+		t.Fatalf("expected open breaker, got %s", b.State())
+	}
+}
+
+func TestCircuitBreakerStateChangeLogs(t *testing.T) {
+	t.Parallel()
+
+	b := CircuitBreakerHandler(1, time.Hour, log.FuncHandler(func(r *log.Record) error {
+		return errors.New("down")
+	}), nil)
+	var logged error
+	b.OnStateChange(func(from, to BreakerState) {
+		logged = b.Log(&log.Record{Msg: "breaker " + to.String()})
+	})
+
+	done := make(chan struct{})
+	go func() {
+		b.Log(&log.Record{Msg: "fail"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("deadlock logging a state change to the breaker")
+	}
+	if logged != ErrBreakerOpen {
+		t.Fatalf("expected ErrBreakerOpen, got %v", logged)
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRetryHandler(t *testing.T) {
+	t.Parallel()
+
+	var attempts int
+	h := RetryHandler(log.FuncHandler(func(r *log.Record) error {
+		attempts++
+		if attempts < 3 {
+			return timeoutError{}
+		}
+		return nil
+	}), RetryOptions{MinBackoff: time.Millisecond})
+
+	if err := h.Log(&log.Record{}); err != nil {
+		t.Fatalf("expected success after retries, got %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+
+	// exhausted attempts
+	attempts = -10
+	if err := h.Log(&log.Record{}); !IsTimeout(err) {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+	if attempts != -7 || h.Dropped() != 1 {
+		t.Fatalf("expected 3 attempts and 1 drop, got %d and %d", attempts+10, h.Dropped())
+	}
+
+	// errors which aren't retryable
+	attempts = 0
+	h = RetryHandler(log.FuncHandler(func(r *log.Record) error {
+		attempts++
+		return errors.New("permanent")
+	}), RetryOptions{MinBackoff: time.Millisecond})
+	if err := h.Log(&log.Record{}); err == nil || attempts != 1 {
+		t.Fatalf("expected a single failed attempt, got %d: %v", attempts, err)
+	}
+}
+
+func TestRetryHandlerBackground(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var msgs []string
+	var fail = map[string]int{"a": 2, "b": 0}
+	h := RetryHandler(log.FuncHandler(func(r *log.Record) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if fail[r.Msg] > 0 {
+			fail[r.Msg]--
+			return timeoutError{}
+		}
+		msgs = append(msgs, r.Msg)
+		return nil
+	}), RetryOptions{MinBackoff: 20 * time.Millisecond, Background: true})
+
+	if err := h.Log(&log.Record{Msg: "a"}); err != nil {
+		t.Fatalf("expected queued retry, got %v", err)
+	}
+	if err := h.Log(&log.Record{Msg: "b"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	h.Close()
+
+	if got := strings.Join(msgs, ","); got != "b,a" {
+		t.Fatalf("expected b then retried a, got %s", got)
+	}
+
+	fail["c"] = 1
+	if err := h.Log(&log.Record{Msg: "c"}); err == nil || h.Dropped() != 1 {
+		t.Fatalf("expected failure without retry after Close, got %v and %d drops", err, h.Dropped())
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	t.Parallel()
+
+	for retry, max := range map[int]time.Duration{1: 10, 2: 20, 3: 40, 4: 50, 100: 50} {
+		max *= time.Millisecond
+		for i := 0; i < 20; i++ {
+			if d := backoff(10*time.Millisecond, 50*time.Millisecond, retry); d < max/2 || d > max {
+				t.Fatalf("backoff %d out of range: %v", retry, d)
+			}
+		}
+	}
+}
+
+type testSink struct {
+	mu      sync.Mutex
+	batches [][]string
+	fail    func(records []*log.Record) error
+}
+
+func (s *testSink) LogBatch(records []*log.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	failed := make(map[*log.Record]bool)
+	if s.fail != nil {
+		err = s.fail(records)
+		var be *BatchError
+		if errors.As(err, &be) {
+			for _, r := range be.Failed {
+				failed[r] = true
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+	var msgs []string
+	for _, r := range records {
+		if !failed[r] {
+			msgs = append(msgs, r.Msg)
+		}
+	}
+	if msgs != nil {
+		s.batches = append(s.batches, msgs)
+	}
+	return err
+}
+
+func (s *testSink) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var batches []string
+	for _, b := range s.batches {
+		batches = append(batches, strings.Join(b, ","))
+	}
+	return strings.Join(batches, " ")
+}
+
+func TestBatchHandler(t *testing.T) {
+	t.Parallel()
+
+	sink := new(testSink)
+	h := BatchHandler(sink, BatchOptions{
+		MaxRecords: 3,
+		MaxBytes:   10,
+		MaxDelay:   time.Hour,
+		Size:       func(r *log.Record) int { return len(r.Msg) },
+	})
+
+	for _, msg := range []string{"a", "b", "c", "dddd", "eeee", "ffff", "g"} {
+		h.Log(&log.Record{Msg: msg})
+	}
+	h.Flush()
+	// a,b,c by count, dddd,eeee before ffff would exceed 10 bytes
+	if got := sink.String(); got != "a,b,c dddd,eeee ffff,g" {
+		t.Fatalf("wrong batches: %s", got)
+	}
+
+	h.Log(&log.Record{Msg: "h"})
+	h.Close()
+	if got := sink.String(); !strings.HasSuffix(got, " h") {
+		t.Fatalf("records not flushed on close: %s", got)
+	}
+	if err := h.Log(&log.Record{Msg: "i"}); err != ErrBatchClosed {
+		t.Fatalf("expected ErrBatchClosed, got %v", err)
+	}
+}
+
+func TestBatchHandlerDelay(t *testing.T) {
+	t.Parallel()
+
+	sink := new(testSink)
+	h := BatchHandler(sink, BatchOptions{MaxDelay: 10 * time.Millisecond})
+	defer h.Close()
+
+	h.Log(&log.Record{Msg: "a"})
+	time.Sleep(50 * time.Millisecond)
+	if got := sink.String(); got != "a" {
+		t.Fatalf("batch not flushed after delay: %q", got)
+	}
+}
+
+func TestBatchHandlerBackoff(t *testing.T) {
+	t.Parallel()
+
+	var attempts []time.Time
+	sink := new(testSink)
+	sink.fail = func(records []*log.Record) error {
+		attempts = append(attempts, time.Now())
+		return errors.New("unavailable")
+	}
+	h := BatchHandler(sink, BatchOptions{
+		MaxRecords: 1,
+		MaxDelay:   time.Hour,
+		MinBackoff: 20 * time.Millisecond,
+	})
+
+	// the full batch is retried after the backoff rather than right away
+	h.Log(&log.Record{Msg: "a"})
+	h.Close()
+	if len(attempts) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(attempts))
+	}
+	for i := 1; i < len(attempts); i++ {
+		if d := attempts[i].Sub(attempts[i-1]); d < 10*time.Millisecond {
+			t.Fatalf("attempt %d only %v after the previous one", i+1, d)
+		}
+	}
+	if h.Dropped() != 1 {
+		t.Fatalf("expected 1 drop, got %d", h.Dropped())
+	}
+}
+
+func TestBatchHandlerPartialFailure(t *testing.T) {
+	t.Parallel()
+
+	var errs int
+	sink := new(testSink)
+	sink.fail = func(records []*log.Record) error {
+		var failed []*log.Record
+		for _, r := range records {
+			if r.Msg == "bad" || r.Msg == "flaky" && errs < 2 {
+				failed = append(failed, r)
+			}
+		}
+		if failed != nil {
+			return &BatchError{Failed: failed, Err: errors.New("rejected")}
+		}
+		return nil
+	}
+	h := BatchHandler(sink, BatchOptions{
+		MaxDelay: time.Hour,
+		OnError:  func(err error) { errs++ },
+	})
+
+	h.Log(&log.Record{Msg: "ok"})
+	h.Log(&log.Record{Msg: "flaky"})
+	h.Log(&log.Record{Msg: "bad"})
+	h.Close()
+
+	// flaky succeeds on its third attempt and bad is dropped
+	if got := sink.String(); got != "ok flaky" {
+		t.Fatalf("wrong batches: %q", got)
+	}
+	if errs != 3 || h.Dropped() != 1 {
+		t.Fatalf("expected 3 errors and 1 drop, got %d and %d", errs, h.Dropped())
+	}
+}
@@ -0,0 +1,378 @@
+package ext
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// FluentOptions configures a FluentHandler. The zero value sends each
+// record in Message mode with the tag "log15".
+type FluentOptions struct {
+	// Tag is the tag of the records. Defaults to "log15".
+	Tag string
+
+	// TagKey, if set, is a context key whose value is the tag of the
+	// record instead of Tag. The key isn't sent with the record.
+	TagKey string
+
+	// Packed sends records in batches in PackedForward mode, configured
+	// by Batch, instead of one Message per record.
+	Packed bool
+	Batch  BatchOptions
+
+	// Ack makes the handler ask the server to acknowledge each message
+	// (the "chunk" option), and send it again on a new connection if it
+	// doesn't within AckTimeout, 10s by default.
+	Ack        bool
+	AckTimeout time.Duration
+
+	// DialTimeout limits connecting to the server, 5s by default. After
+	// a failed attempt, the handler waits for an exponential backoff from
+	// MinBackoff to MaxBackoff, 100ms and 30s by default, before it
+	// connects again, failing the records logged in the meantime.
+	DialTimeout time.Duration
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+}
+
+// ErrFluentBackoff is returned for records logged while a FluentHandler
+// waits to connect again.
+var ErrFluentBackoff = errors.New("log15: waiting to reconnect to fluentd")
+
+// FluentHandler sends records to Fluentd or Fluent Bit at addr with the
+// Forward protocol. Each record is a MessagePack map of its level, message
+// and context under their keys, with the time as an EventTime. For example:
+//
+//	h := logext.FluentHandler("tcp", "localhost:24224", logext.FluentOptions{
+//	    Tag:    "app",
+//	    TagKey: "tag",
+//	    Ack:    true,
+//	})
+//	defer h.Close()
+//
+// The handler connects lazily and again after the connection fails, in
+// which case the message is sent once more. In Message mode, Log returns
+// when the record is sent, or acknowledged with opts.Ack. In Packed mode,
+// the records of a batch are sent in a PackedForward message per tag, and
+// records which fail are retried like by BatchHandler, but records logged
+// while a batch worth of records waits to be sent are dropped rather than
+// block the caller.
+func FluentHandler(network, addr string, opts FluentOptions) *Fluent {
+	if opts.Tag == "" {
+		opts.Tag = "log15"
+	}
+	if opts.AckTimeout <= 0 {
+		opts.AckTimeout = 10 * time.Second
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 100 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 30 * time.Second
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = opts.MinBackoff
+	}
+
+	f := &Fluent{network: network, addr: addr, opts: opts}
+	if opts.Packed {
+		f.batch = newBatch(f, opts.Batch, false)
+		f.handler = f.batch
+	} else {
+		f.handler = log.LazyHandler(log.FuncHandler(f.logMessage))
+	}
+	return f
+}
+
+// Fluent is the Log15.Handler. Read `FluentHandler` for more information.
+type Fluent struct {
+	handler log.Handler
+	network string
+	addr    string
+	opts    FluentOptions
+	batch   *Batch
+
+	mu       sync.Mutex
+	conn     net.Conn
+	resp     *bufio.Reader
+	failures int
+	nextDial time.Time
+}
+
+// Log implements log15.Handler interface.
+func (f *Fluent) Log(r *log.Record) error {
+	return f.handler.Log(r)
+}
+
+// tag returns the tag of r and the context to send without the tag key.
+func (f *Fluent) tag(r *log.Record) (string, []interface{}) {
+	if f.opts.TagKey == "" {
+		return f.opts.Tag, r.Ctx
+	}
+	tag := f.opts.Tag
+	ctx := make([]interface{}, 0, len(r.Ctx))
+	for i := 0; i < len(r.Ctx); i += 2 {
+		if i+1 < len(r.Ctx) && r.Ctx[i] == f.opts.TagKey {
+			if s, ok := r.Ctx[i+1].(string); ok && s != "" {
+				tag = s
+				continue
+			}
+		}
+		ctx = append(ctx, r.Ctx[i:min(i+2, len(r.Ctx))]...)
+	}
+	return tag, ctx
+}
+
+// appendEntry appends the [time, record] entry of r with ctx.
+func appendEntry(b []byte, r *log.Record, ctx []interface{}) []byte {
+	return appendTimeRecord(msgpackArrayHeader(b, 2), r, ctx)
+}
+
+// appendTimeRecord appends the time and the record map of r with ctx.
+func appendTimeRecord(b []byte, r *log.Record, ctx []interface{}) []byte {
+	b = msgpackEventTime(b, r.Time)
+	b = msgpackMapHeader(b, 2+(len(ctx)+1)/2)
+	b = msgpackString(b, r.KeyNames.Lvl)
+	b = msgpackString(b, r.Lvl.String())
+	b = msgpackString(b, r.KeyNames.Msg)
+	b = msgpackString(b, r.Msg)
+	for i := 0; i < len(ctx); i += 2 {
+		k, ok := ctx[i].(string)
+		if !ok {
+			k = fmt.Sprintf("%+v", ctx[i])
+		}
+		b = msgpackString(b, k)
+		if i+1 < len(ctx) {
+			b = appendFluentValue(b, ctx[i+1])
+		} else {
+			b = msgpackNil(b)
+		}
+	}
+	return b
+}
+
+func appendFluentValue(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return msgpackNil(b)
+	case string:
+		return msgpackString(b, v)
+	case bool:
+		return msgpackBool(b, v)
+	case int:
+		return msgpackInt(b, int64(v))
+	case int8:
+		return msgpackInt(b, int64(v))
+	case int16:
+		return msgpackInt(b, int64(v))
+	case int32:
+		return msgpackInt(b, int64(v))
+	case int64:
+		return msgpackInt(b, v)
+	case uint:
+		return msgpackUint(b, uint64(v))
+	case uint8:
+		return msgpackUint(b, uint64(v))
+	case uint16:
+		return msgpackUint(b, uint64(v))
+	case uint32:
+		return msgpackUint(b, uint64(v))
+	case uint64:
+		return msgpackUint(b, v)
+	case float32:
+		return msgpackFloat(b, float64(v))
+	case float64:
+		return msgpackFloat(b, v)
+	case []byte:
+		return msgpackBin(b, v)
+	case time.Time:
+		return msgpackString(b, v.Format(time.RFC3339Nano))
+	case error:
+		return msgpackString(b, v.Error())
+	case fmt.Stringer:
+		return msgpackString(b, v.String())
+	default:
+		return msgpackString(b, fmt.Sprintf("%+v", v))
+	}
+}
+
+// appendOption appends the option map of a message. size is omitted if
+// it's 0, chunk if it's empty.
+func appendOption(b []byte, size int, chunk string) []byte {
+	n := 0
+	if size > 0 {
+		n++
+	}
+	if chunk != "" {
+		n++
+	}
+	b = msgpackMapHeader(b, n)
+	if size > 0 {
+		b = msgpackString(b, "size")
+		b = msgpackUint(b, uint64(size))
+	}
+	if chunk != "" {
+		b = msgpackString(b, "chunk")
+		b = msgpackString(b, chunk)
+	}
+	return b
+}
+
+func (f *Fluent) newChunk() string {
+	if !f.opts.Ack {
+		return ""
+	}
+	var id [16]byte
+	rand.Read(id[:])
+	return base64.StdEncoding.EncodeToString(id[:])
+}
+
+// logMessage sends r in Message mode.
+func (f *Fluent) logMessage(r *log.Record) error {
+	tag, ctx := f.tag(r)
+	chunk := f.newChunk()
+
+	if chunk == "" {
+		msg := msgpackString(msgpackArrayHeader(nil, 3), tag)
+		return f.send(appendTimeRecord(msg, r, ctx), "")
+	}
+	msg := msgpackString(msgpackArrayHeader(nil, 4), tag)
+	msg = appendTimeRecord(msg, r, ctx)
+	return f.send(appendOption(msg, 0, chunk), chunk)
+}
+
+// LogBatch implements BatchSink. It sends a PackedForward message for the
+// records of each tag.
+func (f *Fluent) LogBatch(records []*log.Record) error {
+	var tags []string
+	byTag := make(map[string][]*log.Record)
+	entries := make(map[string][]byte)
+	for _, r := range records {
+		tag, ctx := f.tag(r)
+		if _, ok := byTag[tag]; !ok {
+			tags = append(tags, tag)
+		}
+		byTag[tag] = append(byTag[tag], r)
+		entries[tag] = appendEntry(entries[tag], r, ctx)
+	}
+
+	var failed []*log.Record
+	var err error
+	for _, tag := range tags {
+		chunk := f.newChunk()
+		msg := msgpackArrayHeader(nil, 3)
+		msg = msgpackString(msg, tag)
+		msg = msgpackBin(msg, entries[tag])
+		msg = appendOption(msg, len(byTag[tag]), chunk)
+		if serr := f.send(msg, chunk); serr != nil {
+			failed = append(failed, byTag[tag]...)
+			err = serr
+		}
+	}
+	if err != nil {
+		return &BatchError{Failed: failed, Err: err}
+	}
+	return nil
+}
+
+// send writes msg, waiting for the ack of chunk if it's set. If that
+// fails, it sends msg again on a new connection.
+func (f *Fluent) send(msg []byte, chunk string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if f.conn == nil {
+			if err = f.dial(); err != nil {
+				return err
+			}
+		}
+		if err = f.write(msg, chunk); err == nil {
+			return nil
+		}
+		f.conn.Close()
+		f.conn = nil
+	}
+	return err
+}
+
+func (f *Fluent) dial() error {
+	if time.Now().Before(f.nextDial) {
+		return ErrFluentBackoff
+	}
+	conn, err := net.DialTimeout(f.network, f.addr, f.opts.DialTimeout)
+	if err != nil {
+		f.failures++
+		f.nextDial = time.Now().Add(backoff(f.opts.MinBackoff, f.opts.MaxBackoff, f.failures))
+		return err
+	}
+	f.failures = 0
+	f.conn = conn
+	f.resp = bufio.NewReader(conn)
+	return nil
+}
+
+func (f *Fluent) write(msg []byte, chunk string) error {
+	if _, err := f.conn.Write(msg); err != nil {
+		return err
+	}
+	if chunk == "" {
+		return nil
+	}
+
+	f.conn.SetReadDeadline(time.Now().Add(f.opts.AckTimeout))
+	defer f.conn.SetReadDeadline(time.Time{})
+	resp, err := msgpackDecode(f.resp)
+	if err != nil {
+		return fmt.Errorf("log15: reading fluentd ack: %w", err)
+	}
+	if m, ok := resp.(map[string]interface{}); !ok || m["ack"] != chunk {
+		return fmt.Errorf("log15: unexpected fluentd ack %v", resp)
+	}
+	return nil
+}
+
+// Flush sends the records logged so far in Packed mode and returns when
+// it is done. It does nothing in Message mode.
+func (f *Fluent) Flush() {
+	if f.batch != nil {
+		f.batch.Flush()
+	}
+}
+
+// Dropped returns the number of records dropped in Packed mode after
+// failing too many times or because the batch was full.
+func (f *Fluent) Dropped() uint64 {
+	if f.batch != nil {
+		return f.batch.Dropped()
+	}
+	return 0
+}
+
+// Close sends the remaining records in Packed mode and closes the
+// connection.
+func (f *Fluent) Close() error {
+	if f.batch != nil {
+		f.batch.Close()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conn == nil {
+		return nil
+	}
+	err := f.conn.Close()
+	f.conn = nil
+	return err
+}
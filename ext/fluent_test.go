@@ -0,0 +1,291 @@
+package ext
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// fluentEvent is an event decoded by fluentServer.
+type fluentEvent struct {
+	tag    string
+	time   time.Time
+	record map[string]interface{}
+}
+
+// fluentServer is a stand-in for fluentd which decodes the messages it
+// receives and acks their chunks. With closeAfter set, it closes the first
+// connection after that many messages without acking the last one.
+type fluentServer struct {
+	t          *testing.T
+	l          net.Listener
+	closeAfter int
+
+	mu       sync.Mutex
+	events   []fluentEvent
+	messages int
+	conns    int
+	got      chan struct{}
+}
+
+func newFluentServer(t *testing.T) *fluentServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &fluentServer{t: t, l: l, got: make(chan struct{}, 100)}
+	go srv.serve()
+	t.Cleanup(func() { l.Close() })
+	return srv
+}
+
+func (srv *fluentServer) addr() string {
+	return srv.l.Addr().String()
+}
+
+func (srv *fluentServer) serve() {
+	for {
+		conn, err := srv.l.Accept()
+		if err != nil {
+			return
+		}
+		srv.mu.Lock()
+		srv.conns++
+		first := srv.conns == 1
+		srv.mu.Unlock()
+		go srv.serveConn(conn, first)
+	}
+}
+
+func (srv *fluentServer) serveConn(conn net.Conn, first bool) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for n := 1; ; n++ {
+		v, err := msgpackDecode(r)
+		if err != nil {
+			return
+		}
+		msg, ok := v.([]interface{})
+		if !ok || len(msg) < 2 {
+			srv.t.Errorf("bad message %#v", v)
+			return
+		}
+		if first && n == srv.closeAfter {
+			return
+		}
+
+		events, option := srv.decode(msg)
+		srv.mu.Lock()
+		srv.events = append(srv.events, events...)
+		srv.messages++
+		srv.mu.Unlock()
+		if chunk, ok := option["chunk"]; ok {
+			conn.Write(msgpackString(msgpackString(msgpackMapHeader(nil, 1), "ack"), chunk.(string)))
+		}
+		srv.got <- struct{}{}
+	}
+}
+
+// decode returns the events of a Message or PackedForward message.
+func (srv *fluentServer) decode(msg []interface{}) ([]fluentEvent, map[string]interface{}) {
+	tag := msg[0].(string)
+	var events []fluentEvent
+	var option map[string]interface{}
+	if packed, ok := msg[1].([]byte); ok {
+		r := bufio.NewReader(bytes.NewReader(packed))
+		for {
+			v, err := msgpackDecode(r)
+			if err != nil {
+				break
+			}
+			entry := v.([]interface{})
+			events = append(events, fluentEvent{tag, eventTime(entry[0]), entry[1].(map[string]interface{})})
+		}
+		if len(msg) > 2 {
+			option = msg[2].(map[string]interface{})
+			if size := option["size"]; size != int64(len(events)) {
+				srv.t.Errorf("wrong size option %v for %d events", size, len(events))
+			}
+		}
+	} else {
+		events = append(events, fluentEvent{tag, eventTime(msg[1]), msg[2].(map[string]interface{})})
+		if len(msg) > 3 {
+			option = msg[3].(map[string]interface{})
+		}
+	}
+	return events, option
+}
+
+func eventTime(v interface{}) time.Time {
+	ext := v.(msgpackExt)
+	return time.Unix(int64(binary.BigEndian.Uint32(ext.Data)), int64(binary.BigEndian.Uint32(ext.Data[4:])))
+}
+
+func (srv *fluentServer) wait(t *testing.T, messages int) []fluentEvent {
+	t.Helper()
+	for i := 0; i < messages; i++ {
+		select {
+		case <-srv.got:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d of %d messages", i, messages)
+		}
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.events
+}
+
+func TestFluentHandler(t *testing.T) {
+	t.Parallel()
+
+	srv := newFluentServer(t)
+	h := FluentHandler("tcp", srv.addr(), FluentOptions{Tag: "app", TagKey: "tag"})
+	defer h.Close()
+
+	at := time.Date(2026, 10, 17, 12, 0, 0, 123456789, time.UTC)
+	l := log.New()
+	l.SetHandler(log.FuncHandler(func(r *log.Record) error {
+		r.Time = at
+		return h.Log(r)
+	}))
+	l.Info("one", "n", 1, "neg", -300, "ratio", 0.5, "ok", true, "tag", "audit")
+	l.Warn("two", "lazy", log.Lazy{Fn: func() string { return "evaluated" }})
+
+	events := srv.wait(t, 2)
+	if events[0].tag != "audit" || events[1].tag != "app" {
+		t.Fatalf("wrong tags: %s %s", events[0].tag, events[1].tag)
+	}
+	if !events[0].time.Equal(at) {
+		t.Fatalf("wrong time: %v", events[0].time)
+	}
+	want := map[string]interface{}{"lvl": "info", "msg": "one", "n": int64(1), "neg": int64(-300), "ratio": 0.5, "ok": true}
+	if !reflect.DeepEqual(events[0].record, want) {
+		t.Fatalf("wrong record:\ngot:  %#v\nwant: %#v", events[0].record, want)
+	}
+	if events[1].record["lazy"] != "evaluated" {
+		t.Fatalf("lazy value not evaluated: %#v", events[1].record)
+	}
+}
+
+func TestFluentHandlerPacked(t *testing.T) {
+	t.Parallel()
+
+	srv := newFluentServer(t)
+	h := FluentHandler("tcp", srv.addr(), FluentOptions{TagKey: "tag", Packed: true, Ack: true})
+	l := log.New()
+	l.SetHandler(h)
+	l.Info("a1", "tag", "a")
+	l.Info("b1", "tag", "b")
+	l.Info("a2", "tag", "a")
+	l.Info("default")
+	h.Close()
+
+	events := srv.wait(t, 3)
+	var got []string
+	for _, e := range events {
+		got = append(got, e.tag+":"+e.record["msg"].(string))
+	}
+	if want := []string{"a:a1", "a:a2", "b:b1", "log15:default"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong events: %v, want %v", got, want)
+	}
+}
+
+func TestFluentHandlerReconnect(t *testing.T) {
+	t.Parallel()
+
+	srv := newFluentServer(t)
+	srv.closeAfter = 2
+	h := FluentHandler("tcp", srv.addr(), FluentOptions{Ack: true, AckTimeout: time.Second})
+	defer h.Close()
+
+	for _, msg := range []string{"one", "two", "three"} {
+		if err := h.Log(&log.Record{Msg: msg, KeyNames: log.RecordKeyNames{Msg: "msg", Lvl: "lvl"}}); err != nil {
+			t.Fatalf("%s: %v", msg, err)
+		}
+	}
+
+	// two is lost with the first connection and sent again on a new one
+	events := srv.wait(t, 3)
+	var got []string
+	for _, e := range events {
+		got = append(got, e.record["msg"].(string))
+	}
+	if want := []string{"one", "two", "three"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong events: %v, want %v", got, want)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.conns != 2 {
+		t.Fatalf("expected 2 connections, got %d", srv.conns)
+	}
+}
+
+func TestFluentHandlerBackoff(t *testing.T) {
+	t.Parallel()
+
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	l.Close()
+
+	h := FluentHandler("tcp", addr, FluentOptions{MinBackoff: time.Hour})
+	defer h.Close()
+	if err := h.Log(&log.Record{}); err == nil || err == ErrFluentBackoff {
+		t.Fatalf("expected a dial error, got %v", err)
+	}
+	if err := h.Log(&log.Record{}); err != ErrFluentBackoff {
+		t.Fatalf("expected ErrFluentBackoff, got %v", err)
+	}
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	var b []byte
+	values := []interface{}{
+		nil, true, int64(5), int64(-5), int64(-200), int64(-70000), int64(-5000000000),
+		uint64(200), uint64(70000), uint64(5000000000), 1.5,
+		"short", string(bytes.Repeat([]byte("x"), 300)), []byte{1, 2},
+	}
+	for _, v := range values {
+		switch v := v.(type) {
+		case nil:
+			b = msgpackNil(b)
+		case bool:
+			b = msgpackBool(b, v)
+		case int64:
+			b = msgpackInt(b, v)
+		case uint64:
+			b = msgpackUint(b, v)
+		case float64:
+			b = msgpackFloat(b, v)
+		case string:
+			b = msgpackString(b, v)
+		case []byte:
+			b = msgpackBin(b, v)
+		}
+	}
+
+	r := bufio.NewReader(bytes.NewReader(b))
+	for _, want := range values {
+		got, err := msgpackDecode(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u, ok := want.(uint64); ok && u < 1<<63 {
+			// small unsigned integers decode like signed ones
+			if got == int64(u) {
+				continue
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %#v, want %#v", got, want)
+		}
+	}
+}
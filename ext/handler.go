@@ -61,12 +61,16 @@ type Speculative struct {
 	recs    []*log.Record
 	handler log.Handler
 	full    bool
+	dropped uint64
 }
 
 // Log implements log15.Handler interface
 func (h *Speculative) Log(r *log.Record) error {
 	h.mu.Lock()
 	defer h.mu.Unlock()
+	if h.full {
+		h.dropped++
+	}
 	h.recs[h.idx] = r
 	h.idx = (h.idx + 1) % len(h.recs)
 	h.full = h.full || h.idx == 0
@@ -95,6 +99,14 @@ func (h *Speculative) Flush() {
 	}
 }
 
+// Dropped returns the number of records which were overwritten in the
+// ring buffer before being flushed.
+func (h *Speculative) Dropped() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.dropped
+}
+
 // HotSwapHandler wraps another handler that may swapped out
 // dynamically at runtime in a thread-safe fashion.
 // HotSwapHandler is the same functionality
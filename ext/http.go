@@ -0,0 +1,368 @@
+package ext
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// HTTPOptions configures the handlers which ship records to HTTP
+// endpoints. The zero value sends gzipped requests with http.DefaultClient
+// and retries them 3 times.
+type HTTPOptions struct {
+	// Header is added to every request, e.g. for an API key.
+	Header http.Header
+
+	// Username and Password set basic authentication, BearerToken sets a
+	// bearer token in the Authorization header.
+	Username    string
+	Password    string
+	BearerToken string
+
+	// Client sends the requests. Defaults to http.DefaultClient.
+	Client *http.Client
+
+	// DisableGzip sends uncompressed request bodies.
+	DisableGzip bool
+
+	// MaxRetries is the number of times a request is sent again after a
+	// network error or a response with status 429 or 5xx. Defaults to 3.
+	// The delay before a retry is the Retry-After of the response, if any,
+	// and an exponential backoff from MinBackoff to MaxBackoff otherwise.
+	// They default to 500ms and 30s, and MaxBackoff also caps Retry-After.
+	MaxRetries int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// MaxInFlightBytes caps the size of the records which have been
+	// logged but not sent yet. Records logged beyond it, or while a batch
+	// worth of records waits for a request to complete, are dropped
+	// instead of blocking the caller. Defaults to 16MB.
+	MaxInFlightBytes int
+
+	// JSONArray makes HTTPHandler send a JSON array of the formatted
+	// records instead of newline delimited records (NDJSON).
+	JSONArray bool
+
+	// Batch configures the batching of records. Its MaxAttempts is
+	// ignored, failed requests are retried according to MaxRetries.
+	Batch BatchOptions
+}
+
+func (o *HTTPOptions) setDefaults() {
+	if o.Client == nil {
+		o.Client = http.DefaultClient
+	}
+	if o.MaxRetries < 0 {
+		o.MaxRetries = 0
+	} else if o.MaxRetries == 0 {
+		o.MaxRetries = 3
+	}
+	if o.MinBackoff <= 0 {
+		o.MinBackoff = 500 * time.Millisecond
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = 30 * time.Second
+	}
+	if o.MaxBackoff < o.MinBackoff {
+		o.MaxBackoff = o.MinBackoff
+	}
+	if o.MaxInFlightBytes <= 0 {
+		o.MaxInFlightBytes = 16 << 20
+	}
+}
+
+// ErrInFlightLimit is returned for records which are dropped because
+// HTTPOptions.MaxInFlightBytes is reached.
+var ErrInFlightLimit = errors.New("log15: in-flight bytes limit reached")
+
+// HTTPStatusError is returned for a request which got a response with a
+// status other than 2xx.
+type HTTPStatusError struct {
+	StatusCode int
+	Status     string
+
+	// Body is the beginning of the response body, at most maxErrorBody
+	// bytes. Truncated is set if the body was longer.
+	Body      []byte
+	Truncated bool
+}
+
+// maxErrorBody limits the body kept in an HTTPStatusError.
+const maxErrorBody = 1 << 10
+
+func (e *HTTPStatusError) Error() string {
+	body := bytes.TrimSpace(e.Body)
+	if e.Truncated {
+		return fmt.Sprintf("log15: unexpected response %s: %s... (truncated)", e.Status, body)
+	}
+	return fmt.Sprintf("log15: unexpected response %s: %s", e.Status, body)
+}
+
+// HTTPHandler sends records in batches with POST requests to url. Each
+// record is formatted with fmtr, and the request body is the formatted
+// records one per line, or a JSON array of them with opts.JSONArray, which
+// requires fmtr to format records as JSON. If fmtr is nil, records are
+// formatted with JsonFormat. For example:
+//
+//	h := logext.HTTPHandler("https://logs.example.com/ingest", log.JsonFormat(),
+//	    logext.HTTPOptions{BearerToken: token})
+//	defer h.Close()
+//
+// Requests are sent from a separate goroutine and retried on network
+// errors and responses with status 429 or 5xx. Records of requests which
+// fail anyway are dropped. Close sends the remaining records.
+func HTTPHandler(url string, fmtr log.Format, opts HTTPOptions) *HTTP {
+	if fmtr == nil {
+		fmtr = log.JsonFormat()
+	}
+	fmtr = log.SafeFormat(fmtr)
+	format := func(r *log.Record) httpEntry {
+		return httpEntry{line: fmtr.Format(r)}
+	}
+	if opts.JSONArray {
+		return newHTTP(url, opts, format, encodeJSONArray)
+	}
+	return newHTTP(url, opts, format, encodeNDJSON)
+}
+
+// httpEntry is a record prepared for sending. stream groups records in the
+// request body, it's only used by some encodings.
+type httpEntry struct {
+	stream string
+	line   []byte
+}
+
+// httpEncoder encodes the request body for records and their entries.
+type httpEncoder func(records []*log.Record, entries []httpEntry) (contentType string, body []byte, err error)
+
+func newHTTP(url string, opts HTTPOptions, format func(r *log.Record) httpEntry, encode httpEncoder) *HTTP {
+	opts.setDefaults()
+	h := &HTTP{
+		url:    url,
+		format: format,
+		encode: encode,
+		client: &httpClient{opts},
+		opts:   opts,
+	}
+
+	batch := opts.Batch
+	batch.MaxAttempts = 1
+	batch.Size = h.size
+	h.batch = newBatch(h, batch, false)
+	h.handler = log.LazyHandler(log.FuncHandler(h.enqueue))
+	return h
+}
+
+// HTTP is the Log15.Handler. Read `HTTPHandler` for more information.
+type HTTP struct {
+	handler log.Handler
+	url     string
+	format  func(r *log.Record) httpEntry
+	encode  httpEncoder
+	client  *httpClient
+	opts    HTTPOptions
+	batch   *Batch
+
+	// entries holds the prepared records until they are sent
+	entries  sync.Map
+	inFlight atomic.Int64
+	dropped  atomic.Uint64
+}
+
+// Log implements log15.Handler interface.
+func (h *HTTP) Log(r *log.Record) error {
+	return h.handler.Log(r)
+}
+
+func (h *HTTP) enqueue(r *log.Record) error {
+	rc := r.Clone()
+	e := h.format(rc)
+
+	n := int64(len(e.line))
+	if h.inFlight.Add(n) > int64(h.opts.MaxInFlightBytes) {
+		h.inFlight.Add(-n)
+		h.dropped.Add(1)
+		return ErrInFlightLimit
+	}
+	h.entries.Store(rc, e)
+	if err := h.batch.push(rc); err != nil {
+		h.release(rc)
+		return err
+	}
+	return nil
+}
+
+func (h *HTTP) size(r *log.Record) int {
+	if e, ok := h.entries.Load(r); ok {
+		return len(e.(httpEntry).line)
+	}
+	return 0
+}
+
+// release forgets the prepared record r and returns its entry.
+func (h *HTTP) release(r *log.Record) httpEntry {
+	e, ok := h.entries.LoadAndDelete(r)
+	if !ok {
+		return httpEntry{}
+	}
+	h.inFlight.Add(-int64(len(e.(httpEntry).line)))
+	return e.(httpEntry)
+}
+
+// LogBatch implements BatchSink.
+func (h *HTTP) LogBatch(records []*log.Record) error {
+	entries := make([]httpEntry, len(records))
+	for i, r := range records {
+		entries[i] = h.release(r)
+	}
+	contentType, body, err := h.encode(records, entries)
+	if err != nil {
+		return err
+	}
+	_, err = h.client.post(h.url, contentType, body)
+	return err
+}
+
+func encodeNDJSON(records []*log.Record, entries []httpEntry) (string, []byte, error) {
+	var body bytes.Buffer
+	for _, e := range entries {
+		body.Write(e.line)
+		if len(e.line) > 0 && e.line[len(e.line)-1] != '\n' {
+			body.WriteByte('\n')
+		}
+	}
+	return "application/x-ndjson", body.Bytes(), nil
+}
+
+func encodeJSONArray(records []*log.Record, entries []httpEntry) (string, []byte, error) {
+	var body bytes.Buffer
+	body.WriteByte('[')
+	for i, e := range entries {
+		if i > 0 {
+			body.WriteByte(',')
+		}
+		body.Write(bytes.TrimRight(e.line, "\r\n"))
+	}
+	body.WriteByte(']')
+	return "application/json", body.Bytes(), nil
+}
+
+// Flush sends the records logged so far and returns when it is done.
+func (h *HTTP) Flush() {
+	h.batch.Flush()
+}
+
+// Dropped returns the number of records which were dropped because their
+// request failed or because of HTTPOptions.MaxInFlightBytes.
+func (h *HTTP) Dropped() uint64 {
+	return h.dropped.Load() + h.batch.Dropped()
+}
+
+// Close sends the remaining records and stops the handler.
+func (h *HTTP) Close() error {
+	return h.batch.Close()
+}
+
+// httpClient sends requests for the handlers shipping records over HTTP.
+type httpClient struct {
+	opts HTTPOptions
+}
+
+// post sends body to url, retrying on network errors and responses with
+// status 429 or 5xx. It returns the beginning of the response body.
+func (c *httpClient) post(url, contentType string, body []byte) ([]byte, error) {
+	gzipped := !c.opts.DisableGzip
+	if gzipped {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(body)
+		zw.Close()
+		body = buf.Bytes()
+	}
+
+	for retry := 0; ; retry++ {
+		respBody, wait, err := c.send(url, contentType, gzipped, body)
+		if err == nil {
+			return respBody, nil
+		}
+		var se *HTTPStatusError
+		if errors.As(err, &se) && se.StatusCode != http.StatusTooManyRequests && se.StatusCode < 500 {
+			return nil, err
+		}
+		if retry >= c.opts.MaxRetries {
+			return nil, err
+		}
+
+		if wait <= 0 {
+			wait = backoff(c.opts.MinBackoff, c.opts.MaxBackoff, retry+1)
+		} else if wait > c.opts.MaxBackoff {
+			wait = c.opts.MaxBackoff
+		}
+		time.Sleep(wait)
+	}
+}
+
+// send sends a single request. For an unsuccessful response, it also
+// returns the delay requested by its Retry-After header.
+func (c *httpClient) send(url, contentType string, gzipped bool, body []byte) ([]byte, time.Duration, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	for k, vs := range c.opts.Header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("Content-Type", contentType)
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if c.opts.Username != "" || c.opts.Password != "" {
+		req.SetBasicAuth(c.opts.Username, c.opts.Password)
+	}
+	if c.opts.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.opts.BearerToken)
+	}
+
+	resp, err := c.opts.Client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody+1))
+		se := &HTTPStatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: respBody}
+		if len(respBody) > maxErrorBody {
+			se.Body, se.Truncated = respBody[:maxErrorBody], true
+		}
+		return nil, retryAfter(resp.Header.Get("Retry-After")), se
+	}
+	// the records are delivered even if the response can't be read, and
+	// sending them again would duplicate them
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 32<<20))
+	return respBody, 0, nil
+}
+
+// retryAfter parses the value of a Retry-After header, which is either a
+// number of seconds or a date.
+func retryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
@@ -0,0 +1,327 @@
+package ext
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// httpRecorder is an HTTP server which keeps the decompressed bodies of
+// the requests it gets and answers with the given statuses in turn, then
+// with 200.
+type httpRecorder struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	bodies   []string
+	requests []*http.Request
+	statuses []int
+}
+
+func newHTTPRecorder(statuses ...int) *httpRecorder {
+	rec := &httpRecorder{statuses: statuses}
+	rec.Server = httptest.NewServer(http.HandlerFunc(rec.serve))
+	return rec
+}
+
+func (rec *httpRecorder) serve(w http.ResponseWriter, r *http.Request) {
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = zr
+	}
+	b, _ := io.ReadAll(body)
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.requests = append(rec.requests, r)
+	if len(rec.statuses) > 0 {
+		status := rec.statuses[0]
+		rec.statuses = rec.statuses[1:]
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "0")
+		}
+		w.WriteHeader(status)
+		return
+	}
+	rec.bodies = append(rec.bodies, string(b))
+}
+
+func (rec *httpRecorder) Bodies() []string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]string(nil), rec.bodies...)
+}
+
+func (rec *httpRecorder) Requests() []*http.Request {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]*http.Request(nil), rec.requests...)
+}
+
+func TestHTTPHandlerPanickingFormat(t *testing.T) {
+	t.Parallel()
+
+	srv := newHTTPRecorder()
+	defer srv.Close()
+
+	h := HTTPHandler(srv.URL, log.FormatFunc(func(r *log.Record) []byte {
+		panic("bad format")
+	}), HTTPOptions{DisableGzip: true})
+	if err := h.Log(&log.Record{Msg: "one"}); err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+
+	if bodies := srv.Bodies(); len(bodies) != 1 || !strings.Contains(bodies[0], "PANIC=bad format") {
+		t.Fatalf("expected the record with the panic, got %q", bodies)
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	t.Parallel()
+
+	srv := newHTTPRecorder()
+	defer srv.Close()
+
+	h := HTTPHandler(srv.URL, nil, HTTPOptions{
+		Header:      http.Header{"X-Api-Key": {"secret"}},
+		BearerToken: "token",
+	})
+	l := log.New("app", "test")
+	l.SetHandler(h)
+	l.Info("one", "n", 1)
+	l.Warn("two", "n", 2)
+	h.Close()
+
+	bodies := srv.Bodies()
+	if len(bodies) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(bodies))
+	}
+	var msgs []string
+	sc := bufio.NewScanner(strings.NewReader(bodies[0]))
+	for sc.Scan() {
+		var m map[string]interface{}
+		if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+			t.Fatalf("bad NDJSON line %q: %v", sc.Text(), err)
+		}
+		msgs = append(msgs, m["msg"].(string))
+	}
+	if strings.Join(msgs, ",") != "one,two" {
+		t.Fatalf("wrong records: %v", msgs)
+	}
+
+	req := srv.Requests()[0]
+	if req.Header.Get("Content-Type") != "application/x-ndjson" ||
+		req.Header.Get("Content-Encoding") != "gzip" ||
+		req.Header.Get("Authorization") != "Bearer token" ||
+		req.Header.Get("X-Api-Key") != "secret" {
+		t.Fatalf("wrong request headers: %v", req.Header)
+	}
+}
+
+func TestHTTPHandlerJSONArray(t *testing.T) {
+	t.Parallel()
+
+	srv := newHTTPRecorder()
+	defer srv.Close()
+
+	h := HTTPHandler(srv.URL, log.JsonFormat(), HTTPOptions{
+		JSONArray:   true,
+		DisableGzip: true,
+		Username:    "user",
+		Password:    "pass",
+	})
+	l := log.New()
+	l.SetHandler(h)
+	l.Info("one")
+	l.Info("two")
+	h.Close()
+
+	var records []map[string]interface{}
+	if err := json.Unmarshal([]byte(srv.Bodies()[0]), &records); err != nil {
+		t.Fatalf("bad JSON array: %v", err)
+	}
+	if len(records) != 2 || records[1]["msg"] != "two" {
+		t.Fatalf("wrong records: %v", records)
+	}
+
+	req := srv.Requests()[0]
+	if user, pass, _ := req.BasicAuth(); user != "user" || pass != "pass" {
+		t.Fatalf("wrong basic auth: %s:%s", user, pass)
+	}
+	if req.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("unexpected encoding: %s", req.Header.Get("Content-Encoding"))
+	}
+}
+
+func TestHTTPHandlerRetry(t *testing.T) {
+	t.Parallel()
+
+	srv := newHTTPRecorder(http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	defer srv.Close()
+
+	h := HTTPHandler(srv.URL, nil, HTTPOptions{MinBackoff: time.Millisecond})
+	h.Log(&log.Record{Msg: "retried"})
+	h.Close()
+
+	if n := len(srv.Requests()); n != 3 {
+		t.Fatalf("expected 3 requests, got %d", n)
+	}
+	if bodies := srv.Bodies(); len(bodies) != 1 || !strings.Contains(bodies[0], "retried") {
+		t.Fatalf("record not delivered: %v", bodies)
+	}
+	if h.Dropped() != 0 {
+		t.Fatalf("unexpected drops: %d", h.Dropped())
+	}
+
+	// client errors aren't retried
+	srv2 := newHTTPRecorder(http.StatusBadRequest)
+	defer srv2.Close()
+	var errs []error
+	h = HTTPHandler(srv2.URL, nil, HTTPOptions{
+		MinBackoff: time.Millisecond,
+		Batch:      BatchOptions{OnError: func(err error) { errs = append(errs, err) }},
+	})
+	h.Log(&log.Record{Msg: "rejected"})
+	h.Close()
+
+	if n := len(srv2.Requests()); n != 1 || h.Dropped() != 1 {
+		t.Fatalf("expected 1 request and 1 drop, got %d and %d", n, h.Dropped())
+	}
+	if se, ok := errs[0].(*HTTPStatusError); !ok || se.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status error, got %v", errs)
+	}
+}
+
+func TestHTTPHandlerDoesNotBlock(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	h := HTTPHandler(srv.URL, nil, HTTPOptions{
+		MaxRetries: 1,
+		MinBackoff: 200 * time.Millisecond,
+		Batch:      BatchOptions{MaxRecords: 2},
+	})
+	defer h.Close()
+
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		h.Log(&log.Record{Msg: "test"})
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("Log blocked for %v while the server was failing", d)
+	}
+	if h.Dropped() == 0 {
+		t.Fatalf("expected records to be dropped while the server was failing")
+	}
+}
+
+func TestHTTPHandlerUnreadableResponse(t *testing.T) {
+	t.Parallel()
+
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		// promise more than is sent so that reading the body fails
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	h := HTTPHandler(srv.URL, nil, HTTPOptions{MinBackoff: time.Millisecond})
+	h.Log(&log.Record{Msg: "test"})
+	h.Close()
+
+	if n := requests.Load(); n != 1 || h.Dropped() != 0 {
+		t.Fatalf("expected 1 request and no drops, got %d and %d", n, h.Dropped())
+	}
+}
+
+func TestHTTPStatusErrorTruncated(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(bytes.Repeat([]byte("x"), 1<<20))
+	}))
+	defer srv.Close()
+
+	c := &httpClient{HTTPOptions{}}
+	c.opts.setDefaults()
+	_, err := c.post(srv.URL, "text/plain", []byte("test"))
+	var se *HTTPStatusError
+	if !errors.As(err, &se) {
+		t.Fatalf("expected status error, got %v", err)
+	}
+	if len(se.Body) != maxErrorBody || !se.Truncated {
+		t.Fatalf("expected %d bytes of the body, got %d (truncated %v)", maxErrorBody, len(se.Body), se.Truncated)
+	}
+	if msg := err.Error(); len(msg) > 2*maxErrorBody || !strings.HasSuffix(msg, "... (truncated)") {
+		t.Fatalf("unexpected error message of %d bytes: %.100s", len(msg), msg)
+	}
+}
+
+func TestHTTPHandlerInFlightLimit(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+
+	h := HTTPHandler(srv.URL, log.LogfmtFormat(), HTTPOptions{
+		MaxInFlightBytes: 100,
+		Batch:            BatchOptions{MaxRecords: 1},
+	})
+
+	msg := strings.Repeat("x", 40)
+	var limited int
+	for i := 0; i < 5; i++ {
+		if h.Log(&log.Record{Msg: msg}) == ErrInFlightLimit {
+			limited++
+		}
+	}
+	close(release)
+	h.Close()
+
+	if limited == 0 || h.Dropped() != uint64(limited) {
+		t.Fatalf("expected records over the limit to be dropped, got %d limited and %d dropped", limited, h.Dropped())
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	if d := retryAfter("3"); d != 3*time.Second {
+		t.Fatalf("wrong delay for seconds: %v", d)
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if d := retryAfter(date); d < 58*time.Second || d > time.Minute {
+		t.Fatalf("wrong delay for date: %v", d)
+	}
+	if d := retryAfter("soon"); d != 0 {
+		t.Fatalf("wrong delay for garbage: %v", d)
+	}
+}
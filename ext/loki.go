@@ -0,0 +1,169 @@
+package ext
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// LokiOverflow is the label value which LokiHandler uses instead of the
+// values of a label beyond LokiOptions.MaxLabelValues.
+const LokiOverflow = "__overflow__"
+
+// LokiOptions configures a LokiHandler.
+type LokiOptions struct {
+	HTTPOptions
+
+	// Labels are added to every stream, e.g. {"job": "api"}.
+	Labels map[string]string
+
+	// LabelKeys are the context keys whose values become labels of the
+	// stream instead of being part of the line.
+	LabelKeys []string
+
+	// MaxLabelValues caps the number of distinct values of each label
+	// key. Further values keep the record in the line and set the label
+	// to LokiOverflow, so that a key with unbounded values doesn't make
+	// Loki create a stream per value. Defaults to 100.
+	MaxLabelValues int
+}
+
+// LokiHandler sends records in batches to the push API of Grafana Loki at
+// url, like "http://loki:3100/loki/api/v1/push", with its JSON encoding.
+// The stream of a record is labeled with opts.Labels, its level under
+// "level" and the context values of opts.LabelKeys. The rest of the
+// record is formatted with LogfmtFormat as the line. For example:
+//
+//	h := logext.LokiHandler("http://loki:3100/loki/api/v1/push", logext.LokiOptions{
+//	    Labels:    map[string]string{"job": "api"},
+//	    LabelKeys: []string{"component"},
+//	})
+//	defer h.Close()
+//
+// The records of a batch are grouped by stream in the request. Requests
+// are sent like by HTTPHandler.
+func LokiHandler(url string, opts LokiOptions) *HTTP {
+	if opts.MaxLabelValues <= 0 {
+		opts.MaxLabelValues = 100
+	}
+	l := &loki{
+		opts:   opts,
+		fmtr:   log.SafeFormat(log.LogfmtFormat()),
+		keys:   make(map[string]string, len(opts.LabelKeys)),
+		values: make(map[string]map[string]bool, len(opts.LabelKeys)),
+	}
+	for _, k := range opts.LabelKeys {
+		l.keys[k] = lokiLabelName(k)
+		l.values[k] = make(map[string]bool)
+	}
+	return newHTTP(url, opts.HTTPOptions, l.format, l.encode)
+}
+
+type loki struct {
+	opts LokiOptions
+	fmtr log.Format
+
+	// keys maps the label keys to valid label names
+	keys map[string]string
+
+	mu     sync.Mutex
+	values map[string]map[string]bool
+}
+
+// lokiLevels are the level names understood by Grafana.
+var lokiLevels = map[log.Lvl]string{
+	log.LvlCrit:  "critical",
+	log.LvlError: "error",
+	log.LvlWarn:  "warning",
+	log.LvlInfo:  "info",
+	log.LvlDebug: "debug",
+}
+
+// format takes the labels from r and formats the rest as the line. The
+// stream of the entry is the JSON encoding of the labels.
+func (l *loki) format(r *log.Record) httpEntry {
+	labels := make(map[string]string, len(l.opts.Labels)+len(l.keys)+1)
+	for k, v := range l.opts.Labels {
+		labels[k] = v
+	}
+	labels["level"] = lokiLevels[r.Lvl]
+
+	line := *r
+	line.Ctx = nil
+	for i := 0; i < len(r.Ctx); i += 2 {
+		k, ok := r.Ctx[i].(string)
+		name, promoted := l.keys[k]
+		if !ok || !promoted || i+1 >= len(r.Ctx) {
+			line.Ctx = append(line.Ctx, r.Ctx[i:min(i+2, len(r.Ctx))]...)
+			continue
+		}
+		v := fmt.Sprint(r.Ctx[i+1])
+		if l.admit(k, v) {
+			labels[name] = v
+		} else {
+			labels[name] = LokiOverflow
+			line.Ctx = append(line.Ctx, r.Ctx[i], r.Ctx[i+1])
+		}
+	}
+
+	stream, _ := json.Marshal(labels)
+	return httpEntry{
+		stream: string(stream),
+		line:   bytes.TrimSuffix(l.fmtr.Format(&line), []byte{'\n'}),
+	}
+}
+
+// admit reports whether v may be a value of the label k.
+func (l *loki) admit(k, v string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	values := l.values[k]
+	if values[v] {
+		return true
+	}
+	if len(values) >= l.opts.MaxLabelValues {
+		return false
+	}
+	values[v] = true
+	return true
+}
+
+type lokiStream struct {
+	Stream json.RawMessage `json:"stream"`
+	Values [][2]string     `json:"values"`
+}
+
+func (l *loki) encode(records []*log.Record, entries []httpEntry) (string, []byte, error) {
+	var streams []*lokiStream
+	byStream := make(map[string]*lokiStream)
+	for i, e := range entries {
+		s, ok := byStream[e.stream]
+		if !ok {
+			s = &lokiStream{Stream: json.RawMessage(e.stream)}
+			byStream[e.stream] = s
+			streams = append(streams, s)
+		}
+		ts := strconv.FormatInt(records[i].Time.UnixNano(), 10)
+		s.Values = append(s.Values, [2]string{ts, string(e.line)})
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"streams": streams})
+	return "application/json", body, err
+}
+
+// lokiLabelName replaces the characters which aren't valid in a label name
+// with underscores.
+func lokiLabelName(k string) string {
+	b := []byte(k)
+	for i, c := range b {
+		if c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || i > 0 && '0' <= c && c <= '9' {
+			continue
+		}
+		b[i] = '_'
+	}
+	return string(b)
+}
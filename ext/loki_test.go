@@ -0,0 +1,101 @@
+package ext
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+)
+
+type lokiPush struct {
+	Streams []struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	} `json:"streams"`
+}
+
+func TestLokiHandler(t *testing.T) {
+	t.Parallel()
+
+	srv := newHTTPRecorder()
+	defer srv.Close()
+
+	h := LokiHandler(srv.URL+"/loki/api/v1/push", LokiOptions{
+		Labels:    map[string]string{"job": "test"},
+		LabelKeys: []string{"component", "user-id"},
+	})
+	l := log.New()
+	l.SetHandler(h)
+	l.Info("started", "component", "db", "conns", 4)
+	l.Error("failed", "component", "db", "err", "timeout")
+	l.Info("login", "component", "auth", "user-id", 7)
+	h.Close()
+
+	var push lokiPush
+	if err := json.Unmarshal([]byte(srv.Bodies()[0]), &push); err != nil {
+		t.Fatalf("bad push body: %v", err)
+	}
+	if srv.Requests()[0].URL.Path != "/loki/api/v1/push" {
+		t.Fatalf("wrong path: %s", srv.Requests()[0].URL.Path)
+	}
+
+	var got []string
+	for _, s := range push.Streams {
+		got = append(got, s.Stream["job"]+"/"+s.Stream["level"]+"/"+s.Stream["component"]+"/"+s.Stream["user_id"])
+		for _, v := range s.Values {
+			if strings.Contains(v[1], "component=") || strings.Contains(v[1], "user-id=") {
+				t.Fatalf("label in line: %s", v[1])
+			}
+		}
+	}
+	want := "test/info/db/ test/error/db/ test/info/auth/7"
+	if strings.Join(got, " ") != want {
+		t.Fatalf("wrong streams:\ngot:  %s\nwant: %s", strings.Join(got, " "), want)
+	}
+
+	line := push.Streams[0].Values[0][1]
+	if !strings.Contains(line, `msg=started`) || !strings.Contains(line, "conns=4") || strings.HasSuffix(line, "\n") {
+		t.Fatalf("wrong line: %q", line)
+	}
+}
+
+func TestLokiHandlerGrouping(t *testing.T) {
+	t.Parallel()
+
+	srv := newHTTPRecorder()
+	defer srv.Close()
+
+	h := LokiHandler(srv.URL, LokiOptions{LabelKeys: []string{"req"}, MaxLabelValues: 2})
+	l := log.New()
+	l.SetHandler(h)
+	for _, req := range []string{"a", "b", "a", "c", "d"} {
+		l.Info("request", "req", req)
+	}
+	h.Close()
+
+	var push lokiPush
+	if err := json.Unmarshal([]byte(srv.Bodies()[0]), &push); err != nil {
+		t.Fatalf("bad push body: %v", err)
+	}
+	counts := make(map[string]int)
+	for _, s := range push.Streams {
+		counts[s.Stream["req"]] += len(s.Values)
+		if s.Stream["req"] == LokiOverflow && !strings.Contains(s.Values[0][1], "req=c") {
+			t.Fatalf("overflowed value missing from line: %s", s.Values[0][1])
+		}
+	}
+	if len(push.Streams) != 3 || counts["a"] != 2 || counts["b"] != 1 || counts[LokiOverflow] != 2 {
+		t.Fatalf("wrong streams: %v", counts)
+	}
+}
+
+func TestLokiLabelName(t *testing.T) {
+	t.Parallel()
+
+	for k, want := range map[string]string{"user-id": "user_id", "9lives": "_lives", "ok_1": "ok_1"} {
+		if got := lokiLabelName(k); got != want {
+			t.Fatalf("lokiLabelName(%q) = %q, want %q", k, got, want)
+		}
+	}
+}
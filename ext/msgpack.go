@@ -0,0 +1,285 @@
+package ext
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// The subset of MessagePack needed by the Fluentd forward protocol.
+
+func msgpackNil(b []byte) []byte {
+	return append(b, 0xc0)
+}
+
+func msgpackBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 0xc3)
+	}
+	return append(b, 0xc2)
+}
+
+func msgpackInt(b []byte, v int64) []byte {
+	switch {
+	case v >= 0:
+		return msgpackUint(b, uint64(v))
+	case v >= -32:
+		return append(b, byte(v))
+	case v >= math.MinInt8:
+		return append(b, 0xd0, byte(v))
+	case v >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(v))
+	case v >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(v))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(v))
+	}
+}
+
+func msgpackUint(b []byte, v uint64) []byte {
+	switch {
+	case v < 128:
+		return append(b, byte(v))
+	case v <= math.MaxUint8:
+		return append(b, 0xcc, byte(v))
+	case v <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xcd), uint16(v))
+	case v <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, 0xce), uint32(v))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, 0xcf), v)
+	}
+}
+
+func msgpackFloat(b []byte, v float64) []byte {
+	return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(v))
+}
+
+func msgpackString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, s...)
+}
+
+func msgpackBin(b []byte, v []byte) []byte {
+	switch n := len(v); {
+	case n <= math.MaxUint8:
+		b = append(b, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xc5), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xc6), uint32(n))
+	}
+	return append(b, v...)
+}
+
+func msgpackArrayHeader(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xdc), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, 0xdd), uint32(n))
+	}
+}
+
+func msgpackMapHeader(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xde), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, 0xdf), uint32(n))
+	}
+}
+
+// msgpackEventTime appends t as the EventTime extension of the forward
+// protocol, which keeps nanoseconds.
+func msgpackEventTime(b []byte, t time.Time) []byte {
+	b = append(b, 0xd7, 0x00)
+	b = binary.BigEndian.AppendUint32(b, uint32(t.Unix()))
+	return binary.BigEndian.AppendUint32(b, uint32(t.Nanosecond()))
+}
+
+// msgpackExt is a decoded extension value.
+type msgpackExt struct {
+	Type int8
+	Data []byte
+}
+
+var errMsgpackSize = errors.New("msgpack: value too large")
+
+// msgpackDecode reads a value. Maps decode as map[string]interface{},
+// arrays as []interface{}, integers as int64 or uint64 and binary data as
+// []byte.
+func msgpackDecode(r *bufio.Reader) (interface{}, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c < 0x80:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return msgpackDecodeMap(r, int(c&0x0f))
+	case c&0xf0 == 0x90:
+		return msgpackDecodeArray(r, int(c&0x0f))
+	case c&0xe0 == 0xa0:
+		b, err := msgpackRead(r, int(c&0x1f))
+		return string(b), err
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := msgpackLength(r, c-0xc4)
+		if err != nil {
+			return nil, err
+		}
+		return msgpackRead(r, n)
+	case 0xca:
+		b, err := msgpackRead(r, 4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+	case 0xcb:
+		b, err := msgpackRead(r, 8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		b, err := msgpackRead(r, 1<<(c-0xcc))
+		if err != nil {
+			return nil, err
+		}
+		return msgpackBigEndian(b), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		b, err := msgpackRead(r, size)
+		if err != nil {
+			return nil, err
+		}
+		// sign extend
+		shift := 64 - 8*size
+		return int64(msgpackBigEndian(b)<<shift) >> shift, nil
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return msgpackDecodeExt(r, 1<<(c-0xd4))
+	case 0xc7, 0xc8, 0xc9:
+		n, err := msgpackLength(r, c-0xc7)
+		if err != nil {
+			return nil, err
+		}
+		return msgpackDecodeExt(r, n)
+	case 0xd9, 0xda, 0xdb:
+		n, err := msgpackLength(r, c-0xd9)
+		if err != nil {
+			return nil, err
+		}
+		b, err := msgpackRead(r, n)
+		return string(b), err
+	case 0xdc, 0xdd:
+		n, err := msgpackLength(r, c-0xdc+1)
+		if err != nil {
+			return nil, err
+		}
+		return msgpackDecodeArray(r, n)
+	case 0xde, 0xdf:
+		n, err := msgpackLength(r, c-0xde+1)
+		if err != nil {
+			return nil, err
+		}
+		return msgpackDecodeMap(r, n)
+	}
+	return nil, fmt.Errorf("msgpack: unknown type 0x%02x", c)
+}
+
+// msgpackLength reads a length of 1, 2 or 4 bytes for i = 0, 1 or 2.
+func msgpackLength(r *bufio.Reader, i byte) (int, error) {
+	b, err := msgpackRead(r, 1<<i)
+	if err != nil {
+		return 0, err
+	}
+	n := msgpackBigEndian(b)
+	if n > 64<<20 {
+		return 0, errMsgpackSize
+	}
+	return int(n), nil
+}
+
+func msgpackBigEndian(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func msgpackRead(r *bufio.Reader, n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+func msgpackDecodeExt(r *bufio.Reader, n int) (interface{}, error) {
+	b, err := msgpackRead(r, n+1)
+	if err != nil {
+		return nil, err
+	}
+	return msgpackExt{int8(b[0]), b[1:]}, nil
+}
+
+func msgpackDecodeArray(r *bufio.Reader, n int) (interface{}, error) {
+	a := make([]interface{}, 0, min(n, 1024))
+	for i := 0; i < n; i++ {
+		v, err := msgpackDecode(r)
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, v)
+	}
+	return a, nil
+}
+
+func msgpackDecodeMap(r *bufio.Reader, n int) (interface{}, error) {
+	m := make(map[string]interface{}, min(n, 1024))
+	for i := 0; i < n; i++ {
+		k, err := msgpackDecode(r)
+		if err != nil {
+			return nil, err
+		}
+		v, err := msgpackDecode(r)
+		if err != nil {
+			return nil, err
+		}
+		m[fmt.Sprint(k)] = v
+	}
+	return m, nil
+}
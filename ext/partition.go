@@ -0,0 +1,388 @@
+package ext
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// PartitionOptions configures a PartitionedFileHandler. The zero value
+// keeps up to 64 files open, closes the ones idle for 5 minutes and never
+// rotates.
+type PartitionOptions struct {
+	// MaxOpen is the number of files kept open. When another file is
+	// needed, the least recently used one is closed. Defaults to 64.
+	MaxOpen int
+
+	// IdleTimeout is the time after which an unused file is closed.
+	// Defaults to 5 minutes.
+	IdleTimeout time.Duration
+
+	// Missing replaces the values of the keys which a record doesn't
+	// have, or which are empty. It must start with a letter, a digit or
+	// one of "-_+@". Defaults to "unknown".
+	Missing string
+
+	// MaxSize, if set, is the size at which the file of a partition is
+	// rotated: path is renamed to path.1, path.1 to path.2 and so on,
+	// keeping MaxBackups files, 3 by default.
+	MaxSize    int64
+	MaxBackups int
+}
+
+// ErrPartitionClosed is returned for the records logged to a
+// PartitionedFileHandler after Close.
+var ErrPartitionClosed = errors.New("log15: partitioned file handler is closed")
+
+// maxPathComponent limits the length of a value in a path.
+const maxPathComponent = 128
+
+// PartitionedFileHandler writes each record with fmtr to a file whose path
+// is given by template, in which each {key} is replaced by the value of
+// key in the context of the record. For example, to keep the records of
+// each tenant in a separate file:
+//
+//	h, err := logext.PartitionedFileHandler("/var/log/app/{tenant}.log", log.LogfmtFormat(),
+//	    logext.PartitionOptions{MaxSize: 100 << 20})
+//	if err != nil { ... }
+//	defer h.Close()
+//	log.Root().SetHandler(h)
+//	log.Info("signed up", "tenant", "acme")  // written to /var/log/app/acme.log
+//
+// Values are escaped so that they can't escape their path component and
+// different values never share a file: characters other than letters,
+// digits, '-', '_', '.', '+' and '@', and a leading '.', are
+// percent-encoded, like "acme/x" to "acme%2Fx". Missing values are
+// replaced by opts.Missing, and a value equal to opts.Missing has its
+// first character percent-encoded too, like "%75nknown", so that it
+// doesn't share their file.
+//
+// Files are opened for appending when they are first needed, creating
+// their directories, and all of them share fmtr and the rotation settings
+// of opts.
+func PartitionedFileHandler(template string, fmtr log.Format, opts PartitionOptions) (*PartitionedFile, error) {
+	parts, err := parsePathTemplate(template)
+	if err != nil {
+		return nil, err
+	}
+	if opts.MaxOpen <= 0 {
+		opts.MaxOpen = 64
+	}
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = 5 * time.Minute
+	}
+	if opts.Missing == "" {
+		opts.Missing = "unknown"
+	}
+	if c, _ := utf8.DecodeRuneInString(opts.Missing); !isPathRune(c) {
+		return nil, fmt.Errorf("log15: PartitionOptions.Missing %q must start with a letter, a digit or one of \"-_+@\"", opts.Missing)
+	}
+	if opts.MaxBackups <= 0 {
+		opts.MaxBackups = 3
+	}
+
+	p := &PartitionedFile{
+		parts: parts,
+		fmtr:  log.SafeFormat(fmtr),
+		opts:  opts,
+		files: make(map[string]*list.Element),
+		lru:   list.New(),
+		done:  make(chan struct{}),
+	}
+	p.handler = log.LazyHandler(log.FuncHandler(p.log))
+	go p.closeIdle()
+	return p, nil
+}
+
+// PartitionedFile is the Log15.Handler. Read `PartitionedFileHandler` for
+// more information.
+type PartitionedFile struct {
+	handler log.Handler
+	parts   []pathPart
+	fmtr    log.Format
+	opts    PartitionOptions
+
+	mu     sync.Mutex
+	files  map[string]*list.Element // of *partitionFile
+	lru    *list.List               // most recently used first
+	closed bool
+	done   chan struct{}
+}
+
+type partitionFile struct {
+	path     string
+	f        *os.File
+	size     int64
+	lastUsed time.Time
+}
+
+// pathPart is a literal part of a path template, or a key if key is set.
+type pathPart struct {
+	lit string
+	key string
+}
+
+func parsePathTemplate(template string) ([]pathPart, error) {
+	var parts []pathPart
+	for s := template; s != ""; {
+		i := strings.IndexAny(s, "{}")
+		if i < 0 {
+			parts = append(parts, pathPart{lit: s})
+			break
+		}
+		if s[i] == '}' {
+			return nil, fmt.Errorf("log15: unexpected } in path template %q", template)
+		}
+		if i > 0 {
+			parts = append(parts, pathPart{lit: s[:i]})
+		}
+		end := strings.IndexAny(s[i+1:], "{}")
+		if end < 0 || s[i+1+end] != '}' {
+			return nil, fmt.Errorf("log15: unclosed { in path template %q", template)
+		}
+		key := s[i+1 : i+1+end]
+		if key == "" {
+			return nil, fmt.Errorf("log15: empty key in path template %q", template)
+		}
+		parts = append(parts, pathPart{key: key})
+		s = s[i+end+2:]
+	}
+	if len(parts) == 0 {
+		return nil, errors.New("log15: empty path template")
+	}
+	return parts, nil
+}
+
+// path returns the path of the file of r.
+func (p *PartitionedFile) path(r *log.Record) string {
+	var b strings.Builder
+	for _, part := range p.parts {
+		if part.key == "" {
+			b.WriteString(part.lit)
+			continue
+		}
+		v := ""
+		// the last value of a key is the one of the innermost context
+		for i := len(r.Ctx) - 2; i >= 0; i -= 2 {
+			if r.Ctx[i] == part.key {
+				v = fmt.Sprint(r.Ctx[i+1])
+				if v == p.opts.Missing {
+					v = escapeMissing(v)
+				} else {
+					v = escapePathComponent(v)
+				}
+				break
+			}
+		}
+		if v == "" {
+			v = escapePathComponent(p.opts.Missing)
+		}
+		b.WriteString(v)
+	}
+	return b.String()
+}
+
+// escapePathComponent escapes s so that it can't change the meaning of a
+// path, and so that different values give different components. Letters,
+// digits and "-_.+@" are kept, except a leading dot, and other bytes are
+// percent-encoded. Values longer than maxPathComponent are cut and end
+// with '~' and a hash of the whole value.
+func escapePathComponent(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		c, size := utf8.DecodeRuneInString(s[i:])
+		if isPathRune(c) || c == '.' && i > 0 {
+			b.WriteString(s[i : i+size])
+		} else {
+			for _, x := range []byte(s[i : i+size]) {
+				fmt.Fprintf(&b, "%%%02X", x)
+			}
+		}
+		i += size
+	}
+	escaped := b.String()
+	if len(escaped) <= maxPathComponent {
+		return escaped
+	}
+	sum := sha256.Sum256([]byte(s))
+	cut := strings.ToValidUTF8(escaped[:maxPathComponent-17], "")
+	// don't cut an escape in half
+	if i := strings.LastIndexByte(cut, '%'); i >= len(cut)-2 {
+		cut = cut[:i]
+	}
+	return cut + "~" + hex.EncodeToString(sum[:8])
+}
+
+// isPathRune reports whether escapePathComponent keeps c anywhere in a
+// value.
+func isPathRune(c rune) bool {
+	return c != utf8.RuneError && (unicode.IsLetter(c) || unicode.IsDigit(c) ||
+		strings.ContainsRune("-_+@", c))
+}
+
+// escapeMissing escapes a value equal to PartitionOptions.Missing like
+// escapePathComponent, but percent-encodes its first character too. That
+// character is kept by escapePathComponent, so no other value is escaped
+// the same way.
+func escapeMissing(s string) string {
+	_, size := utf8.DecodeRuneInString(s)
+	var b strings.Builder
+	for _, x := range []byte(s[:size]) {
+		fmt.Fprintf(&b, "%%%02X", x)
+	}
+	b.WriteString(escapePathComponent(s)[size:])
+	return b.String()
+}
+
+// Log implements log15.Handler interface.
+func (p *PartitionedFile) Log(r *log.Record) error {
+	return p.handler.Log(r)
+}
+
+func (p *PartitionedFile) log(r *log.Record) error {
+	path := p.path(r)
+	line := p.fmtr.Format(r)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrPartitionClosed
+	}
+	pf, err := p.file(path)
+	if err != nil {
+		return err
+	}
+	var rotateErr error
+	if p.opts.MaxSize > 0 && pf.size > 0 && pf.size+int64(len(line)) > p.opts.MaxSize {
+		if rotateErr = p.rotate(pf); p.files[path] == nil {
+			return rotateErr
+		}
+	}
+	n, err := pf.f.Write(line)
+	pf.size += int64(n)
+	if err != nil {
+		p.closeFile(p.files[path])
+		return err
+	}
+	return rotateErr
+}
+
+// file returns the open file at path, opening it if needed. It's called
+// with the lock held.
+func (p *PartitionedFile) file(path string) (*partitionFile, error) {
+	if e, ok := p.files[path]; ok {
+		p.lru.MoveToFront(e)
+		pf := e.Value.(*partitionFile)
+		pf.lastUsed = time.Now()
+		return pf, nil
+	}
+
+	for p.lru.Len() >= p.opts.MaxOpen {
+		p.closeFile(p.lru.Back())
+	}
+	f, err := openAppend(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	pf := &partitionFile{path: path, f: f, size: info.Size(), lastUsed: time.Now()}
+	p.files[path] = p.lru.PushFront(pf)
+	return pf, nil
+}
+
+func openAppend(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+}
+
+// rotate moves the file of pf to its first backup and opens a new one. If
+// the file can't be moved, it's kept open and the error is returned.
+func (p *PartitionedFile) rotate(pf *partitionFile) error {
+	pf.f.Close()
+	for i := p.opts.MaxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", pf.path, i), fmt.Sprintf("%s.%d", pf.path, i+1))
+	}
+	renameErr := os.Rename(pf.path, pf.path+".1")
+
+	f, err := openAppend(pf.path)
+	if err != nil {
+		p.lru.Remove(p.files[pf.path])
+		delete(p.files, pf.path)
+		return err
+	}
+	pf.f = f
+	// if the file couldn't be moved, it grows for another MaxSize before
+	// the next attempt rather than being rotated on every record
+	pf.size = 0
+	return renameErr
+}
+
+// closeFile closes the file of e. It's called with the lock held.
+func (p *PartitionedFile) closeFile(e *list.Element) {
+	pf := p.lru.Remove(e).(*partitionFile)
+	delete(p.files, pf.path)
+	pf.f.Close()
+}
+
+// closeIdle periodically closes the files unused for opts.IdleTimeout.
+func (p *PartitionedFile) closeIdle() {
+	ticker := time.NewTicker(max(p.opts.IdleTimeout/4, time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+		p.mu.Lock()
+		// the least recently used files are the idle ones
+		for e := p.lru.Back(); e != nil && time.Since(e.Value.(*partitionFile).lastUsed) >= p.opts.IdleTimeout; e = p.lru.Back() {
+			p.closeFile(e)
+		}
+		p.mu.Unlock()
+	}
+}
+
+// OpenFiles returns the number of files which are open.
+func (p *PartitionedFile) OpenFiles() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lru.Len()
+}
+
+// Close closes all files.
+func (p *PartitionedFile) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	close(p.done)
+	var err error
+	for e := p.lru.Front(); e != nil; e = e.Next() {
+		if cerr := e.Value.(*partitionFile).f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	p.files = nil
+	p.lru.Init()
+	return err
+}
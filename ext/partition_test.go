@@ -0,0 +1,219 @@
+package ext
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestPartitionedFileHandler(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	h, err := PartitionedFileHandler(filepath.Join(dir, "{tenant}", "{service}.log"),
+		log.LogfmtFormat(), PartitionOptions{MaxOpen: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	l := log.New("service", "api")
+	l.SetHandler(h)
+
+	l.Info("a1", "tenant", "acme")
+	l.Info("b1", "tenant", "bolt")
+	l.Info("c1", "tenant", "core", "service", "web")
+	if n := h.OpenFiles(); n != 2 {
+		t.Fatalf("expected 2 open files, got %d", n)
+	}
+	// reopened after it was evicted
+	l.Info("a2", "tenant", "acme")
+	l.Info("x1")
+	l.Info("x2", "tenant", "unknown")
+	l.Info("dots", "tenant", "..", "service", "web")
+	l.Info("evil", "tenant", "../..", "service", "a/../../b")
+
+	for path, msgs := range map[string][]string{
+		"acme/api.log":                  {"a1", "a2"},
+		"bolt/api.log":                  {"b1"},
+		"core/web.log":                  {"c1"},
+		"unknown/api.log":               {"x1"},
+		"%75nknown/api.log":             {"x2"},
+		"%2E.%2F../a%2F..%2F..%2Fb.log": {"evil"},
+	} {
+		data := readFile(t, filepath.Join(dir, path))
+		lines := strings.Split(strings.TrimSuffix(data, "\n"), "\n")
+		if len(lines) != len(msgs) {
+			t.Fatalf("%s: expected %v, got %q", path, msgs, data)
+		}
+		for i, msg := range msgs {
+			if !strings.Contains(lines[i], "msg="+msg) {
+				t.Fatalf("%s: expected %v, got %q", path, msgs, data)
+			}
+		}
+	}
+
+	h.Close()
+	if err := h.Log(&log.Record{Msg: "late"}); err != ErrPartitionClosed {
+		t.Fatalf("expected ErrPartitionClosed, got %v", err)
+	}
+}
+
+func TestPartitionedFileHandlerIdle(t *testing.T) {
+	t.Parallel()
+
+	h, err := PartitionedFileHandler(filepath.Join(t.TempDir(), "{tenant}.log"),
+		log.LogfmtFormat(), PartitionOptions{IdleTimeout: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	l := log.New()
+	l.SetHandler(h)
+	l.Info("hi", "tenant", "acme")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for h.OpenFiles() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle file wasn't closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPartitionedFileHandlerRotate(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	h, err := PartitionedFileHandler(filepath.Join(dir, "{tenant}.log"),
+		log.FormatFunc(func(r *log.Record) []byte { return []byte(r.Msg + "\n") }),
+		PartitionOptions{MaxSize: 10, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	l := log.New("tenant", "acme")
+	l.SetHandler(h)
+	for _, msg := range []string{"0000", "1111", "2222", "3333", "4444", "5555", "6666"} {
+		l.Info(msg)
+	}
+	l.Info("other", "tenant", "bolt")
+
+	base := filepath.Join(dir, "acme.log")
+	for path, want := range map[string]string{
+		base:        "6666\n",
+		base + ".1": "4444\n5555\n",
+		base + ".2": "2222\n3333\n",
+	} {
+		if got := readFile(t, path); got != want {
+			t.Fatalf("%s: expected %q, got %q", path, want, got)
+		}
+	}
+	if _, err := os.Stat(base + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected only 2 backups, got %v", err)
+	}
+	if got := readFile(t, filepath.Join(dir, "bolt.log")); got != "other\n" {
+		t.Fatalf("unexpected partition %q", got)
+	}
+}
+
+func TestPartitionedFileHandlerRotateFailure(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	base := filepath.Join(dir, "acme.log")
+	// the backup can't replace a directory
+	if err := os.MkdirAll(filepath.Join(base+".1", "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	h, err := PartitionedFileHandler(filepath.Join(dir, "{tenant}.log"),
+		log.FormatFunc(func(r *log.Record) []byte { return []byte(r.Msg + "\n") }),
+		PartitionOptions{MaxSize: 10, MaxBackups: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	var failed int
+	for _, msg := range []string{"0000", "1111", "2222", "3333", "4444", "5555", "6666"} {
+		if h.Log(&log.Record{Msg: msg, Ctx: []interface{}{"tenant", "acme"}}) != nil {
+			failed++
+		}
+	}
+	// a rotation is attempted again only after another MaxSize
+	if failed != 3 {
+		t.Fatalf("expected 3 failed rotations, got %d", failed)
+	}
+	if got := readFile(t, base); got != "0000\n1111\n2222\n3333\n4444\n5555\n6666\n" {
+		t.Fatalf("records were lost: %q", got)
+	}
+}
+
+func TestEscapePathComponent(t *testing.T) {
+	seen := make(map[string]string)
+	long := strings.Repeat("x", 200)
+	for _, v := range []string{
+		"acme/x", "acme_x", "acme%2Fx", "a b", "a_b", "...", "___", ".hidden", "_hidden",
+		"..", "%2E.", "é", "\xff", long, long + "y", "naïve@example.com",
+	} {
+		e := escapePathComponent(v)
+		if prev, ok := seen[e]; ok {
+			t.Errorf("%q and %q both escape to %q", prev, v, e)
+		}
+		seen[e] = v
+		if strings.ContainsAny(e, "/\\") || strings.HasPrefix(e, ".") || len(e) > maxPathComponent {
+			t.Errorf("%q: unsafe path component %q", v, e)
+		}
+	}
+	for v, want := range map[string]string{
+		"acme":              "acme",
+		"acme/x":            "acme%2Fx",
+		"100%":              "100%25",
+		"..":                "%2E.",
+		"naïve@example.com": "naïve@example.com",
+	} {
+		if got := escapePathComponent(v); got != want {
+			t.Errorf("%q: expected %q, got %q", v, want, got)
+		}
+	}
+}
+
+func TestEscapeMissing(t *testing.T) {
+	long := strings.Repeat("x", 200)
+	for _, v := range []string{"unknown", "é", long} {
+		e := escapeMissing(v)
+		if e == escapePathComponent(v) || strings.ContainsAny(e, "/\\") {
+			t.Errorf("%q: unexpected escape %q", v, e)
+		}
+	}
+	if got := escapeMissing("unknown"); got != "%75nknown" {
+		t.Errorf("expected %%75nknown, got %q", got)
+	}
+	if _, err := PartitionedFileHandler("/tmp/{tenant}.log", log.LogfmtFormat(), PartitionOptions{Missing: ".none"}); err == nil {
+		t.Errorf("expected an error for Missing starting with a dot")
+	}
+}
+
+func TestParsePathTemplate(t *testing.T) {
+	for _, bad := range []string{"", "/{tenant", "/tenant}.log", "/{}.log", "/{a{b}}"} {
+		if _, err := parsePathTemplate(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+	parts, err := parsePathTemplate("/var/log/{tenant}-{day}.log")
+	if err != nil || len(parts) != 5 || parts[1].key != "tenant" || parts[3].key != "day" || parts[4].lit != ".log" {
+		t.Fatalf("unexpected parts %+v %v", parts, err)
+	}
+}
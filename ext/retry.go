@@ -0,0 +1,193 @@
+package ext
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// RetryOptions configures a RetryHandler. The zero value retries timeouts
+// up to 3 attempts with a backoff from 100ms to 10s in the caller's
+// goroutine.
+type RetryOptions struct {
+	// MaxAttempts is the number of times a record is passed to the
+	// wrapped handler, including the first attempt. Defaults to 3.
+	MaxAttempts int
+
+	// MinBackoff is the delay before the first retry. It doubles with
+	// every further retry up to MaxBackoff. Defaults to 100ms and 10s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Retryable decides which errors are worth retrying. Defaults to
+	// IsTimeout.
+	Retryable func(err error) bool
+
+	// Background makes Log return after the first attempt and retry
+	// failed records in a separate goroutine. Up to QueueSize records,
+	// 1000 by default, wait to be retried; more failed records are
+	// dropped.
+	Background bool
+	QueueSize  int
+}
+
+// IsTimeout reports whether err is a timeout of a network operation, or
+// of a handler of a ParallelMultiHandler.
+func IsTimeout(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	return errors.Is(err, log.ErrHandlerTimeout)
+}
+
+// RetryHandler wraps a handler which fails transiently, like a NetHandler
+// or a SyslogHandler, and passes a record to it again when it returns an
+// error which opts.Retryable accepts. Between attempts, it waits for an
+// exponential backoff with jitter. For example:
+//
+//	h := logext.RetryHandler(log.Must.NetHandler("tcp", ":9090", log.JsonFormat()),
+//	    logext.RetryOptions{MaxAttempts: 5, Background: true})
+//	defer h.Close()
+//
+// Without opts.Background, Log blocks until the record is written or the
+// attempts are exhausted and returns the last error. With it, Log only
+// blocks for the first attempt and Close waits for the pending retries.
+func RetryHandler(h log.Handler, opts RetryOptions) *Retry {
+	if opts.MaxAttempts < 1 {
+		opts.MaxAttempts = 3
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 100 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 10 * time.Second
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = opts.MinBackoff
+	}
+	if opts.Retryable == nil {
+		opts.Retryable = IsTimeout
+	}
+
+	rh := &Retry{handler: h, opts: opts}
+	if opts.Background {
+		if opts.QueueSize <= 0 {
+			opts.QueueSize = 1000
+		}
+		rh.queue = make(chan retryItem, opts.QueueSize)
+		rh.done = make(chan struct{})
+		go rh.loop()
+	}
+	return rh
+}
+
+// Retry is the Log15.Handler. Read `RetryHandler` for more information.
+type Retry struct {
+	handler log.Handler
+	opts    RetryOptions
+	dropped atomic.Uint64
+
+	// set in background mode
+	mu     sync.RWMutex
+	closed bool
+	queue  chan retryItem
+	done   chan struct{}
+}
+
+type retryItem struct {
+	r   *log.Record
+	err error
+}
+
+// Log implements log15.Handler interface.
+func (h *Retry) Log(r *log.Record) error {
+	err := h.handler.Log(r)
+	if err == nil || h.opts.MaxAttempts == 1 || !h.opts.Retryable(err) {
+		return err
+	}
+
+	if h.queue == nil {
+		if err = h.retry(r, err); err != nil {
+			h.dropped.Add(1)
+		}
+		return err
+	}
+
+	rc := r.Clone()
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if !h.closed {
+		select {
+		case h.queue <- retryItem{rc, err}:
+			return nil
+		default:
+		}
+	}
+	h.dropped.Add(1)
+	return err
+}
+
+// retry passes r to the wrapped handler until it succeeds, fails with an
+// error which isn't retryable or the attempts are exhausted.
+func (h *Retry) retry(r *log.Record, err error) error {
+	for attempt := 1; attempt < h.opts.MaxAttempts; attempt++ {
+		time.Sleep(backoff(h.opts.MinBackoff, h.opts.MaxBackoff, attempt))
+		if err = h.handler.Log(r); err == nil || !h.opts.Retryable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// backoff returns the delay before the given retry, counting from 1, for
+// an exponential backoff from min to max. It is chosen at random from the
+// upper half of the exponential backoff so that many failing loggers don't
+// retry in lockstep.
+func backoff(min, max time.Duration, retry int) time.Duration {
+	d := max
+	if retry < 32 {
+		if exp := min << (retry - 1); exp > 0 && exp < d {
+			d = exp
+		}
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+func (h *Retry) loop() {
+	defer close(h.done)
+	for item := range h.queue {
+		if h.retry(item.r, item.err) != nil {
+			h.dropped.Add(1)
+		}
+	}
+}
+
+// Dropped returns the number of records which were given up on, either
+// because all attempts failed or, in background mode, because the queue
+// was full or the handler closed.
+func (h *Retry) Dropped() uint64 {
+	return h.dropped.Load()
+}
+
+// Close waits for the pending retries in background mode. Records which
+// fail after Close aren't retried. It does nothing otherwise.
+func (h *Retry) Close() error {
+	if h.queue == nil {
+		return nil
+	}
+	h.mu.Lock()
+	if !h.closed {
+		h.closed = true
+		close(h.queue)
+	}
+	h.mu.Unlock()
+	<-h.done
+	return nil
+}
@@ -0,0 +1,513 @@
+package ext
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/inconshreveable/log15/receiver"
+)
+
+// SpoolOptions configures a SpoolHandler. The zero value keeps up to
+// 256MB of records in segments of 8MB.
+type SpoolOptions struct {
+	// MaxSize limits the size of the spooled records on disk. Records
+	// which don't fit are dropped. Defaults to 256MB.
+	MaxSize int64
+
+	// MaxSegmentSize is the size at which a new segment file is started.
+	// Segments are removed once their records are replayed. Defaults to
+	// 8MB.
+	MaxSegmentSize int64
+
+	// MinBackoff and MaxBackoff bound the exponential backoff between
+	// the attempts to replay a record, 100ms and 30s by default.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Sync makes the handler sync the segments and the replay position
+	// to disk after each write, so that records survive a crash of the
+	// machine and not only of the process.
+	Sync bool
+}
+
+// ErrSpoolFull is returned for records which are dropped because the
+// spool has reached its MaxSize.
+var ErrSpoolFull = errors.New("log15: spool is full")
+
+const (
+	spoolSegmentExt = ".seg"
+	spoolAckFile    = "ack"
+)
+
+// SpoolHandler wraps a handler which may be unavailable for long, like a
+// NetHandler or an HTTPHandler, and writes the records it fails to an
+// append-only queue of segment files in dir. A goroutine replays them in
+// order once the handler recovers, for example:
+//
+//	h, err := logext.SpoolHandler("/var/spool/app", log.Must.NetHandler("tcp", "collector:7000", log.JsonFormat()),
+//	    logext.SpoolOptions{MaxSize: 1 << 30})
+//	if err != nil { ... }
+//	defer h.Close()
+//
+// While records are spooled, the records logged after them are spooled
+// too, so that the wrapped handler gets all records in order. Log returns
+// nil for spooled records and ErrSpoolFull for records which exceed
+// opts.MaxSize.
+//
+// The position of the replay is kept in dir as well: records which remain
+// when the process exits are replayed when the handler is created again
+// with the same dir, and the ones the wrapped handler accepted aren't
+// replayed twice. Delivery is at least once though: the position is saved
+// after the wrapped handler accepts a record, so a record is replayed
+// again if the process dies in between. Only one handler may use dir at a
+// time. Spooled records are encoded in receiver.BinaryFormat, so that the
+// replayed records have the default key names and no call site.
+func SpoolHandler(dir string, h log.Handler, opts SpoolOptions) (*Spool, error) {
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = 256 << 20
+	}
+	if opts.MaxSegmentSize <= 0 {
+		opts.MaxSegmentSize = 8 << 20
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 100 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 30 * time.Second
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = opts.MinBackoff
+	}
+
+	s := &Spool{
+		h:       h,
+		dir:     dir,
+		opts:    opts,
+		format:  receiver.BinaryFormat(),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	s.handler = log.LazyHandler(log.FuncHandler(s.log))
+	go s.replay()
+	return s, nil
+}
+
+// Spool is the Log15.Handler. Read `SpoolHandler` for more information.
+type Spool struct {
+	handler log.Handler
+	h       log.Handler
+	dir     string
+	opts    SpoolOptions
+	format  log.Format
+	dropped atomic.Uint64
+
+	mu      sync.Mutex
+	segs    []spoolSegment // oldest first
+	nextID  uint64
+	w       *os.File // the last segment
+	ack     *os.File
+	readOff int64 // replay position in segs[0]
+	size    int64 // size of segs
+	closed  bool
+
+	wake    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+type spoolSegment struct {
+	id   uint64
+	size int64
+}
+
+func (s *Spool) segmentPath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%016x%s", id, spoolSegmentExt))
+}
+
+// open loads the segments and the replay position left in the directory.
+func (s *Spool) open() error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	var err error
+	if s.ack, err = os.OpenFile(filepath.Join(s.dir, spoolAckFile), os.O_RDWR|os.O_CREATE, 0644); err != nil {
+		return err
+	}
+	var ack [16]byte
+	ackID, ackOff := uint64(0), int64(0)
+	if _, err := s.ack.ReadAt(ack[:], 0); err == nil {
+		ackID = binary.BigEndian.Uint64(ack[:8])
+		ackOff = int64(binary.BigEndian.Uint64(ack[8:]))
+	}
+	s.nextID = ackID + 1
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		s.ack.Close()
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, spoolSegmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentExt), 16, 64)
+		if err != nil {
+			continue
+		}
+		if id < ackID {
+			// replayed before the ack was moved on
+			os.Remove(filepath.Join(s.dir, name))
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			s.ack.Close()
+			return err
+		}
+		s.segs = append(s.segs, spoolSegment{id, info.Size()})
+		s.size += info.Size()
+		s.nextID = max(s.nextID, id+1)
+	}
+	sort.Slice(s.segs, func(i, j int) bool { return s.segs[i].id < s.segs[j].id })
+	if len(s.segs) == 0 {
+		return nil
+	}
+
+	// the last segment may end with a partial record if the process
+	// died while writing it
+	last := &s.segs[len(s.segs)-1]
+	if s.w, err = os.OpenFile(s.segmentPath(last.id), os.O_RDWR, 0644); err != nil {
+		s.ack.Close()
+		return err
+	}
+	end := spoolValidEnd(s.w, last.size)
+	if end < last.size {
+		if err := s.w.Truncate(end); err != nil {
+			s.w.Close()
+			s.ack.Close()
+			return err
+		}
+		s.size -= last.size - end
+		last.size = end
+	}
+	if s.segs[0].id == ackID {
+		s.readOff = min(ackOff, s.segs[0].size)
+	}
+	if _, err := s.w.Seek(end, io.SeekStart); err != nil {
+		s.w.Close()
+		s.ack.Close()
+		return err
+	}
+	return nil
+}
+
+// spoolValidEnd returns the end of the last complete frame in f.
+func spoolValidEnd(f *os.File, size int64) int64 {
+	var off int64
+	var hdr [4]byte
+	for off+4 <= size {
+		if _, err := f.ReadAt(hdr[:], off); err != nil {
+			break
+		}
+		n := int64(binary.BigEndian.Uint32(hdr[:]))
+		if off+4+n > size {
+			break
+		}
+		off += 4 + n
+	}
+	return off
+}
+
+// pending reports whether there are spooled records to replay.
+func (s *Spool) pending() bool {
+	switch len(s.segs) {
+	case 0:
+		return false
+	case 1:
+		return s.readOff < s.segs[0].size
+	default:
+		return true
+	}
+}
+
+// Log implements log15.Handler interface.
+func (s *Spool) Log(r *log.Record) error {
+	return s.handler.Log(r)
+}
+
+func (s *Spool) log(r *log.Record) error {
+	s.mu.Lock()
+	direct := !s.closed && !s.pending()
+	s.mu.Unlock()
+	// the wrapped handler is called without the lock, so that a slow
+	// handler doesn't hold up the other callers
+	if direct && s.h.Log(r) == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.spool(r)
+}
+
+// spool appends r to the last segment.
+func (s *Spool) spool(r *log.Record) error {
+	if s.closed {
+		return errors.New("log15: spool is closed")
+	}
+	frame := s.format.Format(r)
+	// the replayed records of segs[0] are still on disk, but they don't
+	// count towards MaxSize
+	if s.size-s.readOff+int64(len(frame)) > s.opts.MaxSize {
+		s.dropped.Add(1)
+		return ErrSpoolFull
+	}
+
+	if s.w == nil || len(s.segs) > 0 && s.segs[len(s.segs)-1].size > 0 &&
+		s.segs[len(s.segs)-1].size+int64(len(frame)) > s.opts.MaxSegmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.w.Write(frame)
+	last := &s.segs[len(s.segs)-1]
+	last.size += int64(n)
+	s.size += int64(n)
+	if err != nil {
+		// drop the partial record so that the segment stays readable
+		if terr := s.w.Truncate(last.size - int64(n)); terr == nil {
+			s.w.Seek(last.size-int64(n), io.SeekStart)
+			last.size -= int64(n)
+			s.size -= int64(n)
+		}
+		return err
+	}
+	if s.opts.Sync {
+		s.w.Sync()
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// rotate starts a new segment.
+func (s *Spool) rotate() error {
+	f, err := os.OpenFile(s.segmentPath(s.nextID), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if s.w != nil {
+		s.w.Close()
+	}
+	s.w = f
+	s.segs = append(s.segs, spoolSegment{id: s.nextID})
+	s.nextID++
+	if s.opts.Sync {
+		if d, err := os.Open(s.dir); err == nil {
+			d.Sync()
+			d.Close()
+		}
+	}
+	return nil
+}
+
+// replay passes the spooled records to the wrapped handler in order.
+func (s *Spool) replay() {
+	defer close(s.stopped)
+	var rf *os.File
+	defer func() {
+		if rf != nil {
+			rf.Close()
+		}
+	}()
+
+	failures := 0
+	for {
+		s.mu.Lock()
+		if !s.pending() {
+			s.reset()
+			s.mu.Unlock()
+			select {
+			case <-s.wake:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		seg, off := s.segs[0], s.readOff
+		if off >= seg.size {
+			// the segment is replayed
+			os.Remove(s.segmentPath(seg.id))
+			s.size -= seg.size
+			s.segs = s.segs[1:]
+			s.readOff = 0
+			s.writeAck()
+			s.mu.Unlock()
+			if rf != nil {
+				rf.Close()
+				rf = nil
+			}
+			continue
+		}
+		s.mu.Unlock()
+
+		if rf == nil || rf.Name() != s.segmentPath(seg.id) {
+			if rf != nil {
+				rf.Close()
+			}
+			var err error
+			if rf, err = os.Open(s.segmentPath(seg.id)); err != nil {
+				rf = nil
+				s.skip(seg, seg.size)
+				continue
+			}
+		}
+		r, next, err := s.readRecord(rf, off, seg.size)
+		if err != nil {
+			// a record which can't be decoded is dropped with the rest
+			// of its segment if its length can't be trusted
+			s.dropped.Add(1)
+			s.skip(seg, next)
+			continue
+		}
+
+		if err := s.h.Log(r); err != nil {
+			failures++
+			select {
+			case <-time.After(backoff(s.opts.MinBackoff, s.opts.MaxBackoff, failures)):
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		failures = 0
+		s.skip(seg, next)
+	}
+}
+
+// reset removes the last segment once all records are replayed. It's
+// called with the lock held.
+func (s *Spool) reset() {
+	if len(s.segs) == 0 {
+		return
+	}
+	if s.w != nil {
+		s.w.Close()
+		s.w = nil
+	}
+	os.Remove(s.segmentPath(s.segs[0].id))
+	s.segs = nil
+	s.size = 0
+	s.readOff = 0
+}
+
+// skip moves the replay position in seg to off.
+func (s *Spool) skip(seg spoolSegment, off int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.segs) > 0 && s.segs[0].id == seg.id {
+		s.readOff = off
+		s.writeAck()
+	}
+}
+
+// writeAck saves the replay position. It's called with the lock held.
+func (s *Spool) writeAck() {
+	var ack [16]byte
+	if len(s.segs) > 0 {
+		binary.BigEndian.PutUint64(ack[:8], s.segs[0].id)
+	} else {
+		binary.BigEndian.PutUint64(ack[:8], s.nextID)
+	}
+	binary.BigEndian.PutUint64(ack[8:], uint64(s.readOff))
+	s.ack.WriteAt(ack[:], 0)
+	if s.opts.Sync {
+		s.ack.Sync()
+	}
+}
+
+// readRecord decodes the record at off in f and returns it with the offset
+// of the next record.
+func (s *Spool) readRecord(f *os.File, off, size int64) (*log.Record, int64, error) {
+	var hdr [4]byte
+	if _, err := f.ReadAt(hdr[:], off); err != nil {
+		return nil, size, err
+	}
+	next := off + 4 + int64(binary.BigEndian.Uint32(hdr[:]))
+	if next > size {
+		return nil, size, io.ErrUnexpectedEOF
+	}
+	frame := make([]byte, next-off)
+	if _, err := f.ReadAt(frame, off); err != nil {
+		return nil, size, err
+	}
+	dec, err := receiver.NewDecoder(receiver.FormatBinary, bytes.NewReader(frame), receiver.DefaultKeyNames)
+	if err != nil {
+		return nil, size, err
+	}
+	r, err := dec.Decode()
+	return r, next, err
+}
+
+// Size returns the size of the records on disk which are waiting to be
+// replayed.
+func (s *Spool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.pending() {
+		return 0
+	}
+	return s.size - s.readOff
+}
+
+// Dropped returns the number of records dropped because the spool was
+// full or couldn't be read.
+func (s *Spool) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close stops the replay and closes the files. The records which remain
+// are replayed by the next handler created with the same directory.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+	close(s.done)
+	<-s.stopped
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	if s.w != nil {
+		err = s.w.Close()
+		s.w = nil
+	}
+	if cerr := s.ack.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,287 @@
+package ext
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/inconshreveable/log15/receiver"
+)
+
+// flakyHandler keeps the messages of the records it accepts and fails
+// while it's down.
+type flakyHandler struct {
+	mu   sync.Mutex
+	down bool
+	msgs []string
+}
+
+func (h *flakyHandler) Log(r *log.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.down {
+		return errors.New("down")
+	}
+	h.msgs = append(h.msgs, r.Msg)
+	return nil
+}
+
+func (h *flakyHandler) setDown(down bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.down = down
+}
+
+func (h *flakyHandler) Msgs() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.msgs...)
+}
+
+func (h *flakyHandler) wait(t *testing.T, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		msgs := h.Msgs()
+		if len(msgs) >= n {
+			return msgs
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d records, got %v", n, msgs)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+var spoolTestOptions = SpoolOptions{MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+
+func expectMsgs(t *testing.T, got []string, from, to int) {
+	t.Helper()
+	if len(got) != to-from {
+		t.Fatalf("expected records %d to %d, got %v", from, to, got)
+	}
+	for i, msg := range got {
+		if want := fmt.Sprint(from + i); msg != want {
+			t.Fatalf("expected record %s at %d, got %v", want, i, got)
+		}
+	}
+}
+
+func TestSpoolHandler(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	fh := &flakyHandler{}
+	h, err := SpoolHandler(dir, fh, spoolTestOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	l := log.New()
+	l.SetHandler(h)
+
+	l.Info("0")
+	fh.setDown(true)
+	for i := 1; i < 5; i++ {
+		l.Info(fmt.Sprint(i))
+	}
+	if h.Size() == 0 {
+		t.Fatal("expected spooled records")
+	}
+	fh.setDown(false)
+	// logged after the spooled records
+	l.Info("5")
+
+	expectMsgs(t, fh.wait(t, 6), 0, 6)
+	deadline := time.Now().Add(5 * time.Second)
+	for h.Size() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("spool wasn't emptied, size %d", h.Size())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the emptied segment is removed and records go straight through
+	l.Info("6")
+	expectMsgs(t, fh.Msgs(), 0, 7)
+	if segs, _ := filepath.Glob(filepath.Join(dir, "*.seg")); len(segs) != 0 {
+		t.Fatalf("expected no segments, got %v", segs)
+	}
+}
+
+func TestSpoolHandlerRestart(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	fh := &flakyHandler{down: true}
+	h, err := SpoolHandler(dir, fh, spoolTestOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := log.New()
+	l.SetHandler(h)
+	for i := 0; i < 5; i++ {
+		l.Info(fmt.Sprint(i))
+	}
+	h.Close()
+
+	// a handler which accepts the first 2 records, then goes down
+	fh = &flakyHandler{}
+	partial := log.FuncHandler(func(r *log.Record) error {
+		if len(fh.Msgs()) == 2 {
+			fh.setDown(true)
+		}
+		return fh.Log(r)
+	})
+	if h, err = SpoolHandler(dir, partial, spoolTestOptions); err != nil {
+		t.Fatal(err)
+	}
+	expectMsgs(t, fh.wait(t, 2), 0, 2)
+	h.Close()
+
+	fh = &flakyHandler{}
+	if h, err = SpoolHandler(dir, fh, spoolTestOptions); err != nil {
+		t.Fatal(err)
+	}
+	expectMsgs(t, fh.wait(t, 3), 2, 5)
+	h.Close()
+
+	fh = &flakyHandler{}
+	if h, err = SpoolHandler(dir, fh, spoolTestOptions); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	h.Close()
+	if msgs := fh.Msgs(); len(msgs) != 0 {
+		t.Fatalf("acknowledged records were replayed again: %v", msgs)
+	}
+}
+
+func TestSpoolHandlerLimits(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	fh := &flakyHandler{down: true}
+	h, err := SpoolHandler(dir, fh, SpoolOptions{
+		MaxSize:        200,
+		MaxSegmentSize: 50,
+		MinBackoff:     time.Millisecond,
+		MaxBackoff:     5 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	var full int
+	for i := 0; i < 20; i++ {
+		if err := h.Log(&log.Record{Time: time.Now(), Lvl: log.LvlInfo, Msg: fmt.Sprint(i)}); err == ErrSpoolFull {
+			full++
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if full == 0 || h.Dropped() != uint64(full) {
+		t.Fatalf("expected dropped records, got %d full and %d dropped", full, h.Dropped())
+	}
+	if h.Size() > 200 {
+		t.Fatalf("spool exceeds its size: %d", h.Size())
+	}
+	if segs, _ := filepath.Glob(filepath.Join(dir, "*.seg")); len(segs) < 2 {
+		t.Fatalf("expected several segments, got %v", segs)
+	}
+
+	fh.setDown(false)
+	expectMsgs(t, fh.wait(t, 20-full), 0, 20-full)
+}
+
+func TestSpoolHandlerLimitsReplayed(t *testing.T) {
+	t.Parallel()
+
+	// accepts nothing while down and then everything but record 2
+	var down atomic.Bool
+	down.Store(true)
+	fh := log.FuncHandler(func(r *log.Record) error {
+		if down.Load() || r.Msg == "2" {
+			return errors.New("down")
+		}
+		return nil
+	})
+	rec := func(msg string) *log.Record {
+		return &log.Record{Time: time.Unix(0, 0), Lvl: log.LvlInfo, Msg: msg}
+	}
+	frame := int64(len(receiver.BinaryFormat().Format(rec("0"))))
+	h, err := SpoolHandler(t.TempDir(), fh, SpoolOptions{
+		MaxSize:    3 * frame,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 5 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	for _, msg := range []string{"0", "1", "2"} {
+		if err := h.Log(rec(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	down.Store(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for h.Size() > frame {
+		if time.Now().After(deadline) {
+			t.Fatalf("records weren't replayed, %d bytes left", h.Size())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// the replayed records are still in the segment, but the spool has
+	// room for another one
+	if err := h.Log(rec("3")); err != nil {
+		t.Fatalf("expected record 3 to be spooled, got %v", err)
+	}
+}
+
+func TestSpoolHandlerTornWrite(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	h, err := SpoolHandler(dir, &flakyHandler{down: true}, spoolTestOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := log.New()
+	l.SetHandler(h)
+	l.Info("0")
+	l.Info("1")
+	h.Close()
+
+	// a record cut short by a crash
+	segs, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if len(segs) != 1 {
+		t.Fatalf("expected one segment, got %v", segs)
+	}
+	f, err := os.OpenFile(segs[0], os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 1, 0, 'x'})
+	f.Close()
+
+	fh := &flakyHandler{}
+	if h, err = SpoolHandler(dir, fh, spoolTestOptions); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	l.SetHandler(h)
+	l.Info("2")
+	expectMsgs(t, fh.wait(t, 3), 0, 3)
+	if h.Dropped() != 0 {
+		t.Fatalf("unexpected dropped records: %d", h.Dropped())
+	}
+}
@@ -4,7 +4,6 @@ go 1.24.0
 
 require (
 	github.com/go-stack/stack v1.8.1
+	golang.org/x/sys v0.41.0
 	golang.org/x/term v0.40.0
 )
-
-require golang.org/x/sys v0.41.0 // indirect
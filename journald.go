@@ -0,0 +1,204 @@
+//go:build linux
+// +build linux
+
+package log15
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// JournaldSocket is the path of the socket on which systemd-journald
+// accepts the native journal protocol.
+const JournaldSocket = "/run/systemd/journal/socket"
+
+// JournaldHandler writes records to systemd-journald over its native
+// protocol, so that they keep their structure in the journal. The level of
+// a record is its PRIORITY, the message its MESSAGE and tag its
+// SYSLOG_IDENTIFIER. Each context key becomes a journal field of the same
+// name in upper case, with the characters which aren't allowed in field
+// names replaced by underscores:
+//
+//	log.Info("request done", "path", "/", "user-id", 7)
+//	// MESSAGE=request done PRIORITY=6 PATH=/ USER_ID=7
+//
+// The call site of the record is written as CODE_FILE, CODE_LINE and
+// CODE_FUNC. Context keys which would map to these fields, or to another
+// field which journald sets itself or reads as the origin of an entry like
+// SYSLOG_PID or UNIT, are prefixed with X_, e.g. "message" becomes
+// X_MESSAGE. Records too large for a datagram are passed to journald in
+// a sealed memfd.
+func JournaldHandler(tag string) (Handler, error) {
+	return JournaldSocketHandler(JournaldSocket, tag)
+}
+
+// JournaldSocketHandler is like JournaldHandler but writes to the journal
+// socket at path.
+func JournaldSocketHandler(path, tag string) (Handler, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	addr := &net.UnixAddr{Name: path, Net: "unixgram"}
+	CaptureCallers()
+
+	h := FuncHandler(func(r *Record) error {
+		return journalSend(conn, addr, journalEntry(r, tag))
+	})
+	return &closingHandler{conn, LazyHandler(h)}, nil
+}
+
+// journalPriorities maps levels to syslog priorities.
+var journalPriorities = map[Lvl]int{
+	LvlCrit:  2,
+	LvlError: 3,
+	LvlWarn:  4,
+	LvlInfo:  6,
+	LvlDebug: 7,
+}
+
+// journalEntry encodes r in the native journal protocol.
+func journalEntry(r *Record, tag string) []byte {
+	var buf bytes.Buffer
+	journalField(&buf, "MESSAGE", r.Msg)
+	journalField(&buf, "PRIORITY", strconv.Itoa(journalPriorities[r.Lvl]))
+	if tag != "" {
+		journalField(&buf, "SYSLOG_IDENTIFIER", tag)
+	}
+	if r.Call.Frame().PC != 0 {
+		journalField(&buf, "CODE_FILE", fmt.Sprintf("%+s", r.Call))
+		journalField(&buf, "CODE_LINE", fmt.Sprintf("%d", r.Call))
+		journalField(&buf, "CODE_FUNC", fmt.Sprintf("%+n", r.Call))
+	}
+
+	for i := 0; i < len(r.Ctx); i += 2 {
+		k, ok := r.Ctx[i].(string)
+		if !ok {
+			k = fmt.Sprintf("%+v", r.Ctx[i])
+		}
+		name := journalFieldName(k)
+		if name == "" {
+			continue
+		}
+		var v interface{} = "nil"
+		if i+1 < len(r.Ctx) {
+			v = r.Ctx[i+1]
+		}
+		journalField(&buf, name, journalValue(v))
+	}
+	return buf.Bytes()
+}
+
+// journalField appends a field to buf. Values with newlines are written
+// with their length as binary data.
+func journalField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// journalReserved are the fields which context keys must not set.
+var journalReserved = map[string]bool{
+	"MESSAGE":            true,
+	"PRIORITY":           true,
+	"SYSLOG_IDENTIFIER":  true,
+	"SYSLOG_FACILITY":    true,
+	"SYSLOG_PID":         true,
+	"SYSLOG_TIMESTAMP":   true,
+	"SYSLOG_RAW":         true,
+	"CODE_FILE":          true,
+	"CODE_LINE":          true,
+	"CODE_FUNC":          true,
+	"TID":                true,
+	"UNIT":               true,
+	"USER_UNIT":          true,
+	"INVOCATION_ID":      true,
+	"USER_INVOCATION_ID": true,
+}
+
+// journalFieldName converts a context key to a journal field name, which
+// consists of up to 64 upper case letters, digits and underscores and
+// doesn't start with an underscore or a digit. Reserved fields are
+// prefixed with X_.
+func journalFieldName(k string) string {
+	b := []byte(strings.ToUpper(k))
+	for i, c := range b {
+		if !('A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_') {
+			b[i] = '_'
+		}
+	}
+	name := strings.TrimLeft(string(b), "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' || journalReserved[name] {
+		name = "X_" + name
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+func journalValue(value interface{}) string {
+	if value == nil {
+		return "nil"
+	}
+	switch v := formatShared(value).(type) {
+	case string:
+		return v
+	case float32:
+		return strconv.FormatFloat(float64(v), floatFormat, -1, 64)
+	case float64:
+		return strconv.FormatFloat(v, floatFormat, -1, 64)
+	default:
+		return fmt.Sprintf("%+v", v)
+	}
+}
+
+// journalSend writes entry to the journal socket at addr. If the entry
+// doesn't fit in a datagram, it is written to a sealed memfd whose file
+// descriptor is passed to journald instead.
+func journalSend(conn *net.UnixConn, addr *net.UnixAddr, entry []byte) error {
+	_, _, err := conn.WriteMsgUnix(entry, nil, addr)
+	if err == nil || !errors.Is(err, syscall.EMSGSIZE) && !errors.Is(err, syscall.ENOBUFS) {
+		return err
+	}
+
+	fd, err := unix.MemfdCreate("log15-journal", unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), "log15-journal")
+	defer f.Close()
+	if _, err := f.Write(entry); err != nil {
+		return err
+	}
+	seals := unix.F_SEAL_SHRINK | unix.F_SEAL_GROW | unix.F_SEAL_WRITE | unix.F_SEAL_SEAL
+	if _, err := unix.FcntlInt(uintptr(fd), unix.F_ADD_SEALS, seals); err != nil {
+		return err
+	}
+	_, _, err = conn.WriteMsgUnix(nil, unix.UnixRights(fd), addr)
+	return err
+}
+
+func (m muster) JournaldHandler(tag string) Handler {
+	return must(JournaldHandler(tag))
+}
@@ -0,0 +1,181 @@
+//go:build linux
+// +build linux
+
+package log15
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// journalServer is a stand-in for journald bound in a temporary directory.
+func journalServer(t *testing.T) (string, *net.UnixConn) {
+	path := filepath.Join(t.TempDir(), "journal.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return path, conn
+}
+
+// readJournalEntry receives an entry and decodes its fields, reading it
+// from the passed file descriptor if there is one.
+func readJournalEntry(t *testing.T, conn *net.UnixConn) map[string]string {
+	buf := make([]byte, 1<<16)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf[:n]
+
+	if oobn > 0 {
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			t.Fatal(err)
+		}
+		fds, err := syscall.ParseUnixRights(&msgs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := os.NewFile(uintptr(fds[0]), "memfd")
+		defer f.Close()
+		// the offset is shared with the sender, read from the start
+		// like journald does
+		data, err = io.ReadAll(io.NewSectionReader(f, 0, 1<<30))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fields := make(map[string]string)
+	for len(data) > 0 {
+		i := bytes.IndexAny(data, "=\n")
+		if i < 0 {
+			t.Fatalf("bad entry: %q", data)
+		}
+		name := string(data[:i])
+		if data[i] == '=' {
+			end := bytes.IndexByte(data, '\n')
+			fields[name] = string(data[i+1 : end])
+			data = data[end+1:]
+			continue
+		}
+		size := binary.LittleEndian.Uint64(data[i+1:])
+		fields[name] = string(data[i+9 : i+9+int(size)])
+		data = data[i+9+int(size)+1:]
+	}
+	return fields
+}
+
+func TestJournaldHandler(t *testing.T) {
+	t.Parallel()
+
+	path, srv := journalServer(t)
+	h, err := JournaldSocketHandler(path, "myapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := New("user-id", 7)
+	l.SetHandler(CallerFuncHandler(h))
+	l.Warn("disk\nfull", "mount point", "/var", "_private", true, "2fa", "on", "err", errors.New("ENOSPC"))
+
+	fields := readJournalEntry(t, srv)
+	want := map[string]string{
+		"MESSAGE":           "disk\nfull",
+		"PRIORITY":          "4",
+		"SYSLOG_IDENTIFIER": "myapp",
+		"USER_ID":           "7",
+		"MOUNT_POINT":       "/var",
+		"PRIVATE":           "true",
+		"X_2FA":             "on",
+		"ERR":               "ENOSPC",
+		"CODE_FUNC":         "github.com/inconshreveable/log15.TestJournaldHandler",
+	}
+	for k, v := range want {
+		if fields[k] != v {
+			t.Errorf("field %s: got %q, want %q", k, fields[k], v)
+		}
+	}
+	if !strings.HasSuffix(fields["CODE_FILE"], "journald_test.go") || fields["CODE_LINE"] == "" {
+		t.Errorf("wrong call site: %s:%s", fields["CODE_FILE"], fields["CODE_LINE"])
+	}
+}
+
+func TestJournaldHandlerReservedFields(t *testing.T) {
+	t.Parallel()
+
+	path, srv := journalServer(t)
+	h, err := JournaldSocketHandler(path, "myapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := New()
+	l.SetHandler(CallerFuncHandler(h))
+	l.Info("real", "message", "fake", "priority", 0, "syslog_identifier", "other",
+		"code_line", 1, "syslog-pid", 1, "message_id", "abc")
+
+	fields := readJournalEntry(t, srv)
+	want := map[string]string{
+		"MESSAGE":             "real",
+		"PRIORITY":            "6",
+		"SYSLOG_IDENTIFIER":   "myapp",
+		"X_MESSAGE":           "fake",
+		"X_PRIORITY":          "0",
+		"X_SYSLOG_IDENTIFIER": "other",
+		"X_CODE_LINE":         "1",
+		"X_SYSLOG_PID":        "1",
+		"MESSAGE_ID":          "abc",
+	}
+	for k, v := range want {
+		if fields[k] != v {
+			t.Errorf("field %s: got %q, want %q", k, fields[k], v)
+		}
+	}
+	if fields["CODE_LINE"] == "1" || fields["SYSLOG_PID"] != "" {
+		t.Errorf("context overrode the entry: %v", fields)
+	}
+}
+
+func TestJournaldHandlerLarge(t *testing.T) {
+	t.Parallel()
+
+	path, srv := journalServer(t)
+	h, err := JournaldSocketHandler(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	big := strings.Repeat("x", 4<<20)
+	done := make(chan map[string]string)
+	go func() { done <- readJournalEntry(t, srv) }()
+	if err := h.Log(&Record{Msg: "big", Lvl: LvlInfo, Ctx: []interface{}{"payload", big}}); err != nil {
+		t.Fatal(err)
+	}
+
+	fields := <-done
+	if fields["MESSAGE"] != "big" || fields["PAYLOAD"] != big {
+		t.Fatalf("wrong large entry: MESSAGE=%q, len(PAYLOAD)=%d", fields["MESSAGE"], len(fields["PAYLOAD"]))
+	}
+}
+
+func TestJournaldHandlerNoSocket(t *testing.T) {
+	t.Parallel()
+
+	if _, err := JournaldSocketHandler(filepath.Join(t.TempDir(), "missing"), ""); err == nil {
+		t.Fatal("expected an error for a missing socket")
+	}
+}
@@ -6,11 +6,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -83,6 +86,12 @@ func TestCtx(t *testing.T) {
 	if len(r.Ctx) != 6 {
 		t.Fatalf("Expecting Ctx tansformed into %d ctx args, got %d: %v", 6, len(r.Ctx), r.Ctx)
 	}
+
+	for i, k := range []string{"tester", "x", "y"} {
+		if r.Ctx[2*i] != k {
+			t.Fatalf("Expecting Ctx expanded in key order, got %v", r.Ctx)
+		}
+	}
 }
 
 func testFormatter(f Format) (Logger, *bytes.Buffer) {
@@ -188,6 +197,169 @@ func TestMultiHandler(t *testing.T) {
 
 }
 
+func TestMultiHandlerErrors(t *testing.T) {
+	t.Parallel()
+
+	h, r := testHandler()
+	fail := FuncHandler(func(r *Record) error {
+		return errors.New("fail")
+	})
+	l := New()
+	l.SetHandler(MultiHandler(fail, h, fail))
+
+	err := l.GetHandler().Log(&Record{Msg: "test"})
+	if err == nil || err.Error() != "handler 0: fail\nhandler 2: fail" {
+		t.Fatalf("expected joined child errors, got %v", err)
+	}
+	if r.Msg != "test" {
+		t.Fatalf("expected handler after a failing one to be written to")
+	}
+}
+
+func TestMultiHandlerCopiesRecord(t *testing.T) {
+	t.Parallel()
+
+	h, r := testHandler()
+	l := New()
+	l.SetHandler(MultiHandler(CallerFileHandler(DiscardHandler()), h))
+	l.Info("test", "x", 1)
+
+	if len(r.Ctx) != 2 {
+		t.Fatalf("expected handlers not to see each other's ctx, got %v", r.Ctx)
+	}
+}
+
+func TestParallelMultiHandler(t *testing.T) {
+	t.Parallel()
+
+	h, r := testHandler()
+	block := make(chan struct{})
+	defer close(block)
+	slow := FuncHandler(func(r *Record) error {
+		<-block
+		return nil
+	})
+
+	l := New()
+	l.SetHandler(ParallelMultiHandler(10*time.Millisecond, slow, h))
+
+	err := l.GetHandler().Log(&Record{Msg: "test"})
+	if !errors.Is(err, ErrHandlerTimeout) {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+	if r.Msg != "test" {
+		t.Fatalf("expected fast handler to be written to")
+	}
+}
+
+func TestParallelMultiHandlerHungHandler(t *testing.T) {
+	h, _ := testHandler()
+	block := make(chan struct{})
+	defer close(block)
+	hung := FuncHandler(func(r *Record) error {
+		<-block
+		return nil
+	})
+	pm := ParallelMultiHandler(time.Millisecond, hung, h)
+
+	before := runtime.NumGoroutine()
+	var busy int
+	for i := 0; i < 200; i++ {
+		if err := pm.Log(&Record{Msg: "test"}); errors.Is(err, ErrHandlerBusy) {
+			busy++
+		}
+	}
+	// the hung handler holds one record and its queue the next ones
+	dropped := pm.(interface{ Dropped() uint64 }).Dropped()
+	if dropped < 200-parallelQueueSize-1 || dropped > 200-parallelQueueSize || int(dropped) != busy {
+		t.Fatalf("expected about %d dropped records, got %d (%d busy)", 200-parallelQueueSize-1, dropped, busy)
+	}
+	if n := runtime.NumGoroutine(); n > before+5 {
+		t.Fatalf("goroutines grew from %d to %d", before, n)
+	}
+}
+
+func TestParallelMultiHandlerTimeoutPerHandler(t *testing.T) {
+	t.Parallel()
+
+	slow := FuncHandler(func(r *Record) error {
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	})
+	pm := ParallelMultiHandler(150*time.Millisecond, slow)
+	defer pm.(io.Closer).Close()
+
+	// the second record waits for the first one, then gets its own
+	// timeout rather than what is left of a shared deadline
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- pm.Log(&Record{Msg: "test"}) }()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("expected no timeout, got %v", err)
+		}
+	}
+}
+
+type closeHandler struct {
+	closed atomic.Bool
+}
+
+func (h *closeHandler) Log(r *Record) error {
+	return nil
+}
+
+func (h *closeHandler) Close() error {
+	h.closed.Store(true)
+	return nil
+}
+
+func TestParallelMultiHandlerClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+	var children [3]closeHandler
+	pm := ParallelMultiHandler(time.Second, &children[0], &children[1], &children[2])
+	if err := pm.Log(&Record{Msg: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pm.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range children {
+		if !children[i].closed.Load() {
+			t.Fatalf("handler %d wasn't closed", i)
+		}
+	}
+	if err := pm.Log(&Record{Msg: "test"}); !errors.Is(err, ErrHandlerClosed) {
+		t.Fatalf("expected ErrHandlerClosed after Close, got %v", err)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Fatalf("goroutines grew from %d to %d after Close", before, n)
+	}
+}
+
+func TestMultiHandlerEvaluatesLazyOnce(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+	lazy := Lazy{func() int { return int(calls.Add(1)) }}
+	h1, r1 := testHandler()
+	h2, r2 := testHandler()
+	for _, mh := range []Handler{MultiHandler(h1, h2), ParallelMultiHandler(0, h1, h2)} {
+		calls.Store(0)
+		l := New()
+		l.SetHandler(mh)
+		l.Info("test", "x", lazy)
+		if calls.Load() != 1 {
+			t.Fatalf("expected the lazy value to be evaluated once, got %d", calls.Load())
+		}
+		if r1.Ctx[1] != 1 || r2.Ctx[1] != 1 {
+			t.Fatalf("expected both handlers to get the value, got %v and %v", r1.Ctx, r2.Ctx)
+		}
+	}
+}
+
 type waitHandler struct {
 	ch chan Record
 }
@@ -474,6 +646,33 @@ func TestCallerFileHandler(t *testing.T) {
 	}
 }
 
+func logWrapper(l Logger, msg string) {
+	l.(CallerSkipLogger).WithCallerSkip(1).Info(msg)
+}
+
+func logHelper(l Logger, msg string) {
+	Helper()
+	l.Info(msg)
+}
+
+func TestCallerSkip(t *testing.T) {
+	t.Parallel()
+
+	l := New()
+	h, r := testHandler()
+	l.SetHandler(CallerFileHandler(h))
+
+	for _, fn := range []func(Logger, string){logWrapper, logHelper} {
+		fn(l, "baz")
+		_, _, line, _ := runtime.Caller(0)
+
+		exp := fmt.Sprint("log15_test.go:", line-1)
+		if r.Ctx[1] != exp {
+			t.Fatalf("Wrong caller, got %s expected %s", r.Ctx[1], exp)
+		}
+	}
+}
+
 func TestCallerFuncHandler(t *testing.T) {
 	t.Parallel()
 
@@ -608,3 +807,303 @@ func TestConcurrent(t *testing.T) {
 		}
 	}
 }
+
+func TestDupKeyPolicy(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		policy DupKeyPolicy
+		ctx    []interface{}
+	}{
+		{DupKeysKeepAll, []interface{}{"user", "alice", "x", 1, "user", "bob"}},
+		{DupKeysLastWins, []interface{}{"user", "bob", "x", 1}},
+		{DupKeysFirstWins, []interface{}{"user", "alice", "x", 1}},
+		{DupKeysRename, []interface{}{"user", "alice", "x", 1, "user_1", "bob"}},
+	}
+
+	for _, c := range cases {
+		parent, _, r := testLogger()
+		l := parent.(DupKeyPolicyLogger).WithDupKeyPolicy(c.policy).New("user", "alice", "x", 1)
+		l.Info("test", "user", "bob")
+
+		if fmt.Sprint(r.Ctx) != fmt.Sprint(c.ctx) {
+			t.Errorf("policy %d: got ctx %v, expected %v", c.policy, r.Ctx, c.ctx)
+		}
+	}
+}
+
+func TestDupKeyPolicyNew(t *testing.T) {
+	t.Parallel()
+
+	parent, _, r := testLogger()
+	l := parent.New("user", "alice").(DupKeyPolicyLogger).WithDupKeyPolicy(DupKeysRename)
+	l = l.New("user", "bob", "user_1", "carol")
+	l.Info("test")
+
+	expected := []interface{}{"user", "alice", "user_1", "bob", "user_1_1", "carol"}
+	if fmt.Sprint(r.Ctx) != fmt.Sprint(expected) {
+		t.Fatalf("got ctx %v, expected %v", r.Ctx, expected)
+	}
+}
+
+func TestJsonDupKeys(t *testing.T) {
+	t.Parallel()
+
+	l, buf := testFormatter(JsonFormat())
+	l.New("user", "alice").Info("test", "user", "bob")
+
+	var v map[string]interface{}
+	if err := json.NewDecoder(buf).Decode(&v); err != nil {
+		t.Fatalf("Error decoding JSON: %v", err)
+	}
+
+	got := fmt.Sprint(v["user"])
+	if expected := "[alice bob]"; got != expected {
+		t.Fatalf("got user %s, expected %s", got, expected)
+	}
+}
+
+func TestJsonDupKeysPanicReportedOnce(t *testing.T) {
+	var panics int
+	SetPanicHook(func(err *PanicError) {
+		panics++
+	})
+	defer SetPanicHook(nil)
+
+	l, buf := testFormatter(JsonFormat())
+	l.Info("test", "x", panicStringer{}, "x", 1, "msg", "ctx")
+
+	var v map[string]interface{}
+	if err := json.NewDecoder(buf).Decode(&v); err != nil {
+		t.Fatalf("Error decoding JSON: %v", err)
+	}
+	if got := fmt.Sprint(v["x"]); got != "[PANIC=bad stringer 1]" {
+		t.Fatalf("got x %s, expected [PANIC=bad stringer 1]", got)
+	}
+	if v["msg"] != "ctx" {
+		t.Fatalf("got msg %v, expected the context to take precedence", v["msg"])
+	}
+	if panics != 1 {
+		t.Fatalf("panic reported %d times, expected once", panics)
+	}
+}
+
+func TestSortedKeysFormat(t *testing.T) {
+	t.Parallel()
+
+	l, buf := testFormatter(SortedKeysFormat(LogfmtFormat()))
+	l.New("zone", "us", "app", "web").Info("test", "b", 2, "a", 1, "app", "api")
+
+	// skip timestamp in comparison
+	got := buf.String()[27:]
+	expected := "lvl=info msg=test a=1 app=web app=api b=2 zone=us\n"
+	if got != expected {
+		t.Fatalf("Got %s, expected %s", got, expected)
+	}
+}
+
+func TestSortedKeysFormatCopiesCtx(t *testing.T) {
+	t.Parallel()
+
+	h, r := testHandler()
+	l := New()
+	l.SetHandler(MultiHandler(StreamHandler(io.Discard, SortedKeysFormat(JsonFormat())), h))
+	l.Info("test", "b", 2, "a", 1)
+
+	if r.Ctx[0] != "b" {
+		t.Fatalf("SortedKeysFormat modified the record's ctx: %v", r.Ctx)
+	}
+}
+
+type panicStringer struct{}
+
+func (panicStringer) String() string {
+	panic("bad stringer")
+}
+
+type panicMarshaler struct{}
+
+func (panicMarshaler) MarshalJSON() ([]byte, error) {
+	panic("bad marshaler")
+}
+
+func TestPanicLazy(t *testing.T) {
+	t.Parallel()
+
+	l, _, r := testLogger()
+	l.Info("", "x", Lazy{func() int { panic("bad lazy") }})
+	if r.Ctx[1] != "PANIC=bad lazy" {
+		t.Fatalf("Expected panic marker, got %v", r.Ctx[1])
+	}
+}
+
+func TestPanicStringer(t *testing.T) {
+	t.Parallel()
+
+	l, buf := testFormatter(LogfmtFormat())
+	l.Info("test", "x", panicStringer{}, "y", 1)
+
+	// skip timestamp in comparison
+	got := buf.String()[27:]
+	expected := "lvl=info msg=test x=\"PANIC=bad stringer\" y=1\n"
+	if got != expected {
+		t.Fatalf("Got %s, expected %s", got, expected)
+	}
+}
+
+func TestPanicMarshaler(t *testing.T) {
+	t.Parallel()
+
+	l, buf := testFormatter(JsonFormat())
+	l.Info("test", "x", panicMarshaler{}, "y", 1)
+
+	var v map[string]interface{}
+	if err := json.NewDecoder(buf).Decode(&v); err != nil {
+		t.Fatalf("Error decoding JSON: %v", err)
+	}
+	if v["x"] != "PANIC=bad marshaler" || v["y"] != float64(1) {
+		t.Fatalf("Expected panic marker, got %v", v)
+	}
+}
+
+func TestSafeFormat(t *testing.T) {
+	t.Parallel()
+
+	fmtr := SafeFormat(FormatFunc(func(r *Record) []byte {
+		panic("bad format")
+	}))
+	r := &Record{Msg: "test", Ctx: []interface{}{"x", 1}, KeyNames: RecordKeyNames{Time: "t", Lvl: "lvl", Msg: "msg"}}
+	got := string(fmtr.Format(r))
+	if !strings.Contains(got, `msg=test x=1 LOG15_ERROR="PANIC=bad format"`) {
+		t.Fatalf("unexpected output %q", got)
+	}
+	if len(r.Ctx) != 2 {
+		t.Fatalf("record changed by the fallback: %v", r.Ctx)
+	}
+}
+
+func TestRecordClone(t *testing.T) {
+	t.Parallel()
+
+	r := &Record{Msg: "test", Ctx: make([]interface{}, 2, 4)}
+	r.Ctx[0], r.Ctx[1] = "x", 1
+	c := r.Clone()
+	c.Msg = "clone"
+	c.Ctx[1] = 2
+	c.Ctx = append(c.Ctx, "y", 3)
+	r.Ctx = append(r.Ctx, "z", 4)
+	if r.Msg != "test" || r.Ctx[1] != 1 || c.Ctx[2] != "y" {
+		t.Fatalf("clone shares the record: %+v %+v", r, c)
+	}
+}
+
+func TestPanicFormat(t *testing.T) {
+	t.Parallel()
+
+	l, buf := testFormatter(FormatFunc(func(r *Record) []byte {
+		panic("bad format")
+	}))
+	l.Info("test", "x", 1)
+
+	// skip timestamp in comparison
+	got := buf.String()[27:]
+	expected := "lvl=info msg=test x=1 LOG15_ERROR=\"PANIC=bad format\"\n"
+	if got != expected {
+		t.Fatalf("Got %s, expected %s", got, expected)
+	}
+}
+
+func TestPanicHook(t *testing.T) {
+	var got *PanicError
+	SetPanicHook(func(err *PanicError) {
+		got = err
+	})
+	defer SetPanicHook(nil)
+
+	l, _, r := testLogger()
+	l.SetHandler(FilterHandler(func(r *Record) bool {
+		panic("bad filter")
+	}, l.GetHandler()))
+	l.Info("test")
+
+	if r.Msg != "test" {
+		t.Fatalf("Expected record to be delivered")
+	}
+	if got == nil || got.Value != "bad filter" || len(got.Stack) == 0 {
+		t.Fatalf("Expected panic to be reported, got %v", got)
+	}
+}
+
+func TestRouteHandler(t *testing.T) {
+	t.Parallel()
+
+	db, dbRec := testHandler()
+	http, httpRec := testHandler()
+	dflt, dfltRec := testHandler()
+
+	router := RouteHandler("component", RouteExact, dflt)
+	router.Add("db", db)
+	router.Add("http", http)
+	l := New()
+	l.SetHandler(router)
+
+	l.Info("query", "component", "db")
+	l.Info("request", "component", "http")
+	l.Info("other", "component", "cache")
+	if dbRec.Msg != "query" || httpRec.Msg != "request" || dfltRec.Msg != "other" {
+		t.Fatalf("wrong routing: db=%q http=%q default=%q", dbRec.Msg, httpRec.Msg, dfltRec.Msg)
+	}
+
+	l.Info("no component")
+	if dfltRec.Msg != "no component" {
+		t.Fatalf("expected record without key to go to the default route")
+	}
+
+	router.Remove("db")
+	l.Info("query2", "component", "db")
+	if dbRec.Msg != "query" || dfltRec.Msg != "query2" {
+		t.Fatalf("expected removed route to go to the default route")
+	}
+
+	router.SetDefault(nil)
+	l.Info("dropped", "component", "db")
+	if dfltRec.Msg != "query2" {
+		t.Fatalf("expected record to be dropped")
+	}
+}
+
+func TestRouteHandlerMatch(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		match    RouteMatch
+		patterns []string
+		value    interface{}
+		expected string
+	}{
+		{RoutePrefix, []string{"db", "db.pool"}, "db.pool.conn", "db.pool"},
+		{RoutePrefix, []string{"db", "db.pool"}, "db.query", "db"},
+		{RouteGlob, []string{"http.*", "*"}, "http.server", "http.*"},
+		{RouteGlob, []string{"http.*", "*"}, "db", "*"},
+		{RouteExact, []string{"1", "2"}, 2, "2"},
+	}
+
+	for _, tt := range cases {
+		var got string
+		router := RouteHandler("component", tt.match, nil)
+		for _, p := range tt.patterns {
+			p := p
+			router.Add(p, FuncHandler(func(r *Record) error {
+				got = p
+				return nil
+			}))
+		}
+		l := New()
+		l.SetHandler(router)
+		l.Info("test", "component", tt.value)
+
+		if got != tt.expected {
+			t.Errorf("%v matching %v: got route %q, expected %q", tt.patterns, tt.value, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+// Package log15test provides handlers and assertions for testing code which
+// logs with log15.
+//
+// A Recorder captures the records logged to it so that tests can query them:
+//
+//	rec := log15test.NewRecorder()
+//	logger.SetHandler(rec)
+//
+//	doSomething(logger)
+//
+//	log15test.AssertLogged(t, rec, log15test.Lvl(log.LvlError), log15test.KV("user", "alice"))
+//	log15test.RequireCount(t, rec, 1, log15test.Msg("request done"))
+package log15test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// Recorder is a Handler which keeps every record logged to it. It is safe
+// for concurrent use. Lazy values are evaluated before a record is kept.
+type Recorder struct {
+	handler log.Handler
+
+	mu      sync.Mutex
+	records []*log.Record
+	clock   func() time.Time
+}
+
+// NewRecorder returns an empty Recorder.
+func NewRecorder() *Recorder {
+	rec := new(Recorder)
+	rec.handler = log.LazyHandler(log.FuncHandler(rec.record))
+	return rec
+}
+
+// Log implements log15.Handler interface.
+func (rec *Recorder) Log(r *log.Record) error {
+	return rec.handler.Log(r)
+}
+
+func (rec *Recorder) record(r *log.Record) error {
+	rc := r.Clone()
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.clock != nil {
+		rc.Time = rec.clock()
+	}
+	rec.records = append(rec.records, rc)
+	return nil
+}
+
+// SetClock makes the recorder replace the time of each record with the
+// result of clock, so that formatted records are deterministic. See
+// StepClock.
+func (rec *Recorder) SetClock(clock func() time.Time) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.clock = clock
+}
+
+// StepClock returns a clock which returns start on its first call and a
+// time step later on each following call. It is safe for concurrent use.
+func StepClock(start time.Time, step time.Duration) func() time.Time {
+	var mu sync.Mutex
+	next := start
+	return func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		t := next
+		next = next.Add(step)
+		return t
+	}
+}
+
+// Records returns the records matching all of the given queries in the
+// order they were logged. Without queries, it returns all records.
+func (rec *Recorder) Records(qs ...Query) []*log.Record {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	var records []*log.Record
+	for _, r := range rec.records {
+		if matchAll(r, qs) {
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+// Count returns the number of records matching all of the given queries.
+func (rec *Recorder) Count(qs ...Query) int {
+	return len(rec.Records(qs...))
+}
+
+// Reset discards all records.
+func (rec *Recorder) Reset() {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.records = nil
+}
+
+// A Query selects records of a Recorder.
+type Query struct {
+	desc  string
+	match func(r *log.Record) bool
+}
+
+func (q Query) String() string {
+	return q.desc
+}
+
+// Where returns a Query which selects the records for which match
+// returns true. desc describes the query in failure messages.
+func Where(desc string, match func(r *log.Record) bool) Query {
+	return Query{desc, match}
+}
+
+// Lvl selects the records logged at lvl.
+func Lvl(lvl log.Lvl) Query {
+	return Where(fmt.Sprintf("lvl=%s", lvl), func(r *log.Record) bool {
+		return r.Lvl == lvl
+	})
+}
+
+// Msg selects the records with the message msg.
+func Msg(msg string) Query {
+	return Where(fmt.Sprintf("msg=%q", msg), func(r *log.Record) bool {
+		return r.Msg == msg
+	})
+}
+
+// MsgContains selects the records whose message contains substr.
+func MsgContains(substr string) Query {
+	return Where(fmt.Sprintf("msg contains %q", substr), func(r *log.Record) bool {
+		return strings.Contains(r.Msg, substr)
+	})
+}
+
+// HasKey selects the records whose context has key.
+func HasKey(key string) Query {
+	return Where(fmt.Sprintf("has %s", key), func(r *log.Record) bool {
+		for i := 0; i < len(r.Ctx); i += 2 {
+			if r.Ctx[i] == key {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// KV selects the records whose context has key with a value deeply equal
+// to value. If the key appears more than once, any of its values may match.
+func KV(key string, value interface{}) Query {
+	return Where(fmt.Sprintf("%s=%v", key, value), func(r *log.Record) bool {
+		for i := 0; i+1 < len(r.Ctx); i += 2 {
+			if r.Ctx[i] == key && reflect.DeepEqual(r.Ctx[i+1], value) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func matchAll(r *log.Record, qs []Query) bool {
+	for _, q := range qs {
+		if !q.match(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// describe returns a description of qs and the records of rec for
+// failure messages.
+func describe(rec *Recorder, qs []Query) string {
+	var b strings.Builder
+	if len(qs) == 0 {
+		b.WriteString("any record")
+	}
+	for i, q := range qs {
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		b.WriteString(q.desc)
+	}
+
+	records := rec.Records()
+	fmt.Fprintf(&b, "\nrecorded %d records:", len(records))
+	fmtr := log.SafeFormat(log.LogfmtFormat())
+	for _, r := range records {
+		b.WriteString("\n\t")
+		b.Write(bytes.TrimSuffix(fmtr.Format(r), []byte{'\n'}))
+	}
+	return b.String()
+}
+
+// AssertLogged marks the test as failed unless rec has a record matching
+// all of the given queries.
+func AssertLogged(t testing.TB, rec *Recorder, qs ...Query) {
+	t.Helper()
+	if rec.Count(qs...) == 0 {
+		t.Errorf("expected a record matching %s", describe(rec, qs))
+	}
+}
+
+// AssertNotLogged marks the test as failed if rec has a record matching
+// all of the given queries.
+func AssertNotLogged(t testing.TB, rec *Recorder, qs ...Query) {
+	t.Helper()
+	if rec.Count(qs...) != 0 {
+		t.Errorf("expected no record matching %s", describe(rec, qs))
+	}
+}
+
+// RequireCount stops the test unless rec has exactly n records matching
+// all of the given queries.
+func RequireCount(t testing.TB, rec *Recorder, n int, qs ...Query) {
+	t.Helper()
+	if got := rec.Count(qs...); got != n {
+		t.Fatalf("expected %d records but got %d matching %s", n, got, describe(rec, qs))
+	}
+}
+
+// UpdateGoldenEnv is the environment variable which makes AssertGolden
+// write golden files instead of comparing with them, e.g.
+//
+//	LOG15TEST_UPDATE=1 go test ./...
+const UpdateGoldenEnv = "LOG15TEST_UPDATE"
+
+// AssertGolden formats the records of rec with fmtr and marks the test as
+// failed unless the result equals the contents of the golden file at path.
+// If the environment variable named by UpdateGoldenEnv is set, the golden
+// file is written instead. Use SetClock and log15.SortedKeysFormat to make
+// the output deterministic.
+func AssertGolden(t testing.TB, rec *Recorder, fmtr log.Format, path string) {
+	t.Helper()
+
+	fmtr = log.SafeFormat(fmtr)
+	var got bytes.Buffer
+	for _, r := range rec.Records() {
+		got.Write(fmtr.Format(r))
+	}
+
+	if os.Getenv(UpdateGoldenEnv) != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, got.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading golden file: %v (set %s=1 to create it)", err, UpdateGoldenEnv)
+	}
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("formatted records differ from golden file %s\ngot:\n%s\nwant:\n%s", path, got.Bytes(), want)
+	}
+}
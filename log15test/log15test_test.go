@@ -0,0 +1,196 @@
+package log15test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// fakeTB records the failures reported by the assertion helpers and
+// the output of TestingHandler.
+type fakeTB struct {
+	testing.TB
+	failed, stopped bool
+	msg             string
+	logs            []string
+	cleanups        []func()
+}
+
+func (t *fakeTB) Helper() {}
+
+func (t *fakeTB) Log(args ...interface{}) {
+	t.logs = append(t.logs, fmt.Sprint(args...))
+}
+
+func (t *fakeTB) Cleanup(fn func()) {
+	t.cleanups = append(t.cleanups, fn)
+}
+
+func (t *fakeTB) finish() {
+	for i := len(t.cleanups) - 1; i >= 0; i-- {
+		t.cleanups[i]()
+	}
+}
+
+func (t *fakeTB) Errorf(format string, args ...interface{}) {
+	t.failed = true
+	t.msg = fmt.Sprintf(format, args...)
+}
+
+func (t *fakeTB) Fatalf(format string, args ...interface{}) {
+	t.Errorf(format, args...)
+	t.stopped = true
+}
+
+func TestRecorder(t *testing.T) {
+	t.Parallel()
+
+	rec := NewRecorder()
+	l := log.New("user", "alice")
+	l.SetHandler(rec)
+
+	l.Info("request done", "status", 200)
+	l.Error("request failed", "status", 500, "lazy", log.Lazy{Fn: func() int { return 1 }})
+	l.Debug("cache miss")
+
+	if n := rec.Count(); n != 3 {
+		t.Fatalf("expected 3 records, got %d", n)
+	}
+	if n := rec.Count(Lvl(log.LvlError), KV("status", 500), KV("lazy", 1)); n != 1 {
+		t.Fatalf("expected 1 error record, got %d", n)
+	}
+	if n := rec.Count(MsgContains("request"), KV("user", "alice")); n != 2 {
+		t.Fatalf("expected 2 request records, got %d", n)
+	}
+	if n := rec.Count(HasKey("status"), Msg("cache miss")); n != 0 {
+		t.Fatalf("expected no records, got %d", n)
+	}
+
+	rec.Reset()
+	if n := rec.Count(); n != 0 {
+		t.Fatalf("expected no records after reset, got %d", n)
+	}
+}
+
+func TestRecorderConcurrent(t *testing.T) {
+	t.Parallel()
+
+	rec := NewRecorder()
+	l := log.New()
+	l.SetHandler(rec)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				l.Info("test", "goroutine", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	RequireCount(t, rec, 800)
+	RequireCount(t, rec, 100, KV("goroutine", 3))
+}
+
+func TestAssertions(t *testing.T) {
+	t.Parallel()
+
+	rec := NewRecorder()
+	l := log.New()
+	l.SetHandler(rec)
+	l.Warn("disk full", "free", 0)
+
+	ft := new(fakeTB)
+	AssertLogged(ft, rec, Lvl(log.LvlWarn), KV("free", 0))
+	AssertNotLogged(ft, rec, Lvl(log.LvlError))
+	RequireCount(ft, rec, 1, Msg("disk full"))
+	if ft.failed {
+		t.Fatalf("unexpected failure: %s", ft.msg)
+	}
+
+	ft = new(fakeTB)
+	AssertLogged(ft, rec, Lvl(log.LvlError))
+	if !ft.failed || ft.stopped {
+		t.Fatalf("expected AssertLogged to fail without stopping")
+	}
+
+	ft = new(fakeTB)
+	AssertNotLogged(ft, rec, Msg("disk full"))
+	if !ft.failed || ft.stopped {
+		t.Fatalf("expected AssertNotLogged to fail without stopping")
+	}
+
+	ft = new(fakeTB)
+	RequireCount(ft, rec, 2)
+	if !ft.failed || !ft.stopped {
+		t.Fatalf("expected RequireCount to stop the test")
+	}
+}
+
+func TestAssertGolden(t *testing.T) {
+	t.Parallel()
+
+	rec := NewRecorder()
+	rec.SetClock(StepClock(time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC), time.Second))
+	l := log.New()
+	l.SetHandler(rec)
+	l.Info("starting", "port", 8080, "addr", "localhost")
+	l.Error("listen failed", "err", "address in use")
+
+	AssertGolden(t, rec, log.SortedKeysFormat(log.LogfmtFormat()), filepath.Join("testdata", "golden.log"))
+
+	if os.Getenv(UpdateGoldenEnv) != "" {
+		return
+	}
+
+	ft := new(fakeTB)
+	l.Info("extra")
+	AssertGolden(ft, rec, log.SortedKeysFormat(log.LogfmtFormat()), filepath.Join("testdata", "golden.log"))
+	if !ft.failed {
+		t.Fatalf("expected golden comparison to fail")
+	}
+}
+
+func TestTestingHandler(t *testing.T) {
+	t.Parallel()
+
+	ft := new(fakeTB)
+	l := log.New("component", "db")
+	l.SetHandler(TestingHandler(ft, log.SortedKeysFormat(log.LogfmtFormat())))
+	l.Info("query", "rows", 2)
+
+	if len(ft.logs) != 1 || !strings.HasSuffix(ft.logs[0], "lvl=info msg=query component=db rows=2") {
+		t.Fatalf("unexpected output: %q", ft.logs)
+	}
+	if !strings.HasPrefix(ft.logs[0], "log15test_test.go:") {
+		t.Fatalf("expected the call site in the output: %q", ft.logs[0])
+	}
+
+	ft.finish()
+	l.Info("after the test")
+	if len(ft.logs) != 1 {
+		t.Fatalf("expected no output after the test finished, got %q", ft.logs)
+	}
+}
+
+func TestTestingHandlerSubtest(t *testing.T) {
+	t.Parallel()
+
+	var sub log.Logger
+	t.Run("sub", func(t *testing.T) {
+		sub = NewTestingLogger(t, "subtest", t.Name())
+		sub.Info("from subtest")
+	})
+
+	// logging after the subtest finished must not panic
+	sub.Info("after subtest")
+}
@@ -0,0 +1,66 @@
+package log15test
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// TestingHandler returns a Handler which writes records formatted with
+// fmtr to t.Log, so that go test only shows them for failing tests, or
+// with -v, under the test which logged them. If fmtr is nil, records are
+// formatted with LogfmtFormat.
+//
+// Once the test has finished, records are silently dropped instead of
+// making t.Log panic, so goroutines which outlive the test may keep
+// logging. To scope logging to a subtest, give it a child logger:
+//
+//	t.Run("sub", func(t *testing.T) {
+//	    l := logger.New("subtest", t.Name())
+//	    l.SetHandler(log15test.TestingHandler(t, nil))
+//	    ...
+//	})
+//
+// The file and line which go test prints with each record belong to log15,
+// so each record is prefixed with the call site which logged it, like
+// "db_test.go:42: lvl=info msg=...".
+func TestingHandler(t testing.TB, fmtr log.Format) log.Handler {
+	if fmtr == nil {
+		fmtr = log.LogfmtFormat()
+	}
+	fmtr = log.SafeFormat(fmtr)
+	log.CaptureCallers()
+
+	var mu sync.Mutex
+	done := false
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		done = true
+	})
+
+	return log.LazyHandler(log.FuncHandler(func(r *log.Record) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if done {
+			return nil
+		}
+		line := strings.TrimSuffix(string(fmtr.Format(r)), "\n")
+		if r.Call.Frame().PC != 0 {
+			line = fmt.Sprintf("%v: %s", r.Call, line)
+		}
+		t.Log(line)
+		return nil
+	}))
+}
+
+// NewTestingLogger returns a new Logger with the given context which logs
+// to TestingHandler(t, nil).
+func NewTestingLogger(t testing.TB, ctx ...interface{}) log.Logger {
+	l := log.New(ctx...)
+	l.SetHandler(TestingHandler(t, nil))
+	return l
+}
@@ -0,0 +1,454 @@
+package receiver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// Names of the formats understood by NewDecoder.
+const (
+	FormatLogfmt = "logfmt"
+	FormatJSON   = "json"
+	FormatBinary = "binary"
+)
+
+// logfmtTimeFormat is the time format of LogfmtFormat.
+const logfmtTimeFormat = "2006-01-02T15:04:05-0700"
+
+// maxRecordSize is the size of the largest record a decoder accepts.
+const maxRecordSize = 16 << 20
+
+// DefaultKeyNames are the keys under which LogfmtFormat and JsonFormat
+// write the time, level and message of a record by default.
+var DefaultKeyNames = log.RecordKeyNames{Time: "t", Lvl: "lvl", Msg: "msg"}
+
+// A Decoder reads records from a stream.
+type Decoder interface {
+	// Decode returns the next record, or io.EOF at the end of the
+	// stream. After a *LineError, decoding may go on with the next line;
+	// other errors are final.
+	Decode() (*log.Record, error)
+}
+
+// LineError is returned by a Decoder for a line which isn't a record.
+type LineError struct {
+	Line []byte
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("bad record %q: %v", e.Line, e.Err)
+}
+
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+// NewDecoder returns a Decoder for the records in format read from r, in
+// which keys are the names of the time, level and message keys. The
+// time of records without one is the time they are decoded.
+func NewDecoder(format string, r io.Reader, keys log.RecordKeyNames) (Decoder, error) {
+	switch format {
+	case FormatLogfmt:
+		return &lineDecoder{lines: newLineScanner(r), keys: keys, parse: parseLogfmt}, nil
+	case FormatJSON:
+		return &lineDecoder{lines: newLineScanner(r), keys: keys, parse: parseJSON}, nil
+	case FormatBinary:
+		return &binaryDecoder{r: bufio.NewReader(r), keys: keys}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+func newLineScanner(r io.Reader) *bufio.Scanner {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, maxRecordSize)
+	return sc
+}
+
+// lineDecoder decodes a record from each non empty line.
+type lineDecoder struct {
+	lines *bufio.Scanner
+	keys  log.RecordKeyNames
+	parse func(line []byte, keys log.RecordKeyNames) (*log.Record, error)
+}
+
+func (d *lineDecoder) Decode() (*log.Record, error) {
+	for d.lines.Scan() {
+		line := bytes.TrimSpace(d.lines.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		r, err := d.parse(line, d.keys)
+		if err != nil {
+			return nil, &LineError{append([]byte(nil), line...), err}
+		}
+		return r, nil
+	}
+	if err := d.lines.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// newRecord returns a record with keys and the current time.
+func newRecord(keys log.RecordKeyNames) *log.Record {
+	return &log.Record{Time: time.Now(), Lvl: log.LvlInfo, KeyNames: keys}
+}
+
+// setField sets the time, level or message of r if k is one of their keys
+// and adds k and v to the context otherwise.
+func setField(r *log.Record, k string, v interface{}, timeLayout string) error {
+	switch k {
+	case r.KeyNames.Time:
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("bad time %v", v)
+		}
+		t, err := time.Parse(timeLayout, s)
+		if err != nil {
+			return err
+		}
+		r.Time = t
+	case r.KeyNames.Lvl:
+		s, _ := v.(string)
+		lvl, err := log.LvlFromString(s)
+		if err != nil {
+			return err
+		}
+		r.Lvl = lvl
+	case r.KeyNames.Msg:
+		r.Msg = fmt.Sprint(v)
+	default:
+		r.Ctx = append(r.Ctx, k, v)
+	}
+	return nil
+}
+
+// parseLogfmt decodes a line written by LogfmtFormat. All values of the
+// context are strings.
+func parseLogfmt(line []byte, keys log.RecordKeyNames) (*log.Record, error) {
+	r := newRecord(keys)
+	s := string(line)
+	for len(s) > 0 {
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return nil, errors.New("expected key=value")
+		}
+		k := s[:eq]
+		if strings.ContainsAny(k, " \"") {
+			return nil, fmt.Errorf("bad key %q", k)
+		}
+
+		v, rest, err := logfmtValue(s[eq+1:])
+		if err != nil {
+			return nil, err
+		}
+		if err := setField(r, k, v, logfmtTimeFormat); err != nil {
+			return nil, err
+		}
+		s = strings.TrimLeft(rest, " ")
+	}
+	return r, nil
+}
+
+// logfmtValue decodes the value at the start of s and returns the rest.
+// Like LogfmtFormat, it escapes backslashes in unquoted values too.
+func logfmtValue(s string) (v, rest string, err error) {
+	quoted := strings.HasPrefix(s, `"`)
+	if quoted {
+		s = s[1:]
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				b.WriteByte(s[i])
+			}
+		case quoted && c == '"':
+			return b.String(), s[i+1:], nil
+		case !quoted && c == ' ':
+			return b.String(), s[i:], nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if quoted {
+		return "", "", errors.New("unterminated quoted value")
+	}
+	return b.String(), "", nil
+}
+
+// parseJSON decodes a line written by JsonFormat, keeping the order of the
+// keys. Numbers in the context are json.Numbers.
+func parseJSON(line []byte, keys log.RecordKeyNames) (*log.Record, error) {
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.UseNumber()
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, errors.New("expected a JSON object")
+	}
+
+	r := newRecord(keys)
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		k := t.(string)
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			return nil, err
+		}
+		if err := setField(r, k, v, time.RFC3339Nano); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Tags of the values in the binary format.
+const (
+	tagNil byte = iota
+	tagString
+	tagInt
+	tagUint
+	tagFloat
+	tagBool
+	tagTime
+)
+
+// BinaryFormat returns a Format which encodes records compactly, keeping
+// the types of integers, floats, bools and times in the context, for
+// example to send them to a receiver with NetHandler:
+//
+//	log.NetHandler("tcp", "collector:7000", receiver.BinaryFormat())
+//
+// Each record is a frame of a 4 byte big endian length followed by the
+// time in nanoseconds, the level, the message and the key value pairs of
+// the context. Other values are encoded as strings like by LogfmtFormat,
+// and so are keys which aren't strings. Integers are decoded as int64 or
+// uint64, floats as float64.
+func BinaryFormat() log.Format {
+	return log.FormatFunc(func(r *log.Record) []byte {
+		b := make([]byte, 4, 64+len(r.Msg))
+		b = binary.AppendVarint(b, r.Time.UnixNano())
+		b = binary.AppendUvarint(b, uint64(r.Lvl))
+		b = appendString(b, r.Msg)
+		b = binary.AppendUvarint(b, uint64((len(r.Ctx)+1)/2))
+		for i := 0; i < len(r.Ctx); i += 2 {
+			k, ok := r.Ctx[i].(string)
+			if !ok {
+				k = fmt.Sprintf("%+v", r.Ctx[i])
+			}
+			b = appendString(b, k)
+			if i+1 < len(r.Ctx) {
+				b = appendValue(b, r.Ctx[i+1])
+			} else {
+				b = append(b, tagNil)
+			}
+		}
+		binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+		return b
+	})
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendValue(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(b, tagNil)
+	case string:
+		return appendString(append(b, tagString), v)
+	case int:
+		return binary.AppendVarint(append(b, tagInt), int64(v))
+	case int8:
+		return binary.AppendVarint(append(b, tagInt), int64(v))
+	case int16:
+		return binary.AppendVarint(append(b, tagInt), int64(v))
+	case int32:
+		return binary.AppendVarint(append(b, tagInt), int64(v))
+	case int64:
+		return binary.AppendVarint(append(b, tagInt), v)
+	case uint:
+		return binary.AppendUvarint(append(b, tagUint), uint64(v))
+	case uint8:
+		return binary.AppendUvarint(append(b, tagUint), uint64(v))
+	case uint16:
+		return binary.AppendUvarint(append(b, tagUint), uint64(v))
+	case uint32:
+		return binary.AppendUvarint(append(b, tagUint), uint64(v))
+	case uint64:
+		return binary.AppendUvarint(append(b, tagUint), v)
+	case float32:
+		return binary.BigEndian.AppendUint64(append(b, tagFloat), math.Float64bits(float64(v)))
+	case float64:
+		return binary.BigEndian.AppendUint64(append(b, tagFloat), math.Float64bits(v))
+	case bool:
+		if v {
+			return append(b, tagBool, 1)
+		}
+		return append(b, tagBool, 0)
+	case time.Time:
+		return binary.AppendVarint(append(b, tagTime), v.UnixNano())
+	case error:
+		return appendString(append(b, tagString), v.Error())
+	case fmt.Stringer:
+		return appendString(append(b, tagString), v.String())
+	default:
+		return appendString(append(b, tagString), fmt.Sprintf("%+v", v))
+	}
+}
+
+// binaryDecoder decodes the frames written by BinaryFormat.
+type binaryDecoder struct {
+	r    *bufio.Reader
+	keys log.RecordKeyNames
+}
+
+func (d *binaryDecoder) Decode() (*log.Record, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(d.r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxRecordSize {
+		return nil, fmt.Errorf("record of %d bytes is too large", n)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(d.r, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return decodeBinary(frame, d.keys)
+}
+
+var errShortFrame = errors.New("short binary record")
+
+// frameReader reads the fields of a frame.
+type frameReader struct {
+	b   []byte
+	err error
+}
+
+func (f *frameReader) varint() int64 {
+	v, n := binary.Varint(f.b)
+	if n <= 0 {
+		f.fail()
+		return 0
+	}
+	f.b = f.b[n:]
+	return v
+}
+
+func (f *frameReader) uvarint() uint64 {
+	v, n := binary.Uvarint(f.b)
+	if n <= 0 {
+		f.fail()
+		return 0
+	}
+	f.b = f.b[n:]
+	return v
+}
+
+func (f *frameReader) bytes(n uint64) []byte {
+	if uint64(len(f.b)) < n {
+		f.fail()
+		return nil
+	}
+	v := f.b[:n]
+	f.b = f.b[n:]
+	return v
+}
+
+func (f *frameReader) string() string {
+	return string(f.bytes(f.uvarint()))
+}
+
+func (f *frameReader) fail() {
+	if f.err == nil {
+		f.err = errShortFrame
+	}
+	f.b = nil
+}
+
+func (f *frameReader) value() interface{} {
+	tag := f.bytes(1)
+	if tag == nil {
+		return nil
+	}
+	switch tag[0] {
+	case tagNil:
+		return nil
+	case tagString:
+		return f.string()
+	case tagInt:
+		return f.varint()
+	case tagUint:
+		return f.uvarint()
+	case tagFloat:
+		b := f.bytes(8)
+		if b == nil {
+			return nil
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b))
+	case tagBool:
+		b := f.bytes(1)
+		return b != nil && b[0] != 0
+	case tagTime:
+		return time.Unix(0, f.varint())
+	default:
+		if f.err == nil {
+			f.err = fmt.Errorf("unknown value tag %d", tag[0])
+		}
+		return nil
+	}
+}
+
+func decodeBinary(frame []byte, keys log.RecordKeyNames) (*log.Record, error) {
+	f := &frameReader{b: frame}
+	r := &log.Record{KeyNames: keys}
+	r.Time = time.Unix(0, f.varint())
+	r.Lvl = log.Lvl(f.uvarint())
+	r.Msg = f.string()
+	pairs := f.uvarint()
+	if pairs > uint64(len(f.b)) {
+		f.fail()
+	}
+	for i := uint64(0); i < pairs && f.err == nil; i++ {
+		k := f.string()
+		r.Ctx = append(r.Ctx, k, f.value())
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return r, nil
+}
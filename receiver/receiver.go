@@ -0,0 +1,265 @@
+// Package receiver accepts records sent by log15 handlers over the network
+// and feeds them into a handler tree, so that log15 can collect the records
+// of many processes:
+//
+//	rc := &receiver.Receiver{
+//	    Handler: log.Must.FileHandler("/var/log/all.log", log.LogfmtFormat()),
+//	    Format:  receiver.FormatJSON,
+//	}
+//	go rc.ListenAndServe("udp", ":7001")
+//	rc.ListenAndServe("tcp", ":7000")
+//
+// while the processes log with
+//
+//	log.Root().SetHandler(log.Must.NetHandler("tcp", "collector:7000", log.JsonFormat()))
+//
+// Records written by LogfmtFormat, JsonFormat and BinaryFormat are
+// understood. Only BinaryFormat keeps the types of the context values, the
+// other formats decode them as strings and JSON values.
+package receiver
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// ErrReceiverClosed is returned by the Serve methods of a Receiver after
+// Close.
+var ErrReceiverClosed = errors.New("receiver: closed")
+
+// A Receiver decodes the records of the streams and datagrams it accepts
+// and passes them to its handler. Its fields must not be changed once it
+// serves. A Receiver can serve several listeners at once.
+type Receiver struct {
+	// Handler receives the decoded records. It's called concurrently
+	// for records of different connections.
+	Handler log.Handler
+
+	// Format is the format of the records: FormatLogfmt, FormatJSON or
+	// FormatBinary. Defaults to FormatLogfmt.
+	Format string
+
+	// KeyNames are the time, level and message keys of the records.
+	// Defaults to DefaultKeyNames.
+	KeyNames log.RecordKeyNames
+
+	// AddrKey, if set, is the key under which the address of the sender
+	// is added to the context of each record.
+	AddrKey string
+
+	// ErrorLog logs the records which can't be decoded and the errors
+	// of connections. Defaults to discarding them.
+	ErrorLog log.Logger
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[io.Closer]bool
+	conns     map[io.Closer]bool
+	wg        sync.WaitGroup
+}
+
+// ListenAndServe listens on the network address addr and serves it. The
+// stream networks "tcp" and "unix", and the datagram networks "udp" and
+// "unixgram" are supported, with the variants understood by net.Listen
+// and net.ListenPacket.
+func (rc *Receiver) ListenAndServe(network, addr string) error {
+	switch network {
+	case "udp", "udp4", "udp6", "unixgram":
+		c, err := net.ListenPacket(network, addr)
+		if err != nil {
+			return err
+		}
+		return rc.ServePacket(c)
+	default:
+		l, err := net.Listen(network, addr)
+		if err != nil {
+			return err
+		}
+		return rc.Serve(l)
+	}
+}
+
+// Serve accepts connections on l and decodes a stream of records from
+// each. It always returns an error, ErrReceiverClosed after Close.
+func (rc *Receiver) Serve(l net.Listener) error {
+	if !rc.track(true, l, true) {
+		l.Close()
+		return ErrReceiverClosed
+	}
+	defer rc.track(true, l, false)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if rc.isClosed() {
+				return ErrReceiverClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		if !rc.track(false, conn, true) {
+			conn.Close()
+			return ErrReceiverClosed
+		}
+		go func() {
+			defer rc.wg.Done()
+			defer rc.track(false, conn, false)
+			defer conn.Close()
+			rc.serveStream(conn, conn.RemoteAddr())
+		}()
+	}
+}
+
+// ServePacket reads datagrams from c, each holding one or more records.
+// It always returns an error, ErrReceiverClosed after Close.
+func (rc *Receiver) ServePacket(c net.PacketConn) error {
+	if !rc.track(true, c, true) {
+		c.Close()
+		return ErrReceiverClosed
+	}
+	defer rc.track(true, c, false)
+
+	buf := make([]byte, 64<<10)
+	for {
+		n, addr, err := c.ReadFrom(buf)
+		if err != nil {
+			if rc.isClosed() {
+				return ErrReceiverClosed
+			}
+			return err
+		}
+		if !rc.hold() {
+			return ErrReceiverClosed
+		}
+		rc.serveStream(bytes.NewReader(buf[:n]), addr)
+		rc.wg.Done()
+	}
+}
+
+// serveStream decodes the records read from r until the end of r or an
+// error which ends the stream.
+func (rc *Receiver) serveStream(r io.Reader, addr net.Addr) {
+	keys := rc.KeyNames
+	if keys == (log.RecordKeyNames{}) {
+		keys = DefaultKeyNames
+	}
+	format := rc.Format
+	if format == "" {
+		format = FormatLogfmt
+	}
+	dec, err := NewDecoder(format, r, keys)
+	if err != nil {
+		rc.logError("bad receiver format", "err", err)
+		return
+	}
+
+	for {
+		rec, err := dec.Decode()
+		var le *LineError
+		switch {
+		case err == nil:
+		case errors.As(err, &le):
+			rc.logError("dropped bad record", "addr", addrString(addr), "err", le.Err, "line", string(le.Line))
+			continue
+		case err == io.EOF || rc.isClosed():
+			return
+		default:
+			rc.logError("closing stream", "addr", addrString(addr), "err", err)
+			return
+		}
+
+		if rc.AddrKey != "" {
+			rec.Ctx = append(rec.Ctx, rc.AddrKey, addrString(addr))
+		}
+		rc.Handler.Log(rec)
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func (rc *Receiver) logError(msg string, ctx ...interface{}) {
+	if rc.ErrorLog != nil {
+		rc.ErrorLog.Error(msg, ctx...)
+	}
+}
+
+// track adds c to or removes c from the listeners or connections. It
+// returns false if c can't be added because the receiver is closed. An
+// added connection is counted in rc.wg, which its goroutine must release.
+func (rc *Receiver) track(listener bool, c io.Closer, add bool) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.listeners == nil {
+		rc.listeners = make(map[io.Closer]bool)
+		rc.conns = make(map[io.Closer]bool)
+	}
+	set := rc.conns
+	if listener {
+		set = rc.listeners
+	}
+	if !add {
+		delete(set, c)
+		return true
+	}
+	if rc.closed {
+		return false
+	}
+	set[c] = true
+	if !listener {
+		// counted with the lock held so that Close, which waits once it
+		// has set closed, can't miss the connection
+		rc.wg.Add(1)
+	}
+	return true
+}
+
+// hold counts a datagram in rc.wg like a connection, so that Close waits
+// until its records have been handled. It returns false if the receiver is
+// closed.
+func (rc *Receiver) hold() bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.closed {
+		return false
+	}
+	rc.wg.Add(1)
+	return true
+}
+
+func (rc *Receiver) isClosed() bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.closed
+}
+
+// Close closes the listeners and connections of the receiver and waits
+// until the records which are being decoded have been handled.
+func (rc *Receiver) Close() error {
+	rc.mu.Lock()
+	rc.closed = true
+	var err error
+	for c := range rc.listeners {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	for c := range rc.conns {
+		c.Close()
+	}
+	rc.mu.Unlock()
+	rc.wg.Wait()
+	return err
+}
@@ -0,0 +1,341 @@
+package receiver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+func testRecord() *log.Record {
+	return &log.Record{
+		Time:     time.Date(2026, 10, 17, 12, 30, 0, 0, time.UTC),
+		Lvl:      log.LvlWarn,
+		Msg:      "disk \"almost\" full",
+		KeyNames: DefaultKeyNames,
+		Ctx: []interface{}{
+			"path", `C:\data dir`,
+			"free", 12,
+			"ratio", 0.5,
+			"ok", false,
+			"err", errors.New("line1\nline2"),
+		},
+	}
+}
+
+func decodeAll(t *testing.T, format string, data []byte) []*log.Record {
+	t.Helper()
+	dec, err := NewDecoder(format, bytes.NewReader(data), DefaultKeyNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []*log.Record
+	for {
+		r, err := dec.Decode()
+		if err == io.EOF {
+			return records
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+}
+
+func TestDecodeLogfmt(t *testing.T) {
+	t.Parallel()
+
+	in := testRecord()
+	data := log.LogfmtFormat().Format(in)
+	out := decodeAll(t, FormatLogfmt, append(data, data...))
+	if len(out) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(out))
+	}
+	r := out[0]
+	if !r.Time.Equal(in.Time) || r.Lvl != in.Lvl || r.Msg != in.Msg {
+		t.Fatalf("wrong record: %v %v %q", r.Time, r.Lvl, r.Msg)
+	}
+	want := []interface{}{"path", `C:\data dir`, "free", "12", "ratio", "0.500", "ok", "false", "err", "line1\nline2"}
+	if !reflect.DeepEqual(r.Ctx, want) {
+		t.Fatalf("wrong context:\ngot:  %#v\nwant: %#v", r.Ctx, want)
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	t.Parallel()
+
+	in := testRecord()
+	in.Time = in.Time.Add(123 * time.Nanosecond)
+	out := decodeAll(t, FormatJSON, log.JsonFormat().Format(in))
+	r := out[0]
+	if !r.Time.Equal(in.Time) || r.Lvl != in.Lvl || r.Msg != in.Msg {
+		t.Fatalf("wrong record: %v %v %q", r.Time, r.Lvl, r.Msg)
+	}
+	ctx := make(map[string]interface{})
+	for i := 0; i < len(r.Ctx); i += 2 {
+		ctx[r.Ctx[i].(string)] = r.Ctx[i+1]
+	}
+	if ctx["path"] != `C:\data dir` || ctx["free"] != json.Number("12") || ctx["ok"] != false {
+		t.Fatalf("wrong context: %#v", ctx)
+	}
+}
+
+func TestDecodeBinary(t *testing.T) {
+	t.Parallel()
+
+	in := testRecord()
+	in.Ctx = append(in.Ctx, "at", in.Time, "n", uint8(3), "dangling")
+	fmtr := BinaryFormat()
+	out := decodeAll(t, FormatBinary, append(fmtr.Format(in), fmtr.Format(in)...))
+	if len(out) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(out))
+	}
+	r := out[1]
+	if !r.Time.Equal(in.Time) || r.Lvl != in.Lvl || r.Msg != in.Msg {
+		t.Fatalf("wrong record: %v %v %q", r.Time, r.Lvl, r.Msg)
+	}
+	want := []interface{}{
+		"path", `C:\data dir`, "free", int64(12), "ratio", 0.5, "ok", false,
+		"err", "line1\nline2", "at", time.Unix(0, in.Time.UnixNano()), "n", uint64(3), "dangling", nil,
+	}
+	if !reflect.DeepEqual(r.Ctx, want) {
+		t.Fatalf("wrong context:\ngot:  %#v\nwant: %#v", r.Ctx, want)
+	}
+
+	// truncated frames are an error
+	frame := fmtr.Format(in)
+	dec, _ := NewDecoder(FormatBinary, bytes.NewReader(frame[:len(frame)-3]), DefaultKeyNames)
+	if _, err := dec.Decode(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected unexpected EOF, got %v", err)
+	}
+}
+
+func TestDecodeBadLine(t *testing.T) {
+	t.Parallel()
+
+	data := "msg=one\nnot a record\nmsg=\"unterminated\n{\"msg\":\"two\"}\nmsg=three\n"
+	dec, _ := NewDecoder(FormatLogfmt, strings.NewReader(data), DefaultKeyNames)
+	var msgs []string
+	var bad int
+	for {
+		r, err := dec.Decode()
+		if err == io.EOF {
+			break
+		}
+		var le *LineError
+		if errors.As(err, &le) {
+			bad++
+			continue
+		}
+		msgs = append(msgs, r.Msg)
+	}
+	if strings.Join(msgs, ",") != "one,three" || bad != 3 {
+		t.Fatalf("expected 2 records and 3 bad lines, got %v and %d", msgs, bad)
+	}
+}
+
+func hasKV(ctx []interface{}, k string, v interface{}) bool {
+	for i := 0; i+1 < len(ctx); i += 2 {
+		if ctx[i] == k && ctx[i+1] == v {
+			return true
+		}
+	}
+	return false
+}
+
+// collector is a handler which keeps the messages of records.
+type collector struct {
+	mu      sync.Mutex
+	records []*log.Record
+	n       chan struct{}
+}
+
+func newCollector() *collector {
+	return &collector{n: make(chan struct{}, 100)}
+}
+
+func (c *collector) Log(r *log.Record) error {
+	c.mu.Lock()
+	c.records = append(c.records, r)
+	c.mu.Unlock()
+	c.n <- struct{}{}
+	return nil
+}
+
+func (c *collector) wait(t *testing.T, n int) []*log.Record {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-c.n:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d of %d records", i, n)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.records
+}
+
+func TestReceiver(t *testing.T) {
+	t.Parallel()
+
+	sock := filepath.Join(t.TempDir(), "log15d.sock")
+	for _, tc := range []struct {
+		network, addr, format string
+		fmtr                  log.Format
+	}{
+		{"tcp", "127.0.0.1:0", FormatLogfmt, log.LogfmtFormat()},
+		{"unix", sock, FormatJSON, log.JsonFormat()},
+		{"udp", "127.0.0.1:0", FormatBinary, BinaryFormat()},
+	} {
+		c := newCollector()
+		rc := &Receiver{Handler: c, Format: tc.format, AddrKey: "remote"}
+
+		var addr string
+		done := make(chan error, 1)
+		if tc.network == "udp" {
+			pc, err := net.ListenPacket(tc.network, tc.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr = pc.LocalAddr().String()
+			go func() { done <- rc.ServePacket(pc) }()
+		} else {
+			l, err := net.Listen(tc.network, tc.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr = l.Addr().String()
+			go func() { done <- rc.Serve(l) }()
+		}
+
+		h, err := log.NetHandler(tc.network, addr, tc.fmtr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := log.New("network", tc.network)
+		l.SetHandler(h)
+		l.Info("one", "n", 1)
+		l.Error("two")
+
+		records := c.wait(t, 2)
+		if records[0].Msg != "one" || records[1].Msg != "two" || records[1].Lvl != log.LvlError {
+			t.Fatalf("%s: wrong records: %v", tc.network, records)
+		}
+		ctx := records[0].Ctx
+		if !hasKV(ctx, "network", tc.network) || ctx[len(ctx)-2] != "remote" {
+			t.Fatalf("%s: wrong context: %v", tc.network, records[0].Ctx)
+		}
+
+		rc.Close()
+		if err := <-done; err != ErrReceiverClosed {
+			t.Fatalf("%s: expected ErrReceiverClosed, got %v", tc.network, err)
+		}
+	}
+}
+
+func TestReceiverCloseWaitsForConnections(t *testing.T) {
+	t.Parallel()
+
+	for i := 0; i < 20; i++ {
+		var closed, late atomic.Bool
+		rc := &Receiver{Handler: log.FuncHandler(func(r *log.Record) error {
+			if closed.Load() {
+				late.Store(true)
+			}
+			return nil
+		})}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error, 1)
+		go func() { done <- rc.Serve(l) }()
+
+		// keep connecting while the receiver is closed
+		stop := make(chan struct{})
+		var dialers sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			dialers.Add(1)
+			go func() {
+				defer dialers.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					conn, err := net.Dial("tcp", l.Addr().String())
+					if err != nil {
+						return
+					}
+					conn.Write(log.LogfmtFormat().Format(testRecord()))
+					conn.Close()
+				}
+			}()
+		}
+		time.Sleep(time.Millisecond)
+		rc.Close()
+		closed.Store(true)
+		close(stop)
+		dialers.Wait()
+
+		if err := <-done; err != ErrReceiverClosed {
+			t.Fatalf("expected ErrReceiverClosed, got %v", err)
+		}
+		if late.Load() {
+			t.Fatal("a record was handled after Close returned")
+		}
+	}
+}
+
+func TestReceiverCloseWaitsForDatagrams(t *testing.T) {
+	t.Parallel()
+
+	entered, release := make(chan struct{}), make(chan struct{})
+	rc := &Receiver{Handler: log.FuncHandler(func(r *log.Record) error {
+		close(entered)
+		<-release
+		return nil
+	})}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- rc.ServePacket(pc) }()
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(log.LogfmtFormat().Format(testRecord()))
+	<-entered
+
+	closed := make(chan struct{})
+	go func() {
+		rc.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Close returned while a datagram was being handled")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-closed
+	if err := <-done; err != ErrReceiverClosed {
+		t.Fatalf("expected ErrReceiverClosed, got %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package log15
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// RouteMatch determines how a Router compares the value of its key with
+// the patterns of its routes.
+type RouteMatch int
+
+// List of route matching modes
+const (
+	// RouteExact matches values equal to the pattern.
+	RouteExact RouteMatch = iota
+
+	// RoutePrefix matches values which start with the pattern. If more
+	// than one pattern matches, the longest one wins.
+	RoutePrefix
+
+	// RouteGlob matches values with the pattern syntax of path.Match,
+	// e.g. "db.*". If more than one pattern matches, the route added
+	// first wins.
+	RouteGlob
+)
+
+// RouteHandler returns a Router which sends each record to one of several
+// handlers depending on the value of key in the record's context. Records
+// which don't match any route, including those without the key, go to
+// dflt, which may be nil to drop them. For example, to write the logs of
+// the db and http components to their own files:
+//
+//	router := log.RouteHandler("component", log.RouteExact, log.StdoutHandler)
+//	router.Add("db", log.Must.FileHandler("/var/log/db.log", log.LogfmtFormat()))
+//	router.Add("http", log.Must.FileHandler("/var/log/access.log", log.LogfmtFormat()))
+//
+// Values which aren't strings are matched by their fmt.Sprint form. The
+// key may also name the record's level or message, as for
+// MatchFilterHandler. Routes may be added and removed at any time, even
+// while records are being logged.
+func RouteHandler(key string, match RouteMatch, dflt Handler) *Router {
+	r := &Router{key: key, match: match}
+	r.table.Store(&routeTable{dflt: dflt})
+	return r
+}
+
+// Router is the Handler returned by RouteHandler.
+type Router struct {
+	key   string
+	match RouteMatch
+
+	mu    sync.Mutex   // serializes changes to table
+	table atomic.Value // *routeTable, replaced on every change
+}
+
+type route struct {
+	pattern string
+	h       Handler
+}
+
+type routeTable struct {
+	routes []route
+	dflt   Handler
+}
+
+// Log implements the Handler interface.
+func (rt *Router) Log(r *Record) error {
+	v, ok := rt.value(r)
+	h := rt.table.Load().(*routeTable).lookup(rt.match, v, ok)
+	if h == nil {
+		return nil
+	}
+	return h.Log(r)
+}
+
+// value returns the value of the router's key in r and whether r has one.
+func (rt *Router) value(r *Record) (string, bool) {
+	var v interface{}
+	switch rt.key {
+	case r.KeyNames.Lvl:
+		v = r.Lvl.String()
+	case r.KeyNames.Msg:
+		v = r.Msg
+	default:
+		found := false
+		for i := 0; i < len(r.Ctx); i += 2 {
+			if r.Ctx[i] == rt.key {
+				v, found = r.Ctx[i+1], true
+				break
+			}
+		}
+		if !found {
+			return "", false
+		}
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		s = fmt.Sprint(v)
+	}
+	return s, true
+}
+
+func (t *routeTable) lookup(match RouteMatch, value string, ok bool) Handler {
+	if !ok {
+		return t.dflt
+	}
+
+	best := -1
+	for i, r := range t.routes {
+		switch match {
+		case RouteExact:
+			if value == r.pattern {
+				return r.h
+			}
+		case RoutePrefix:
+			if strings.HasPrefix(value, r.pattern) && (best < 0 || len(r.pattern) > len(t.routes[best].pattern)) {
+				best = i
+			}
+		case RouteGlob:
+			if ok, _ := path.Match(r.pattern, value); ok {
+				return r.h
+			}
+		}
+	}
+	if best >= 0 {
+		return t.routes[best].h
+	}
+	return t.dflt
+}
+
+// Add routes records matching pattern to h. If the router already has a
+// route with the same pattern, its handler is replaced.
+func (rt *Router) Add(pattern string, h Handler) {
+	rt.update(func(t *routeTable) {
+		for i, r := range t.routes {
+			if r.pattern == pattern {
+				t.routes[i].h = h
+				return
+			}
+		}
+		t.routes = append(t.routes, route{pattern, h})
+	})
+}
+
+// Remove removes the route with the given pattern, if any. Records which
+// matched it go to another matching route or the default handler.
+func (rt *Router) Remove(pattern string) {
+	rt.update(func(t *routeTable) {
+		for i, r := range t.routes {
+			if r.pattern == pattern {
+				t.routes = append(t.routes[:i], t.routes[i+1:]...)
+				return
+			}
+		}
+	})
+}
+
+// SetDefault replaces the handler for records which don't match any
+// route. It may be nil to drop them.
+func (rt *Router) SetDefault(h Handler) {
+	rt.update(func(t *routeTable) {
+		t.dflt = h
+	})
+}
+
+// Patterns returns the patterns of the router's routes in the order they
+// were added.
+func (rt *Router) Patterns() []string {
+	t := rt.table.Load().(*routeTable)
+	patterns := make([]string, len(t.routes))
+	for i, r := range t.routes {
+		patterns[i] = r.pattern
+	}
+	return patterns
+}
+
+// update applies fn to a copy of the routing table and swaps it in, so
+// that Log never sees a table which is being changed.
+func (rt *Router) update(fn func(t *routeTable)) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	old := rt.table.Load().(*routeTable)
+	t := &routeTable{
+		routes: append([]route(nil), old.routes...),
+		dflt:   old.dflt,
+	}
+	fn(t)
+	rt.table.Store(t)
+}
@@ -0,0 +1,190 @@
+package log15
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// captureCallers is set once any handler needs the call site of records.
+// Until then loggers don't pay for walking the stack.
+var captureCallers atomic.Bool
+
+// CaptureCallers makes every Logger record the program counter of its call
+// sites in Record.PC. CallerFileHandler, CallerFuncHandler and
+// CallerStackHandler call it for you; a custom handler which reads
+// Record.PC must call it when it is created.
+func CaptureCallers() {
+	captureCallers.Store(true)
+}
+
+// helpers is the set of names of the functions marked with Helper.
+var helpers sync.Map
+
+// Helper marks the calling function as a logging helper. When a Logger
+// records the call site of a log record, it passes over helper functions
+// so that CallerFileHandler, CallerFuncHandler and CallerStackHandler
+// report the code which called the helper instead. Like testing.T.Helper,
+// Helper is meant to be called at the start of the helper function:
+//
+//	func logRequest(l log.Logger, r *http.Request) {
+//	    log.Helper()
+//	    l.Info("request", "method", r.Method, "path", r.URL.Path)
+//	}
+func Helper() {
+	var pc [1]uintptr
+	if runtime.Callers(2, pc[:]) == 0 {
+		return
+	}
+	frame, _ := runtime.CallersFrames(pc[:]).Next()
+	if _, ok := helpers.Load(frame.Function); !ok {
+		helpers.Store(frame.Function, struct{}{})
+	}
+}
+
+// callerPC returns the program counter of the call site skip frames above
+// the caller of callerPC, passing over any functions marked with Helper.
+func callerPC(skip int) uintptr {
+	var pc [1]uintptr
+	for {
+		// account for runtime.Callers and callerPC itself
+		if runtime.Callers(skip+2, pc[:]) == 0 {
+			return 0
+		}
+		frame, _ := runtime.CallersFrames(pc[:]).Next()
+		if _, ok := helpers.Load(frame.Function); !ok {
+			return pc[0]
+		}
+		skip++
+	}
+}
+
+// callerFrame returns the frame of the call site at pc.
+func callerFrame(pc uintptr) runtime.Frame {
+	if pc == 0 {
+		return runtime.Frame{}
+	}
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	return frame
+}
+
+// callerStack returns the frames of the current goroutine's stack from the
+// call site at pc down to the last frame outside of the standard library.
+func callerStack(pc uintptr) []runtime.Frame {
+	site := callerFrame(pc)
+	if site.PC == 0 {
+		return nil
+	}
+
+	pcs := make([]uintptr, 64)
+	for {
+		n := runtime.Callers(2, pcs)
+		if n < len(pcs) {
+			pcs = pcs[:n]
+			break
+		}
+		pcs = make([]uintptr, 2*len(pcs))
+	}
+
+	var stack []runtime.Frame
+	frames := runtime.CallersFrames(pcs)
+	for {
+		frame, more := frames.Next()
+		if stack != nil || frame.PC == site.PC && frame.Function == site.Function {
+			stack = append(stack, frame)
+		}
+		if !more {
+			break
+		}
+	}
+
+	// trim the runtime and testing frames below the program's entry point
+	for len(stack) > 0 && isStdlib(stack[len(stack)-1].Function) {
+		stack = stack[:len(stack)-1]
+	}
+	return stack
+}
+
+// isStdlib reports whether fn belongs to a package of the standard library,
+// whose import paths don't have a dot in their first element.
+func isStdlib(fn string) bool {
+	pkg := funcPackage(fn)
+	if pkg == "main" {
+		return false
+	}
+	if i := strings.IndexByte(pkg, '/'); i >= 0 {
+		pkg = pkg[:i]
+	}
+	return !strings.Contains(pkg, ".")
+}
+
+// funcPackage returns the import path of the package of the fully
+// qualified function name fn.
+func funcPackage(fn string) string {
+	slash := strings.LastIndexByte(fn, '/')
+	if dot := strings.IndexByte(fn[slash+1:], '.'); dot >= 0 {
+		return fn[:slash+1+dot]
+	}
+	return fn
+}
+
+// call formats a call site with the same verbs as the Call type of
+// github.com/go-stack/stack:
+//
+//	%s    source file
+//	%d    line number
+//	%n    function name
+//	%v    equivalent to %s:%d
+//
+// The s and v verbs accept the + flag to print the source file path
+// relative to its package's import path, and the # flag to print the
+// full path. The n verb accepts the + flag to print the import path of
+// the function's package as well.
+type call runtime.Frame
+
+func (c call) Format(s fmt.State, verb rune) {
+	switch verb {
+	case 's', 'v':
+		file := c.File
+		switch {
+		case s.Flag('#'):
+		case s.Flag('+'):
+			file = funcPackage(c.Function) + "/" + filepath.Base(file)
+		default:
+			file = filepath.Base(file)
+		}
+		io.WriteString(s, file)
+		if verb == 'v' {
+			io.WriteString(s, ":")
+			io.WriteString(s, strconv.Itoa(c.Line))
+		}
+	case 'd':
+		io.WriteString(s, strconv.Itoa(c.Line))
+	case 'n':
+		name := c.Function
+		if !s.Flag('+') {
+			name = strings.TrimPrefix(name, funcPackage(name)+".")
+		}
+		io.WriteString(s, name)
+	}
+}
+
+// callStack formats a list of call sites as a space separated list
+// inside []'s, each formatted with the verb and flags given to Format.
+type callStack []runtime.Frame
+
+func (cs callStack) Format(s fmt.State, verb rune) {
+	io.WriteString(s, "[")
+	for i, frame := range cs {
+		if i > 0 {
+			io.WriteString(s, " ")
+		}
+		call(frame).Format(s, verb)
+	}
+	io.WriteString(s, "]")
+}
@@ -0,0 +1,155 @@
+package log15
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"testing"
+)
+
+func testHandler() (Handler, *Record) {
+	rec := new(Record)
+	return FuncHandler(func(r Record) error {
+		*rec = r
+		return nil
+	}), rec
+}
+
+func TestCallerFileHandler(t *testing.T) {
+	t.Parallel()
+
+	l := New()
+	h, r := testHandler()
+	l.SetHandler(CallerFileHandler(h))
+
+	l.Info("baz")
+	_, _, line, _ := runtime.Caller(0)
+
+	if len(r.Ctx) != 2 {
+		t.Fatalf("Expected caller in record context. Got length %d, expected %d", len(r.Ctx), 2)
+	}
+
+	const key = "caller"
+
+	if r.Ctx[0] != key {
+		t.Fatalf("Wrong context key, got %s expected %s", r.Ctx[0], key)
+	}
+
+	exp := fmt.Sprint("caller_test.go:", line-1)
+	if r.Ctx[1] != exp {
+		t.Fatalf("Wrong context value, got %s expected string matching %s", r.Ctx[1], exp)
+	}
+}
+
+func TestCallerFuncHandler(t *testing.T) {
+	t.Parallel()
+
+	l := New()
+	h, r := testHandler()
+	l.SetHandler(CallerFuncHandler(h))
+
+	l.Info("baz")
+
+	if len(r.Ctx) != 2 {
+		t.Fatalf("Expected caller in record context. Got length %d, expected %d", len(r.Ctx), 2)
+	}
+
+	const regex = "^github.com/inconshreveable/log15/v3\\.TestCallerFuncHandler$"
+
+	s, ok := r.Ctx[1].(string)
+	if !ok {
+		t.Fatalf("Wrong context value type, got %T expected string", r.Ctx[1])
+	}
+
+	if !regexp.MustCompile(regex).MatchString(s) {
+		t.Fatalf("Wrong context value, got %s expected string matching %s", s, regex)
+	}
+}
+
+func TestCallerStackHandler(t *testing.T) {
+	t.Parallel()
+
+	l := New()
+	h, r := testHandler()
+	l.SetHandler(CallerStackHandler("%#v", h))
+
+	lines := []int{}
+
+	func() {
+		l.Info("baz")
+		_, _, line, _ := runtime.Caller(0)
+		lines = append(lines, line-1)
+	}()
+	_, file, line, _ := runtime.Caller(0)
+	lines = append(lines, line-1)
+
+	if len(r.Ctx) != 2 {
+		t.Fatalf("Expected stack in record context. Got length %d, expected %d", len(r.Ctx), 2)
+	}
+
+	exp := "["
+	for i, line := range lines {
+		if i > 0 {
+			exp += " "
+		}
+		exp += fmt.Sprint(file, ":", line)
+	}
+	exp += "]"
+
+	if r.Ctx[1] != exp {
+		t.Fatalf("Wrong context value, got %s expected string matching %s", r.Ctx[1], exp)
+	}
+}
+
+func TestCallerFormat(t *testing.T) {
+	t.Parallel()
+
+	pc, file, line, _ := runtime.Caller(0)
+	c := call(callerFrame(pc + 1))
+
+	cases := []struct {
+		format, expected string
+	}{
+		{"%s", filepath.Base(file)},
+		{"%d", fmt.Sprint(line)},
+		{"%v", fmt.Sprint(filepath.Base(file), ":", line)},
+		{"%+v", fmt.Sprint("github.com/inconshreveable/log15/v3/", filepath.Base(file), ":", line)},
+		{"%#v", fmt.Sprint(file, ":", line)},
+		{"%n", "TestCallerFormat"},
+		{"%+n", "github.com/inconshreveable/log15/v3.TestCallerFormat"},
+	}
+
+	for _, tt := range cases {
+		if got := fmt.Sprintf(tt.format, c); got != tt.expected {
+			t.Errorf("Sprintf(%q): got %s expected %s", tt.format, got, tt.expected)
+		}
+	}
+}
+
+func logWrapper(l Logger, msg string) {
+	l.(CallerSkipLogger).WithCallerSkip(1).Info(msg)
+}
+
+func logHelper(l Logger, msg string) {
+	Helper()
+	l.Info(msg)
+}
+
+func TestCallerSkip(t *testing.T) {
+	t.Parallel()
+
+	l := New()
+	h, r := testHandler()
+	l.SetHandler(CallerFileHandler(h))
+
+	for _, fn := range []func(Logger, string){logWrapper, logHelper} {
+		fn(l, "baz")
+		_, _, line, _ := runtime.Caller(0)
+
+		exp := fmt.Sprint("caller_test.go:", line-1)
+		if r.Ctx[1] != exp {
+			t.Fatalf("Wrong caller, got %s expected %s", r.Ctx[1], exp)
+		}
+	}
+}
@@ -44,6 +44,9 @@ If you really do favor your type-safety, you may choose to pass a log.Ctx instea
 
 	log.Warn("size out of bounds", log.Ctx{"low": lowBound, "high": highBound, "val": val})
 
+The keys of a log.Ctx are always written in sorted order. To sort all context keys in the output,
+wrap a Format with log.SortedKeysFormat.
+
 # Context loggers
 
 Frequently, you want to add context to a logger so that you can track actions associated with it. An http
@@ -59,6 +62,14 @@ This will output a log line that includes the path context that is attached to t
 
 	lvl=dbug t=2014-05-02T16:07:23-0700 path=/repo/12/add_hook msg="db txn commit" duration=0.12
 
+By default, a key that is set both on the logger and at the call site is written twice. You can
+choose a different policy for a logger and all of its children:
+
+	requestlogger = requestlogger.(log.DupKeyPolicyLogger).WithDupKeyPolicy(log.DupKeysLastWins)
+
+The available policies are DupKeysKeepAll, DupKeysLastWins, DupKeysFirstWins and DupKeysRename.
+Because a JSON object can't repeat a key, JsonFormat writes the values of a repeated key as an array.
+
 # Handlers
 
 The Handler interface defines where log lines are printed to and how they are formatted. Handler is a
@@ -85,6 +96,51 @@ or above in JSON formatted output to the file /var/log/service.json
 	    log.MatchFilterHandler("pkg", "app/rpc" log.StdoutHandler())
 	)
 
+# Logging File Names and Line Numbers
+
+This package implements three Handlers that add debugging information to the
+context, CallerFileHandler, CallerFuncHandler and CallerStackHandler. Here's
+an example that adds the source file and line number of each logging call to
+the context.
+
+	h := log.CallerFileHandler(log.StdoutHandler)
+	log.Root().SetHandler(h)
+	...
+	log.Error("open file", "err", err)
+
+This will output a line that looks like:
+
+	lvl=eror t=2014-05-02T16:07:23-0700 msg="open file" err="file not found" caller=data.go:42
+
+Here's an example that logs the call stack rather than just the call site.
+
+	h := log.CallerStackHandler("%+v", log.StdoutHandler)
+	log.Root().SetHandler(h)
+	...
+	log.Error("open file", "err", err)
+
+This will output a line that looks like:
+
+	lvl=eror t=2014-05-02T16:07:23-0700 msg="open file" err="file not found" stack="[pkg/data.go:42 pkg/cmd/main.go]"
+
+The "%+v" format instructs the handler to include the path of the source file
+relative to the import path of its package, and "%#v" prints the full path. The
+verbs are the same as those of the github.com/go-stack/stack package.
+
+Loggers only look up their call site once one of these handlers has been created,
+so programs that don't use them don't pay for it. A custom handler which reads
+Record.PC must call log.CaptureCallers when it is created.
+
+If you log through your own helper functions, the call site would be the helper
+rather than its caller. Either call log.Helper at the start of the helper, like
+testing.T.Helper, or log through a logger returned by WithCallerSkip, a method of
+CallerSkipLogger:
+
+	func logErr(l log.Logger, err error) {
+	    log.Helper()
+	    l.Error("operation failed", "err", err)
+	}
+
 # Custom Handlers
 
 The Handler interface is so simple that it's also trivial to write your own. Let's create an
@@ -175,6 +231,10 @@ to return errors. Instead, log15 handles errors by making these guarantees to yo
 - Any log record containing an error will include the context key LOG15_ERROR, enabling you to easily
 (and if you like, automatically) detect if any of your logging calls are passing bad values.
 
+The same goes for panics. If a Lazy function, a String or Error method, a filter function or a custom
+Format panics, the built-in handlers and formats recover and replace the offending value with a marker
+like PANIC=<value>. Use SetPanicHook to be told about these panics.
+
 Understanding this, you might wonder why the Handler interface can return an error value in its Log method. Handlers
 are encouraged to return errors only if they fail to write their log records out to an external source like if the
 syslog daemon is not responding. This allows the construction of useful handlers which cope with those failures
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -117,6 +118,46 @@ func logfmt(buf *bytes.Buffer, ctx []interface{}, color int) {
 	buf.WriteByte('\n')
 }
 
+// SortedKeysFormat returns a Format which writes the context of each
+// record sorted by key using the given Format. The time, level and message
+// keep their usual place. Combined with a fixed time, this makes the output
+// of LogfmtFormat, JsonFormat and TerminalFormat reproducible byte for byte,
+// which is useful for golden tests and diffing logs:
+//
+//	log.StreamHandler(os.Stdout, log.SortedKeysFormat(log.LogfmtFormat()))
+//
+// Values of duplicate keys stay in the order they were logged.
+func SortedKeysFormat(f Format) Format {
+	return FormatFunc(func(r Record) []byte {
+		sorted := r
+		sorted.Ctx = sortedCtx(r.Ctx)
+		return f.Format(sorted)
+	})
+}
+
+// sortedCtx returns a copy of ctx with its key/value pairs sorted by key.
+// Keys which aren't strings are moved to the end.
+func sortedCtx(ctx []interface{}) []interface{} {
+	pairs := make([]int, len(ctx)/2)
+	for i := range pairs {
+		pairs[i] = 2 * i
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		ki, iok := ctx[pairs[i]].(string)
+		kj, jok := ctx[pairs[j]].(string)
+		if iok != jok {
+			return iok
+		}
+		return ki < kj
+	})
+
+	sorted := make([]interface{}, 0, len(ctx))
+	for _, i := range pairs {
+		sorted = append(sorted, ctx[i], ctx[i+1])
+	}
+	return sorted
+}
+
 // JsonFormat formats log records as JSON objects separated by newlines.
 // It is the equivalent of JsonFormatEx(false, true).
 func JsonFormat() Format {
@@ -137,19 +178,38 @@ func JsonFormatEx(pretty, lineSeparated bool) Format {
 	return FormatFunc(func(r Record) []byte {
 		props := make(map[string]interface{})
 
-		props[r.KeyNames.Time] = r.Time
-		props[r.KeyNames.Lvl] = r.Lvl.String()
-		props[r.KeyNames.Msg] = r.Msg
-
+		// a JSON object can't repeat a key, so the values of duplicate
+		// keys are collected into an array rather than silently dropped
+		var dups map[string][]interface{}
 		for i := 0; i < len(r.Ctx); i += 2 {
 			k, ok := r.Ctx[i].(string)
 			if !ok {
 				props[errorKey] = fmt.Sprintf("%+v is not a string key", r.Ctx[i])
 			}
-			props[k] = formatJSONValue(r.Ctx[i+1])
+			v := formatJSONValue(r.Ctx[i+1])
+			if prev, seen := props[k]; ok && seen {
+				if dups == nil {
+					dups = make(map[string][]interface{})
+				}
+				if dups[k] == nil {
+					dups[k] = []interface{}{prev}
+				}
+				dups[k] = append(dups[k], v)
+			}
+			props[k] = v
 		}
+		for k, vs := range dups {
+			props[k] = vs
+		}
+
+		// the context is added first to find its duplicate keys, but it
+		// still takes precedence over the record's own keys, of which the
+		// message comes first if the key names are the same
+		setDefault(props, r.KeyNames.Msg, r.Msg)
+		setDefault(props, r.KeyNames.Lvl, r.Lvl.String())
+		setDefault(props, r.KeyNames.Time, r.Time)
 
-		b, err := jsonMarshal(props)
+		b, err := safeMarshal(jsonMarshal, props)
 		if err != nil {
 			b, _ = jsonMarshal(map[string]string{
 				errorKey: err.Error(),
@@ -165,13 +225,20 @@ func JsonFormatEx(pretty, lineSeparated bool) Format {
 	})
 }
 
+// setDefault sets props[k] to v unless k is already set.
+func setDefault(props map[string]interface{}, k string, v interface{}) {
+	if _, ok := props[k]; !ok {
+		props[k] = v
+	}
+}
+
 func formatShared(value interface{}) (result interface{}) {
 	defer func() {
 		if err := recover(); err != nil {
 			if v := reflect.ValueOf(value); v.Kind() == reflect.Ptr && v.IsNil() {
 				result = "nil"
 			} else {
-				panic(err)
+				result = reportPanic(err)
 			}
 		}
 	}()
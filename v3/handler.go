@@ -1,12 +1,15 @@
 package log15
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Handler interface defines where and how log records are written.
@@ -38,7 +41,7 @@ func (h funcHandler) Log(r Record) error {
 // to evaluate Lazy objects and perform safe concurrent writes.
 func StreamHandler(wr io.Writer, fmtr Format) Handler {
 	h := FuncHandler(func(r Record) error {
-		_, err := wr.Write(fmtr.Format(r))
+		_, err := wr.Write(safeFormat(fmtr, r))
 		return err
 	})
 	return LazyHandler(SyncHandler(h))
@@ -91,6 +94,47 @@ func (h *closingHandler) Close() error {
 	return h.WriteCloser.Close()
 }
 
+// CallerFileHandler returns a Handler that adds the line number and file of
+// the calling function to the context with key "caller".
+func CallerFileHandler(h Handler) Handler {
+	CaptureCallers()
+	return FuncHandler(func(r Record) error {
+		r.Ctx = append(r.Ctx, "caller", fmt.Sprint(call(callerFrame(r.PC))))
+		return h.Log(r)
+	})
+}
+
+// CallerFuncHandler returns a Handler that adds the calling function name to
+// the context with key "fn".
+func CallerFuncHandler(h Handler) Handler {
+	CaptureCallers()
+	return FuncHandler(func(r Record) error {
+		r.Ctx = append(r.Ctx, "fn", fmt.Sprintf("%+n", call(callerFrame(r.PC))))
+		return h.Log(r)
+	})
+}
+
+// CallerStackHandler returns a Handler that adds a stack trace to the context
+// with key "stack". The stack trace is formated as a space separated list of
+// call sites inside matching []'s. The most recent call site is listed first.
+// Each call site is formatted according to format, which supports the same
+// verbs as the Call type of package github.com/go-stack/stack: %s, %d, %n
+// and %v, with the + and # flags.
+//
+// The stack is walked when the record is handled, so the record must be
+// handled on the goroutine which logged it; put CallerStackHandler in front
+// of any BufferedHandler.
+func CallerStackHandler(format string, h Handler) Handler {
+	CaptureCallers()
+	return FuncHandler(func(r Record) error {
+		s := callerStack(r.PC)
+		if len(s) > 0 {
+			r.Ctx = append(r.Ctx, "stack", fmt.Sprintf(format, callStack(s)))
+		}
+		return h.Log(r)
+	})
+}
+
 // FilterHandler returns a Handler that only writes records to the
 // wrapped Handler if the given function evaluates true. For example,
 // to only log records where the 'err' key is not nil:
@@ -105,13 +149,25 @@ func (h *closingHandler) Close() error {
 //	}, h))
 func FilterHandler(fn func(r Record) bool, h Handler) Handler {
 	return FuncHandler(func(r Record) error {
-		if fn(r) {
+		if filter(fn, &r) {
 			return h.Log(r)
 		}
 		return nil
 	})
 }
 
+// filter reports whether fn passes r. If fn panics, r passes with the
+// panic added to its context so that it isn't silently lost.
+func filter(fn func(r Record) bool, r *Record) (pass bool) {
+	defer func() {
+		if p := recover(); p != nil {
+			r.Ctx = append(r.Ctx, errorKey, reportPanic(p))
+			pass = true
+		}
+	}()
+	return fn(*r)
+}
+
 // MatchFilterHandler returns a Handler that only writes records
 // to the wrapped Handler if the given key in the logged
 // context matches the value. For example, to only log records
@@ -158,16 +214,211 @@ func LvlFilterHandler(maxLvl Lvl, h Handler) Handler {
 //	log.MultiHandler(
 //	    log.Must.FileHandler("/var/log/app.log", log.LogfmtFormat()),
 //	    log.StderrHandler)
+//
+// Each handler is passed its own copy of the record, so handlers which
+// add to the context don't affect each other. Lazy values are evaluated
+// once, before the record is copied. Every handler is written to even if
+// some of them fail; the errors of those which failed are returned joined
+// with errors.Join.
 func MultiHandler(hs ...Handler) Handler {
 	return FuncHandler(func(r Record) error {
-		for _, h := range hs {
-			// what to do about failures?
-			h.Log(r)
+		evaluateLazies(&r)
+		var errs []error
+		for i, h := range hs {
+			if err := h.Log(r.Clone()); err != nil {
+				errs = append(errs, fmt.Errorf("handler %d: %w", i, err))
+			}
 		}
-		return nil
+		return errors.Join(errs...)
 	})
 }
 
+// ErrHandlerTimeout is the error reported for a handler which didn't
+// finish within the timeout of a ParallelMultiHandler.
+var ErrHandlerTimeout = errors.New("log15: handler timed out")
+
+// ErrHandlerClosed is returned for the records logged to a
+// ParallelMultiHandler after Close.
+var ErrHandlerClosed = errors.New("log15: handler is closed")
+
+// ErrHandlerBusy is the error reported for a handler of a
+// ParallelMultiHandler whose queue is full. The record is dropped for
+// that handler.
+var ErrHandlerBusy = errors.New("log15: handler busy, record dropped")
+
+// parallelQueueSize is the number of records which wait for a handler of
+// a ParallelMultiHandler.
+const parallelQueueSize = 100
+
+// ParallelMultiHandler is like MultiHandler, but writes to all of its
+// handlers concurrently so that a slow handler doesn't delay the others.
+// It waits for every handler to finish, but if timeout is positive, no
+// longer than timeout for each of them, counted from the moment the
+// handler starts on the record. A record which waits in the queue of a
+// handler for longer than timeout is given up on too. A handler which
+// takes longer is reported as having failed with ErrHandlerTimeout and is
+// left to finish in the background.
+//
+// Each handler is written to by its own goroutine, which the records
+// wait for in a queue. When the queue of a handler is full, like when
+// the handler hangs, its records are dropped and reported with
+// ErrHandlerBusy. The returned handler has the methods
+//
+//	Dropped() uint64
+//	Close() error
+//
+// Dropped returns the number of records dropped so far. Close stops the
+// goroutines once they have written the records in their queues, and
+// closes the handlers which implement io.Closer. Records logged after
+// Close fail with ErrHandlerClosed.
+func ParallelMultiHandler(timeout time.Duration, hs ...Handler) Handler {
+	h := &parallelMultiHandler{timeout: timeout, handlers: hs, queues: make([]chan parallelJob, len(hs))}
+	h.workers.Add(len(hs))
+	for i, child := range hs {
+		h.queues[i] = make(chan parallelJob, parallelQueueSize)
+		go func(i int, child Handler, queue chan parallelJob) {
+			defer h.workers.Done()
+			for job := range queue {
+				job.events <- parallelEvent{idx: i, started: true}
+				job.events <- parallelEvent{idx: i, err: child.Log(job.r)}
+			}
+		}(i, child, h.queues[i])
+	}
+	return h
+}
+
+type parallelMultiHandler struct {
+	timeout  time.Duration
+	handlers []Handler
+	queues   []chan parallelJob
+	workers  sync.WaitGroup
+	dropped  atomic.Uint64
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+type parallelJob struct {
+	r      Record
+	events chan<- parallelEvent
+}
+
+// parallelEvent tells Log that a handler started on its record, finished
+// it with err, or, if timeout is set, that it took too long. The timeouts
+// of gen other than the current one of the handler are stale.
+type parallelEvent struct {
+	idx     int
+	started bool
+	timeout bool
+	gen     int
+	err     error
+}
+
+func (h *parallelMultiHandler) Log(r Record) error {
+	evaluateLazies(&r)
+	n := len(h.queues)
+	// the workers and the timers never block on events: each handler
+	// sends at most a start, a result and two timeouts
+	events := make(chan parallelEvent, 4*n)
+	errs := make([]error, n)
+	finished := make([]bool, n)
+	timers := make([]*time.Timer, n)
+	gens := make([]int, n)
+	defer func() {
+		for _, t := range timers {
+			if t != nil {
+				t.Stop()
+			}
+		}
+	}()
+	startTimer := func(i int) {
+		if h.timeout > 0 {
+			ev := parallelEvent{idx: i, timeout: true, gen: gens[i]}
+			timers[i] = time.AfterFunc(h.timeout, func() { events <- ev })
+		}
+	}
+
+	h.mu.RLock()
+	if h.closed {
+		h.mu.RUnlock()
+		return ErrHandlerClosed
+	}
+	pending := 0
+	for i, queue := range h.queues {
+		select {
+		case queue <- parallelJob{r.Clone(), events}:
+			pending++
+			startTimer(i)
+		default:
+			h.dropped.Add(1)
+			errs[i], finished[i] = ErrHandlerBusy, true
+		}
+	}
+	h.mu.RUnlock()
+
+	for pending > 0 {
+		ev := <-events
+		switch {
+		case finished[ev.idx]:
+		case ev.started:
+			// the time in the queue is over, the handler gets its own
+			if timers[ev.idx] != nil {
+				timers[ev.idx].Stop()
+			}
+			gens[ev.idx]++
+			startTimer(ev.idx)
+		case ev.timeout:
+			if ev.gen == gens[ev.idx] {
+				errs[ev.idx], finished[ev.idx] = ErrHandlerTimeout, true
+				pending--
+			}
+		default:
+			errs[ev.idx], finished[ev.idx] = ev.err, true
+			pending--
+		}
+	}
+
+	var joined []error
+	for i, err := range errs {
+		if err != nil {
+			joined = append(joined, fmt.Errorf("handler %d: %w", i, err))
+		}
+	}
+	return errors.Join(joined...)
+}
+
+// Dropped returns the number of records dropped because the queue of a
+// handler was full.
+func (h *parallelMultiHandler) Dropped() uint64 {
+	return h.dropped.Load()
+}
+
+// Close stops the workers once their queues are empty and closes the
+// handlers which implement io.Closer.
+func (h *parallelMultiHandler) Close() error {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return nil
+	}
+	h.closed = true
+	for _, queue := range h.queues {
+		close(queue)
+	}
+	h.mu.Unlock()
+
+	h.workers.Wait()
+	var errs []error
+	for _, child := range h.handlers {
+		if c, ok := child.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
 // FailoverHandler writes all log records to the first handler
 // specified, but will failover and write to the second handler if
 // the first handler has failed, and so on for all handlers specified.
@@ -199,7 +450,7 @@ func FailoverHandler(hs ...Handler) Handler {
 
 // ChannelHandler writes all records to the given channel.
 // It blocks if the channel is full. Useful for async processing
-// of log messages, it's used by BufferedHandler.
+// of log messages.
 func ChannelHandler(recs chan<- Record) Handler {
 	return FuncHandler(func(r Record) error {
 		recs <- r
@@ -212,14 +463,36 @@ func ChannelHandler(recs chan<- Record) Handler {
 // handler whenever it is available for writing. Since these
 // writes happen asynchronously, all writes to a BufferedHandler
 // never return an error and any errors from the wrapped handler are ignored.
+// The records for which the wrapped handler returns an error are counted
+// as dropped by the Dropped method of the returned handler:
+//
+//	Dropped() uint64
 func BufferedHandler(bufSize int, h Handler) Handler {
-	recs := make(chan Record, bufSize)
+	b := &bufferedHandler{recs: make(chan Record, bufSize)}
 	go func() {
-		for m := range recs {
-			_ = h.Log(m)
+		for m := range b.recs {
+			if err := h.Log(m); err != nil {
+				b.dropped.Add(1)
+			}
 		}
 	}()
-	return ChannelHandler(recs)
+	return b
+}
+
+type bufferedHandler struct {
+	recs    chan Record
+	dropped atomic.Uint64
+}
+
+func (b *bufferedHandler) Log(r Record) error {
+	b.recs <- r
+	return nil
+}
+
+// Dropped returns the number of records which the wrapped handler failed
+// to write.
+func (b *bufferedHandler) Dropped() uint64 {
+	return b.dropped.Load()
 }
 
 // LazyHandler writes all values to the wrapped handler after evaluating
@@ -228,31 +501,42 @@ func BufferedHandler(bufSize int, h Handler) Handler {
 // it if you write your own Handler.
 func LazyHandler(h Handler) Handler {
 	return FuncHandler(func(r Record) error {
-		// go through the values (odd indices) and reassign
-		// the values of any lazy fn to the result of its execution
-		hadErr := false
-		for i := 1; i < len(r.Ctx); i += 2 {
-			lz, ok := r.Ctx[i].(Lazy)
-			if ok {
-				v, err := evaluateLazy(lz)
-				if err != nil {
-					hadErr = true
-					r.Ctx[i] = err
-				} else {
-					r.Ctx[i] = v
-				}
-			}
-		}
+		evaluateLazies(&r)
+		return h.Log(r)
+	})
+}
 
-		if hadErr {
-			r.Ctx = append(r.Ctx, errorKey, "bad lazy")
+// evaluateLazies replaces the lazy values in the context of r by the
+// results of their functions.
+func evaluateLazies(r *Record) {
+	// go through the values (odd indices) and reassign
+	// the values of any lazy fn to the result of its execution
+	hadErr := false
+	for i := 1; i < len(r.Ctx); i += 2 {
+		lz, ok := r.Ctx[i].(Lazy)
+		if ok {
+			v, err := evaluateLazy(lz)
+			if err != nil {
+				hadErr = true
+				r.Ctx[i] = err
+			} else {
+				r.Ctx[i] = v
+			}
 		}
+	}
 
-		return h.Log(r)
-	})
+	if hadErr {
+		r.Ctx = append(r.Ctx, errorKey, "bad lazy")
+	}
 }
 
-func evaluateLazy(lz Lazy) (interface{}, error) {
+func evaluateLazy(lz Lazy) (result interface{}, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			result, err = reportPanic(p), nil
+		}
+	}()
+
 	t := reflect.TypeOf(lz.Fn)
 
 	if t.Kind() != reflect.Func {
@@ -0,0 +1,149 @@
+package log15
+
+import (
+	"errors"
+	"io"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBufferedHandlerDropped(t *testing.T) {
+	t.Parallel()
+
+	h := BufferedHandler(1, FuncHandler(func(r Record) error {
+		return errors.New("fail")
+	}))
+	l := New()
+	l.SetHandler(h)
+	for i := 0; i < 3; i++ {
+		l.Info("test")
+	}
+
+	d := h.(interface{ Dropped() uint64 })
+	for deadline := time.Now().Add(5 * time.Second); d.Dropped() != 3; {
+		if time.Now().After(deadline) {
+			t.Fatalf("wrong drop count: %d", d.Dropped())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMultiHandlerErrors(t *testing.T) {
+	t.Parallel()
+
+	h, r := testHandler()
+	fail := FuncHandler(func(r Record) error {
+		return errors.New("fail")
+	})
+	l := New()
+	l.SetHandler(MultiHandler(fail, h, fail))
+
+	err := l.GetHandler().Log(Record{Msg: "test"})
+	if err == nil || err.Error() != "handler 0: fail\nhandler 2: fail" {
+		t.Fatalf("expected joined child errors, got %v", err)
+	}
+	if r.Msg != "test" {
+		t.Fatalf("expected handler after a failing one to be written to")
+	}
+}
+
+func TestMultiHandlerCopiesRecord(t *testing.T) {
+	t.Parallel()
+
+	h, r := testHandler()
+	add := FuncHandler(func(r Record) error {
+		r.Ctx = append(r.Ctx, "added", true)
+		return nil
+	})
+	ctx := make([]interface{}, 2, 4)
+	ctx[0], ctx[1] = "x", 1
+	l := New()
+	l.SetHandler(MultiHandler(add, h))
+	l.GetHandler().Log(Record{Msg: "test", Ctx: ctx})
+
+	if len(r.Ctx) != 2 || ctx[:4][2] != nil {
+		t.Fatalf("a handler saw the context added by another one: %v", r.Ctx)
+	}
+}
+
+func TestParallelMultiHandler(t *testing.T) {
+	t.Parallel()
+
+	h, r := testHandler()
+	block := make(chan struct{})
+	defer close(block)
+	slow := FuncHandler(func(r Record) error {
+		<-block
+		return nil
+	})
+
+	err := ParallelMultiHandler(10*time.Millisecond, slow, h).Log(Record{Msg: "test"})
+	if !errors.Is(err, ErrHandlerTimeout) {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+	if r.Msg != "test" {
+		t.Fatalf("expected fast handler to be written to")
+	}
+}
+
+func TestParallelMultiHandlerTimeoutPerHandler(t *testing.T) {
+	t.Parallel()
+
+	slow := FuncHandler(func(r Record) error {
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	})
+	pm := ParallelMultiHandler(150*time.Millisecond, slow)
+	defer pm.(io.Closer).Close()
+
+	// the second record waits for the first one, then gets its own
+	// timeout rather than what is left of a shared deadline
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- pm.Log(Record{Msg: "test"}) }()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("expected no timeout, got %v", err)
+		}
+	}
+}
+
+type closeHandler struct {
+	closed atomic.Bool
+}
+
+func (h *closeHandler) Log(r Record) error {
+	return nil
+}
+
+func (h *closeHandler) Close() error {
+	h.closed.Store(true)
+	return nil
+}
+
+func TestParallelMultiHandlerClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+	var children [3]closeHandler
+	pm := ParallelMultiHandler(time.Second, &children[0], &children[1], &children[2])
+	if err := pm.Log(Record{Msg: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pm.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range children {
+		if !children[i].closed.Load() {
+			t.Fatalf("handler %d wasn't closed", i)
+		}
+	}
+	if err := pm.Log(Record{Msg: "test"}); !errors.Is(err, ErrHandlerClosed) {
+		t.Fatalf("expected ErrHandlerClosed after Close, got %v", err)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Fatalf("goroutines grew from %d to %d after Close", before, n)
+	}
+}
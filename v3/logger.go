@@ -2,6 +2,7 @@ package log15
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 )
@@ -72,6 +73,19 @@ type Record struct {
 	Msg      string
 	Ctx      []interface{}
 	KeyNames *RecordKeyNames
+
+	// PC is the program counter of the call site, or zero. Loggers only
+	// record it once CaptureCallers has been called.
+	PC uintptr
+}
+
+// Clone returns a copy of r with its own context, so that changes to the
+// context of the copy don't affect r. Handlers which keep a record after
+// Log returns, or change its context, should work on a clone, since the
+// handlers which log it after them may change it too.
+func (r Record) Clone() Record {
+	r.Ctx = append(make([]interface{}, 0, len(r.Ctx)), r.Ctx...)
+	return r
 }
 
 // RecordKeyNames are the predefined names of the log props used by the Logger interface.
@@ -106,27 +120,76 @@ type Logger interface {
 	Crit(msg string, ctx ...interface{})
 }
 
+// DupKeyPolicyLogger is implemented by the loggers which can resolve
+// duplicate context keys, like the ones returned by New and Root.
+type DupKeyPolicyLogger interface {
+	Logger
+
+	// WithDupKeyPolicy returns a new Logger with this logger's context and
+	// handler which resolves duplicate context keys according to p.
+	WithDupKeyPolicy(p DupKeyPolicy) Logger
+}
+
+// CallerSkipLogger is implemented by the loggers which can report the call
+// site of a function which wraps them, like the ones returned by New and
+// Root.
+type CallerSkipLogger interface {
+	Logger
+
+	// WithCallerSkip returns a new Logger with this logger's context and
+	// handler which reports the call site skip additional frames up the
+	// stack. It's meant for functions which wrap a Logger.
+	WithCallerSkip(skip int) Logger
+}
+
 type logger struct {
-	ctx []interface{}
-	h   *swapHandler
+	ctx        []interface{}
+	h          *swapHandler
+	dupKeys    DupKeyPolicy
+	callerSkip int
 }
 
 func (l *logger) write(msg string, lvl Lvl, ctx []interface{}) {
+	var pc uintptr
+	if captureCallers.Load() {
+		pc = callerPC(2 + l.callerSkip)
+	}
 	l.h.Log(Record{
 		Time:     time.Now(),
 		Lvl:      lvl,
 		Msg:      msg,
-		Ctx:      newContext(l.ctx, ctx),
+		Ctx:      l.dupKeys.resolve(newContext(l.ctx, ctx)),
 		KeyNames: DefaultRecordKeyNames,
+		PC:       pc,
 	})
 }
 
 func (l *logger) New(ctx ...interface{}) Logger {
-	child := &logger{newContext(l.ctx, ctx), new(swapHandler)}
-	child.SetHandler(l.h)
+	return l.child(l.dupKeys.resolve(newContext(l.ctx, ctx)))
+}
+
+func (l *logger) WithDupKeyPolicy(p DupKeyPolicy) Logger {
+	child := l.child(p.resolve(l.ctx))
+	child.dupKeys = p
+	return child
+}
+
+func (l *logger) WithCallerSkip(skip int) Logger {
+	child := l.child(l.ctx)
+	child.callerSkip += skip
 	return child
 }
 
+// child returns a logger with the given context and the same settings
+// as l which writes to l's handler.
+func (l *logger) child(ctx []interface{}) *logger {
+	child := *l
+	child.ctx = ctx
+	child.h = new(swapHandler)
+	child.SetHandler(l.h)
+	return &child
+}
+
 func newContext(prefix []interface{}, suffix []interface{}) []interface{} {
 	normalizedSuffix := normalize(suffix)
 	newCtx := make([]interface{}, len(prefix)+len(normalizedSuffix))
@@ -163,6 +226,80 @@ func (l *logger) SetHandler(h Handler) {
 	l.h.Swap(h)
 }
 
+// DupKeyPolicy determines how a Logger resolves context keys which are
+// set more than once, for example once by New and again at the call site.
+type DupKeyPolicy int
+
+// List of duplicate key policies
+const (
+	// DupKeysKeepAll keeps every key/value pair. It is the default.
+	DupKeysKeepAll DupKeyPolicy = iota
+
+	// DupKeysLastWins keeps the most recently set value of a key in
+	// the position where the key first appeared.
+	DupKeysLastWins
+
+	// DupKeysFirstWins keeps the first value of a key and drops the rest.
+	DupKeysFirstWins
+
+	// DupKeysRename keeps every value but renames each repeated key
+	// by appending a numeric suffix, e.g. "user", "user_1", "user_2".
+	DupKeysRename
+)
+
+// resolve returns ctx with duplicate keys resolved according to p. It
+// never modifies ctx; a new slice is allocated only if ctx has duplicates.
+func (p DupKeyPolicy) resolve(ctx []interface{}) []interface{} {
+	if p == DupKeysKeepAll || !hasDupKeys(ctx) {
+		return ctx
+	}
+
+	resolved := make([]interface{}, 0, len(ctx))
+	// maps each key to the index of its value in resolved
+	seen := make(map[string]int, len(ctx)/2)
+	for i := 0; i < len(ctx); i += 2 {
+		k, ok := ctx[i].(string)
+		if !ok {
+			// leave bad keys for the formatter to report
+			resolved = append(resolved, ctx[i], ctx[i+1])
+			continue
+		}
+
+		j, dup := seen[k]
+		if dup {
+			switch p {
+			case DupKeysLastWins:
+				resolved[j] = ctx[i+1]
+				continue
+			case DupKeysFirstWins:
+				continue
+			case DupKeysRename:
+				base := k
+				for n := 1; dup; n++ {
+					k = fmt.Sprintf("%s_%d", base, n)
+					_, dup = seen[k]
+				}
+			}
+		}
+		seen[k] = len(resolved) + 1
+		resolved = append(resolved, k, ctx[i+1])
+	}
+	return resolved
+}
+
+func hasDupKeys(ctx []interface{}) bool {
+	seen := make(map[string]struct{}, len(ctx)/2)
+	for i := 0; i < len(ctx); i += 2 {
+		if k, ok := ctx[i].(string); ok {
+			if _, dup := seen[k]; dup {
+				return true
+			}
+			seen[k] = struct{}{}
+		}
+	}
+	return false
+}
+
 func normalize(ctx []interface{}) []interface{} {
 	// if the caller passed a Ctx object, then expand it
 	if len(ctx) == 1 {
@@ -199,16 +336,22 @@ type Lazy struct {
 // Ctx is a map of key/value pairs to pass as context to a log function
 // Use this only if you really need greater safety around the arguments you pass
 // to the logging functions.
+//
+// A Ctx is expanded in order of its keys so that the same Ctx always
+// produces the same output.
 type Ctx map[string]interface{}
 
 func (c Ctx) toArray() []interface{} {
-	arr := make([]interface{}, len(c)*2)
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
 
-	i := 0
-	for k, v := range c {
-		arr[i] = k
-		arr[i+1] = v
-		i += 2
+	arr := make([]interface{}, len(c)*2)
+	for i, k := range keys {
+		arr[2*i] = k
+		arr[2*i+1] = c[k]
 	}
 
 	return arr
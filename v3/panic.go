@@ -0,0 +1,96 @@
+package log15
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// A PanicError describes a panic which was recovered from user code, like a
+// Lazy function, a String or Error method or a custom Format, while a record
+// was handled.
+type PanicError struct {
+	// Value is the value passed to panic.
+	Value interface{}
+
+	// Stack is the stack trace of the goroutine which panicked.
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("log15: recovered panic: %v", e.Value)
+}
+
+var panicHook atomic.Value
+
+// SetPanicHook sets a function which is called with every panic that
+// the built-in handlers and formats recover from user code. The record
+// is still delivered with the offending value replaced by a marker of
+// the form "PANIC=<value>". The hook is called synchronously from the
+// goroutine which handles the record, so it must not log through the
+// handler which panicked. Passing nil removes the hook.
+func SetPanicHook(fn func(err *PanicError)) {
+	panicHook.Store(fn)
+}
+
+// reportPanic reports p, a value recovered from a panic, to the panic hook
+// and returns the marker which replaces the value which caused it.
+func reportPanic(p interface{}) string {
+	if fn, _ := panicHook.Load().(func(*PanicError)); fn != nil {
+		fn(&PanicError{Value: p, Stack: debug.Stack()})
+	}
+	return fmt.Sprintf("PANIC=%v", p)
+}
+
+// SafeFormat returns a Format which formats records with fmtr, but
+// recovers if fmtr panics, for example in the String method of a value.
+// The record is then formatted with LogfmtFormat instead, with the panic
+// added to its context and reported to the panic hook. The built-in
+// handlers which take a Format already do this; handlers implemented
+// elsewhere should wrap the Format they are given:
+//
+//	fmtr = log.SafeFormat(fmtr)
+func SafeFormat(fmtr Format) Format {
+	return FormatFunc(func(r Record) []byte {
+		return safeFormat(fmtr, r)
+	})
+}
+
+// safeFormat formats r with fmtr. If fmtr panics, r is formatted with
+// LogfmtFormat instead and the panic is added to its context.
+func safeFormat(fmtr Format, r Record) (b []byte) {
+	defer func() {
+		if p := recover(); p != nil {
+			r.Ctx = append(r.Ctx[:len(r.Ctx):len(r.Ctx)], errorKey, reportPanic(p))
+			b = LogfmtFormat().Format(r)
+		}
+	}()
+	return fmtr.Format(r)
+}
+
+// safeMarshal marshals props. If a value's MarshalJSON method panics,
+// the value is replaced by a panic marker and props is marshaled again.
+func safeMarshal(marshal func(v interface{}) ([]byte, error), props map[string]interface{}) (b []byte, err error) {
+	defer func() {
+		if recover() != nil {
+			for k, v := range props {
+				if p := marshalPanic(v); p != nil {
+					props[k] = reportPanic(p)
+				}
+			}
+			b, err = marshal(props)
+		}
+	}()
+	return marshal(props)
+}
+
+// marshalPanic returns the value recovered from marshaling v, or nil
+// if marshaling v doesn't panic.
+func marshalPanic(v interface{}) (p interface{}) {
+	defer func() {
+		p = recover()
+	}()
+	_, _ = json.Marshal(v)
+	return nil
+}
@@ -0,0 +1,102 @@
+package log15
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+type panicStringer struct{}
+
+func (panicStringer) String() string {
+	panic("bad stringer")
+}
+
+type panicMarshaler struct{}
+
+func (panicMarshaler) MarshalJSON() ([]byte, error) {
+	panic("bad marshaler")
+}
+
+func testFormatter(f Format) (Logger, *bytes.Buffer) {
+	l := New()
+	var buf bytes.Buffer
+	l.SetHandler(StreamHandler(&buf, f))
+	return l, &buf
+}
+
+func TestPanicLazy(t *testing.T) {
+	t.Parallel()
+
+	l := New()
+	h, r := testHandler()
+	l.SetHandler(LazyHandler(h))
+	l.Info("", "x", Lazy{func() int { panic("bad lazy") }})
+	if r.Ctx[1] != "PANIC=bad lazy" {
+		t.Fatalf("Expected panic marker, got %v", r.Ctx[1])
+	}
+}
+
+func TestPanicStringer(t *testing.T) {
+	t.Parallel()
+
+	l, buf := testFormatter(LogfmtFormat())
+	l.Info("test", "x", panicStringer{}, "y", 1)
+
+	expected := "lvl=info msg=test x=\"PANIC=bad stringer\" y=1\n"
+	if got := buf.String(); !strings.HasSuffix(got, expected) {
+		t.Fatalf("Got %s, expected %s", got, expected)
+	}
+}
+
+func TestPanicMarshaler(t *testing.T) {
+	t.Parallel()
+
+	l, buf := testFormatter(JsonFormat())
+	l.Info("test", "x", panicMarshaler{}, "y", 1)
+
+	var v map[string]interface{}
+	if err := json.NewDecoder(buf).Decode(&v); err != nil {
+		t.Fatalf("Error decoding JSON: %v", err)
+	}
+	if v["x"] != "PANIC=bad marshaler" || v["y"] != float64(1) {
+		t.Fatalf("Expected panic marker, got %v", v)
+	}
+}
+
+func TestPanicFormat(t *testing.T) {
+	t.Parallel()
+
+	l, buf := testFormatter(FormatFunc(func(r Record) []byte {
+		panic("bad format")
+	}))
+	l.Info("test", "x", 1)
+
+	expected := "lvl=info msg=test x=1 LOG15_ERROR=\"PANIC=bad format\"\n"
+	if got := buf.String(); !strings.HasSuffix(got, expected) {
+		t.Fatalf("Got %s, expected %s", got, expected)
+	}
+}
+
+func TestPanicHook(t *testing.T) {
+	var got *PanicError
+	SetPanicHook(func(err *PanicError) {
+		got = err
+	})
+	defer SetPanicHook(nil)
+
+	l := New()
+	h, r := testHandler()
+	l.SetHandler(FilterHandler(func(r Record) bool {
+		panic("bad filter")
+	}, h))
+	l.Info("test")
+
+	if r.Msg != "test" {
+		t.Fatalf("Expected record to be delivered")
+	}
+	if got == nil || got.Value != "bad filter" || len(got.Stack) == 0 {
+		t.Fatalf("Expected panic to be reported, got %v", got)
+	}
+}
@@ -22,7 +22,7 @@ func init() {
 		StderrHandler = StreamHandler(os.Stderr, TerminalFormat())
 	}
 
-	root = &logger{[]interface{}{}, new(swapHandler)}
+	root = &logger{[]interface{}{}, new(swapHandler), DupKeysKeepAll, 0}
 	root.SetHandler(StdoutHandler)
 }
 
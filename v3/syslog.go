@@ -41,7 +41,7 @@ func sharedSyslog(fmtr Format, sysWr *syslog.Writer, err error) (Handler, error)
 			syslogFn = sysWr.Debug
 		}
 
-		s := strings.TrimSpace(string(fmtr.Format(r)))
+		s := strings.TrimSpace(string(safeFormat(fmtr, r)))
 		return syslogFn(s)
 	})
 	return LazyHandler(&closingHandler{sysWr, h}), nil